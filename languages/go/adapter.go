@@ -0,0 +1,202 @@
+package oso
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/osohq/go-oso/errors"
+	"github.com/osohq/go-oso/interfaces"
+	"github.com/osohq/go-oso/internal/host"
+)
+
+/*
+An Adapter connects data filtering to the store holding resources, such as a
+database accessed with database/sql or GORM. Set one with
+Oso.SetDataFilteringAdapter.
+
+The Filter passed to BuildQuery always constrains the resource itself with a
+FilterIsa naming the resource type, so that adapters can tell which collection
+of resources (e.g. which table) to query.
+*/
+type Adapter interface {
+	// Translate a Filter into a query against the store.
+	BuildQuery(filter *Filter) interface{}
+	// Run a query returned by BuildQuery and return the resources it matches.
+	ExecuteQuery(query interface{}) ([]interface{}, error)
+}
+
+/*
+An Adapter that filters a slice of resources held in memory, for testing
+policies that use data filtering.
+
+Resources are matched against a FilterIsa by the name of their Go type, so
+resource types must be registered under the names of their Go types.
+*/
+type MemoryAdapter struct {
+	resources []interface{}
+}
+
+func NewMemoryAdapter(resources []interface{}) *MemoryAdapter {
+	return &MemoryAdapter{resources: resources}
+}
+
+// The query for a MemoryAdapter is the filter itself.
+func (a *MemoryAdapter) BuildQuery(filter *Filter) interface{} {
+	return filter
+}
+
+func (a *MemoryAdapter) ExecuteQuery(query interface{}) ([]interface{}, error) {
+	filter, ok := query.(*Filter)
+	if !ok {
+		return nil, fmt.Errorf("Expected a *Filter query, got: %T", query)
+	}
+	results := make([]interface{}, 0)
+	for _, resource := range a.resources {
+		ok, err := matchFilter(filter, resource)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			results = append(results, resource)
+		}
+	}
+	return results, nil
+}
+
+// Check whether `resource` satisfies `filter`.
+func matchFilter(filter *Filter, resource interface{}) (bool, error) {
+	switch filter.Op {
+	case FilterAnd:
+		for _, child := range filter.Children {
+			if ok, err := matchFilter(child, resource); err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	case FilterOr:
+		for _, child := range filter.Children {
+			if ok, err := matchFilter(child, resource); err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	case FilterNot:
+		ok, err := matchFilter(filter.Children[0], resource)
+		return !ok, err
+	}
+
+	field, err := lookupField(resource, filter.Field)
+	if err != nil {
+		return false, err
+	}
+	switch filter.Op {
+	case FilterIsa:
+		if field == nil {
+			return false, nil
+		}
+		return host.ClassName(reflect.TypeOf(field)) == filter.Value, nil
+	case FilterIn:
+		return containsValue(filter.Value, field)
+	case FilterContains:
+		return containsValue(field, filter.Value)
+	}
+	return compareValues(filter.Op, field, filter.Value)
+}
+
+// Look up the field at the dot-separated `path` from `resource`.
+func lookupField(resource interface{}, path string) (interface{}, error) {
+	if path == "" {
+		return resource, nil
+	}
+	value := reflect.ValueOf(resource)
+	for _, name := range strings.Split(path, ".") {
+		for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+			value = value.Elem()
+		}
+		switch value.Kind() {
+		case reflect.Struct:
+			field, ok := host.FieldByName(value, name)
+			if !ok {
+				return nil, errors.NewMissingAttributeError(resource, path)
+			}
+			value = field
+		case reflect.Map:
+			value = value.MapIndex(reflect.ValueOf(name))
+		default:
+			value = reflect.Value{}
+		}
+		if !value.IsValid() {
+			return nil, errors.NewMissingAttributeError(resource, path)
+		}
+	}
+	return value.Interface(), nil
+}
+
+// Check whether `collection`, a slice, array or map, contains `item`. Maps
+// are checked for a key equal to `item`.
+func containsValue(collection interface{}, item interface{}) (bool, error) {
+	value := reflect.Indirect(reflect.ValueOf(collection))
+	switch value.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			if ok, err := compareValues(FilterEq, value.Index(i).Interface(), item); err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	case reflect.Map:
+		for _, key := range value.MapKeys() {
+			if ok, err := compareValues(FilterEq, key.Interface(), item); err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("Cannot check whether %T contains a value", collection)
+}
+
+// Compare `left` to `right` the same way Polar compares them.
+func compareValues(op FilterOp, left interface{}, right interface{}) (bool, error) {
+	left, right = derefInstance(left), derefInstance(right)
+	leftCmp, leftOk := toComparer(left)
+	rightCmp, rightOk := toComparer(right)
+	if !leftOk {
+		switch op {
+		case FilterEq:
+			return reflect.DeepEqual(left, right), nil
+		case FilterNeq:
+			return !reflect.DeepEqual(left, right), nil
+		}
+		return false, fmt.Errorf("Cannot compare %T with %s", left, filterOpSymbols[op])
+	}
+	switch op {
+	case FilterEq:
+		return leftCmp.Equal(right), nil
+	case FilterNeq:
+		return !leftCmp.Equal(right), nil
+	case FilterLt:
+		return leftCmp.Lt(right), nil
+	case FilterLeq:
+		return leftCmp.Lt(right) || leftCmp.Equal(right), nil
+	case FilterGt:
+		return rightOk && rightCmp.Lt(left), nil
+	case FilterGeq:
+		return (rightOk && rightCmp.Lt(left)) || leftCmp.Equal(right), nil
+	}
+	return false, fmt.Errorf("Unexpected filter operator: %s", op)
+}
+
+func toComparer(v interface{}) (interfaces.Comparer, bool) {
+	switch v := v.(type) {
+	case interfaces.Comparer:
+		return v, true
+	case time.Time:
+		return timeComparer(v), true
+	}
+	if value, ok := basicValue(v); ok {
+		return basicComparer{value}, true
+	}
+	return nil, false
+}
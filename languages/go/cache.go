@@ -0,0 +1,214 @@
+package oso
+
+import (
+	"container/list"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+Counters describing the use of the IsAllowed result cache.
+*/
+type CacheStats struct {
+	// Number of IsAllowed calls answered from the cache.
+	Hits uint64
+	// Number of IsAllowed calls that had to query the policy.
+	Misses uint64
+}
+
+// A least-recently-used cache of IsAllowed results.
+type resultCache struct {
+	mu   sync.Mutex
+	size int
+	// Entries, most recently used first, and an index of them by key.
+	entries *list.List
+	index   map[string]*list.Element
+	// Incremented whenever the cache is cleared, so that results computed
+	// against a previous policy aren't added to the cache.
+	generation uint64
+	stats      CacheStats
+}
+
+type cacheEntry struct {
+	key     string
+	allowed bool
+}
+
+func newResultCache(size int) *resultCache {
+	return &resultCache{
+		size:    size,
+		entries: list.New(),
+		index:   make(map[string]*list.Element),
+	}
+}
+
+// Build a cache key from the Go values of the query arguments. The Polar terms
+// they convert to can't be used, since instances get a new ID on every query.
+// The full key is kept rather than a hash, since a collision would give a
+// wrong authorization result.
+func cacheKey(args ...interface{}) string {
+	var b strings.Builder
+	for _, arg := range args {
+		writeKey(&b, reflect.ValueOf(arg), make(map[keyRef]int))
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// A pointer, map or slice being written by writeKey. The type is part of it
+// since e.g. a slice and a pointer to its first element have the same address.
+type keyRef struct {
+	ptr uintptr
+	typ reflect.Type
+}
+
+// Write an encoding of the type and value of `v` for use in a cache key. Unlike
+// %#v, it doesn't call GoString methods, which may format different values the
+// same way, and it follows pointers rather than printing their addresses, so
+// equal values give equal keys however they're allocated. `path` maps the
+// pointers, maps and slices being written to how deeply they're nested, so
+// that a cycle is written as a reference back up the path.
+func writeKey(b *strings.Builder, v reflect.Value, path map[keyRef]int) {
+	if !v.IsValid() {
+		b.WriteString("nil")
+		return
+	}
+	b.WriteString(v.Type().String())
+	b.WriteByte('(')
+	defer b.WriteByte(')')
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice:
+		if v.IsNil() {
+			b.WriteString("nil")
+			return
+		}
+		ref := keyRef{v.Pointer(), v.Type()}
+		if depth, ok := path[ref]; ok {
+			fmt.Fprintf(b, "^%d", depth)
+			return
+		}
+		path[ref] = len(path)
+		defer delete(path, ref)
+		switch v.Kind() {
+		case reflect.Ptr:
+			writeKey(b, v.Elem(), path)
+		case reflect.Map:
+			// Map iteration order is random, so sort the entries by key.
+			entries := make([]string, 0, v.Len())
+			for _, k := range v.MapKeys() {
+				var entry strings.Builder
+				writeKey(&entry, k, path)
+				entry.WriteByte(':')
+				writeKey(&entry, v.MapIndex(k), path)
+				entries = append(entries, entry.String())
+			}
+			sort.Strings(entries)
+			b.WriteString(strings.Join(entries, ","))
+		default:
+			writeElems(b, v, path)
+		}
+	case reflect.Interface:
+		writeKey(b, v.Elem(), path)
+	case reflect.Array:
+		writeElems(b, v, path)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			writeKey(b, v.Field(i), path)
+			b.WriteByte(',')
+		}
+	case reflect.String:
+		b.WriteString(strconv.Quote(v.String()))
+	case reflect.Bool:
+		b.WriteString(strconv.FormatBool(v.Bool()))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		b.WriteString(strconv.FormatInt(v.Int(), 10))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		b.WriteString(strconv.FormatUint(v.Uint(), 10))
+	case reflect.Float32, reflect.Float64:
+		b.WriteString(strconv.FormatFloat(v.Float(), 'g', -1, 64))
+	case reflect.Complex64, reflect.Complex128:
+		fmt.Fprint(b, v.Complex())
+	default:
+		// Functions, channels and unsafe pointers can only be told apart by
+		// their addresses.
+		fmt.Fprintf(b, "%#x", v.Pointer())
+	}
+}
+
+func writeElems(b *strings.Builder, v reflect.Value, path map[keyRef]int) {
+	for i := 0; i < v.Len(); i++ {
+		writeKey(b, v.Index(i), path)
+		b.WriteByte(',')
+	}
+}
+
+// Look up the result for key, returning the current generation for use with
+// put on a miss.
+func (c *resultCache) get(key string) (allowed bool, generation uint64, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.index[key]; ok {
+		c.entries.MoveToFront(elem)
+		c.stats.Hits++
+		return elem.Value.(*cacheEntry).allowed, c.generation, true
+	}
+	c.stats.Misses++
+	return false, c.generation, false
+}
+
+// Store the result for key, unless the cache was cleared since generation.
+func (c *resultCache) put(key string, generation uint64, allowed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if elem, ok := c.index[key]; ok {
+		elem.Value.(*cacheEntry).allowed = allowed
+		c.entries.MoveToFront(elem)
+		return
+	}
+	c.index[key] = c.entries.PushFront(&cacheEntry{key, allowed})
+	if c.entries.Len() > c.size {
+		oldest := c.entries.Back()
+		c.entries.Remove(oldest)
+		delete(c.index, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *resultCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries.Init()
+	c.index = make(map[string]*list.Element)
+	c.generation++
+}
+
+func (c *resultCache) getStats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// Return the result cache, or nil if it is disabled.
+func (p *Polar) resultCache() *resultCache {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.cache
+}
+
+func (p *Polar) setResultCache(cache *resultCache) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cache = cache
+}
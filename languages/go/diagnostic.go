@@ -0,0 +1,40 @@
+package oso
+
+import (
+	"strings"
+
+	"github.com/osohq/go-oso/errors"
+	"github.com/osohq/go-oso/internal/ffi"
+	. "github.com/osohq/go-oso/types"
+)
+
+/*
+A problem found in a policy by Oso.LoadWithDiagnostics: either an error, which
+prevents the policy from loading, or a warning.
+*/
+type Diagnostic struct {
+	// The error, or nil for a warning. Parse errors are *errors.ParseError;
+	// other errors are *errors.FormattedPolarError.
+	Err error
+	// A description of the problem, including the part of the policy it was
+	// found in when known.
+	Message string
+	// The file the problem was found in, or "" if unknown.
+	Filename string
+	// The line and column the problem was found at, starting from 1, or 0 if
+	// unknown. Only errors report their location.
+	Line   int
+	Column int
+}
+
+func newDiagnostic(d ffi.Diagnostic) Diagnostic {
+	if d.Error == nil {
+		return Diagnostic{Message: strings.TrimSpace(*d.Warning)}
+	}
+	diagnostic := Diagnostic{Err: d.Error, Message: d.Error.Formatted}
+	diagnostic.Filename, diagnostic.Line, diagnostic.Column = d.Error.Location()
+	if _, ok := d.Error.Kind.ErrorKindVariant.(ErrorKindParse); ok {
+		diagnostic.Err = errors.NewParseError(d.Error)
+	}
+	return diagnostic
+}
@@ -0,0 +1,71 @@
+package oso
+
+import (
+	"reflect"
+
+	"github.com/osohq/go-oso/internal/host"
+)
+
+/*
+Get the exported fields of a struct, or of the struct a pointer points to, as
+a map from field names to values. Passing the map to a query gives the policy
+a plain Polar dictionary, without registering the struct as a class:
+
+	allowed, err := o.QueryRuleOnce("check", oso.AsDict(request))
+	// check(request) if request.Method = "GET";
+
+Fields promoted from embedded structs are included as they would be by Go,
+with fields of the outer struct taking precedence. Field values are not
+converted themselves, so a field holding a struct is passed as an instance.
+Fields are renamed and hidden by `polar` struct tags as they are for attribute
+lookups. Returns nil if `v` isn't a struct or a non-nil pointer to one.
+*/
+func AsDict(v interface{}) map[string]interface{} {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil
+	}
+	dict := make(map[string]interface{})
+	addFields(dict, rv)
+	return dict
+}
+
+// Add the exported fields of the struct `rv` to `dict`, and then the fields
+// promoted from its embedded structs, leaving fields that are already there.
+func addFields(dict map[string]interface{}, rv reflect.Value) {
+	var embedded []reflect.Value
+	for i := 0; i < rv.NumField(); i++ {
+		field := rv.Type().Field(i)
+		value := rv.Field(i)
+		name, _ := host.PolarTag(field)
+		if name == "-" {
+			continue
+		}
+		if field.Anonymous && host.IndirectType(field.Type).Kind() == reflect.Struct {
+			// Nothing is promoted through a nil pointer.
+			if value.Kind() == reflect.Ptr {
+				if value.IsNil() {
+					continue
+				}
+				value = value.Elem()
+			}
+			embedded = append(embedded, value)
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if _, ok := dict[name]; !ok {
+			dict[name] = value.Interface()
+		}
+	}
+	for _, value := range embedded {
+		addFields(dict, value)
+	}
+}
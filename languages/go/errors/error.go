@@ -2,11 +2,48 @@ package errors
 
 import (
 	"fmt"
+	"os"
 	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/osohq/go-oso/types"
 )
 
+type ClosedError struct{}
+
+func NewClosedError() *ClosedError {
+	return &ClosedError{}
+}
+
+func (e *ClosedError) Error() string {
+	return "Polar instance has been closed."
+}
+
+type ConstantRegistrationError struct {
+	name  string
+	inner error
+}
+
+func NewConstantRegistrationError(name string, inner error) *ConstantRegistrationError {
+	return &ConstantRegistrationError{name: name, inner: inner}
+}
+
+func (e *ConstantRegistrationError) Error() string {
+	return fmt.Sprintf("Could not register constant %s: %v", e.name, e.inner)
+}
+
+// Name returns the name of the constant that could not be registered.
+func (e *ConstantRegistrationError) Name() string {
+	return e.name
+}
+
+// Unwrap returns the error registering the constant.
+func (e *ConstantRegistrationError) Unwrap() error {
+	return e.inner
+}
+
 type DuplicateClassAliasError struct {
 	name     string
 	cls      reflect.Type
@@ -21,6 +58,31 @@ func (e *DuplicateClassAliasError) Error() string {
 	return fmt.Sprintf("Attempted to alias %v as '%s', but %v already has that alias.", e.cls, e.name, e.existing)
 }
 
+type ConflictingClassRegistrationError struct {
+	name string
+	cls  reflect.Type
+}
+
+func NewConflictingClassRegistrationError(name string, cls reflect.Type) *ConflictingClassRegistrationError {
+	return &ConflictingClassRegistrationError{name: name, cls: cls}
+}
+
+func (e *ConflictingClassRegistrationError) Error() string {
+	return fmt.Sprintf("Attempted to register %v as '%s' again with different options.", e.cls, e.name)
+}
+
+type DuplicateFileLoadError struct {
+	file string
+}
+
+func NewDuplicateFileLoadError(file string) *DuplicateFileLoadError {
+	return &DuplicateFileLoadError{file: file}
+}
+
+func (e *DuplicateFileLoadError) Error() string {
+	return fmt.Sprintf("File %s has already been loaded.", e.file)
+}
+
 type DuplicateInstanceRegistrationError struct {
 	id uint64
 }
@@ -34,17 +96,63 @@ func (e *DuplicateInstanceRegistrationError) Error() string {
 }
 
 type InlineQueryFailedError struct {
-	source string
+	source   string
+	query    string
+	line     int
+	filename string
 }
 
 func NewInlineQueryFailedError(source string) *InlineQueryFailedError {
-	return &InlineQueryFailedError{source: source}
+	e := &InlineQueryFailedError{source: source, query: source}
+	// The source may end with the location of the query.
+	if match := parseErrorLocation.FindStringSubmatchIndex(source); match != nil {
+		e.query = source[:match[0]]
+		e.line, _ = strconv.Atoi(source[match[2]:match[3]])
+		if match[6] >= 0 {
+			e.filename = source[match[6]:match[7]]
+		}
+	}
+	return e
 }
 
 func (e *InlineQueryFailedError) Error() string {
 	return fmt.Sprintf("Inline query failed: %s", e.source)
 }
 
+// Source returns the source of the failing inline query, e.g. "1 = 2".
+func (e *InlineQueryFailedError) Source() string {
+	return e.query
+}
+
+// Line returns the line of the failing inline query, starting from 1, or 0 if
+// unknown.
+func (e *InlineQueryFailedError) Line() int {
+	return e.line
+}
+
+// Filename returns the file containing the failing inline query, or "" if it
+// was not loaded from a file.
+func (e *InlineQueryFailedError) Filename() string {
+	return e.filename
+}
+
+type MissingRulesError struct {
+	names []string
+}
+
+func NewMissingRulesError(names []string) *MissingRulesError {
+	return &MissingRulesError{names: names}
+}
+
+func (e *MissingRulesError) Error() string {
+	return fmt.Sprintf("Policy does not define rules: %s", strings.Join(e.names, ", "))
+}
+
+// Names returns the names of the missing rules.
+func (e *MissingRulesError) Names() []string {
+	return e.names
+}
+
 type MissingAttributeError struct {
 	instance interface{}
 	field    string
@@ -114,6 +222,22 @@ func (e *KwargsError) Error() string {
 	return fmt.Sprintf("Go does not support keyword arguments")
 }
 
+// PanicError is returned when a Go function or method called by Polar panics.
+type PanicError struct {
+	// The value passed to panic.
+	Value interface{}
+	// The stack trace of the goroutine at the time of the panic.
+	Stack []byte
+}
+
+func NewPanicError(value interface{}, stack []byte) *PanicError {
+	return &PanicError{Value: value, Stack: stack}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v\n\n%s", e.Value, e.Stack)
+}
+
 type PolarFileExtensionError struct {
 	file string
 }
@@ -138,6 +262,51 @@ func (e *PolarFileNotFoundError) Error() string {
 	return fmt.Sprintf("Could not find file: %s", e.file)
 }
 
+type PolarFileLoadError struct {
+	file     string
+	notFound bool
+	inner    error
+}
+
+func NewPolarFileLoadError(file string, inner error) *PolarFileLoadError {
+	return &PolarFileLoadError{file: file, notFound: os.IsNotExist(inner), inner: inner}
+}
+
+func (e *PolarFileLoadError) Error() string {
+	if e.notFound {
+		return fmt.Sprintf("Could not find file: %s", e.file)
+	}
+	return fmt.Sprintf("Could not read file %s: %v", e.file, e.inner)
+}
+
+// Filename returns the path of the file that could not be loaded.
+func (e *PolarFileLoadError) Filename() string {
+	return e.file
+}
+
+// NotFound reports whether the file could not be loaded because it does not
+// exist, as opposed to failing to read it (e.g. because it is a directory).
+func (e *PolarFileLoadError) NotFound() bool {
+	return e.notFound
+}
+
+// Unwrap returns the error reading the file.
+func (e *PolarFileLoadError) Unwrap() error {
+	return e.inner
+}
+
+type NoMatchingPolarFilesError struct {
+	patterns []string
+}
+
+func NewNoMatchingPolarFilesError(patterns []string) *NoMatchingPolarFilesError {
+	return &NoMatchingPolarFilesError{patterns: patterns}
+}
+
+func (e *NoMatchingPolarFilesError) Error() string {
+	return fmt.Sprintf("No Polar files matched the given patterns: %s", strings.Join(e.patterns, ", "))
+}
+
 type UnimplementedOperationError struct {
 	operation string
 }
@@ -151,15 +320,55 @@ func (e *UnimplementedOperationError) Error() string {
 }
 
 type UnregisteredClassError struct {
-	name string
+	names []string
 }
 
 func NewUnregisteredClassError(name string) *UnregisteredClassError {
-	return &UnregisteredClassError{name: name}
+	return &UnregisteredClassError{names: []string{name}}
+}
+
+// NewUnregisteredClassesError reports that a policy refers to several classes
+// that haven't been registered.
+func NewUnregisteredClassesError(names []string) *UnregisteredClassError {
+	return &UnregisteredClassError{names: names}
 }
 
 func (e *UnregisteredClassError) Error() string {
-	return fmt.Sprintf("Unregistered class: %s", e.name)
+	if len(e.names) == 1 {
+		return fmt.Sprintf("Unregistered class: %s", e.names[0])
+	}
+	return fmt.Sprintf("Unregistered classes: %s", strings.Join(e.names, ", "))
+}
+
+// Names returns the names of the unregistered classes.
+func (e *UnregisteredClassError) Names() []string {
+	return e.names
+}
+
+type UnregisteredFieldError struct {
+	class string
+	field string
+}
+
+func NewUnregisteredFieldError(class string, field string) *UnregisteredFieldError {
+	return &UnregisteredFieldError{class: class, field: field}
+}
+
+func (e *UnregisteredFieldError) Error() string {
+	return fmt.Sprintf("'%s' is not a registered field of class %s", e.field, e.class)
+}
+
+type UnregisteredMethodError struct {
+	class  string
+	method string
+}
+
+func NewUnregisteredMethodError(class string, method string) *UnregisteredMethodError {
+	return &UnregisteredMethodError{class: class, method: method}
+}
+
+func (e *UnregisteredMethodError) Error() string {
+	return fmt.Sprintf("'%s' is not a registered method of class %s", e.method, e.class)
 }
 
 type UnregisteredInstanceError struct {
@@ -186,6 +395,72 @@ func (e *FormattedPolarError) Error() string {
 	return fmt.Sprintf("Error: %#v\n%s", e.Kind.ErrorKindVariant, e.Formatted)
 }
 
+// Location returns the file, line and column (starting from 1) of the part of
+// the policy the error was found in, if the Polar core reported them; the line
+// and column are 0 if not.
+func (e *FormattedPolarError) Location() (filename string, line int, column int) {
+	if match := parseErrorLocation.FindStringSubmatch(e.Formatted); match != nil {
+		line, _ = strconv.Atoi(match[1])
+		column, _ = strconv.Atoi(match[2])
+		filename = match[3]
+	}
+	return filename, line, column
+}
+
+// ParseError is returned when a Polar policy fails to parse. It exposes the
+// location of the problem when the Polar core reports one.
+type ParseError struct {
+	// The file containing the error, or "" if the policy was not loaded from a
+	// file.
+	Filename string
+	// The line and column of the error, starting from 1, or 0 if unknown.
+	Line   int
+	Column int
+	// The offending token, or "" if the error was not caused by a token.
+	Token string
+
+	inner *FormattedPolarError
+}
+
+var parseErrorLocation = regexp.MustCompile(` at line (\d+), column (\d+)(?: in file (.+))?$`)
+
+func NewParseError(inner *FormattedPolarError) *ParseError {
+	e := &ParseError{inner: inner}
+	e.Filename, e.Line, e.Column = inner.Location()
+	if kind, ok := inner.Kind.ErrorKindVariant.(types.ErrorKindParse); ok {
+		switch variant := kind.ParseErrorVariant.(type) {
+		case types.ParseErrorIntegerOverflow:
+			e.Token = variant.Token
+		case types.ParseErrorInvalidTokenCharacter:
+			e.Token = variant.Token
+		case types.ParseErrorUnrecognizedToken:
+			e.Token = variant.Token
+		case types.ParseErrorExtraToken:
+			e.Token = variant.Token
+		case types.ParseErrorReservedWord:
+			e.Token = variant.Token
+		case types.ParseErrorInvalidFloat:
+			e.Token = variant.Token
+		}
+	}
+	return e
+}
+
+func (e *ParseError) Error() string {
+	if e.inner == nil {
+		return "Polar parse error"
+	}
+	return e.inner.Error()
+}
+
+// Unwrap returns the error reported by the Polar core.
+func (e *ParseError) Unwrap() error {
+	if e.inner == nil {
+		return nil
+	}
+	return e.inner
+}
+
 type ErrorWithAdditionalInfo struct {
 	Inner error
 	Info  string
@@ -195,6 +470,9 @@ func (e *ErrorWithAdditionalInfo) Error() string {
 	return fmt.Sprintf("%s\n%s", e.Info, e.Inner)
 }
 
+// NotFoundError is returned by Oso.Authorize when the actor is not allowed to
+// perform the action and also cannot read the resource, so its existence should
+// be hidden from them.
 type NotFoundError struct{}
 
 func (e *NotFoundError) Error() string {
@@ -203,6 +481,8 @@ func (e *NotFoundError) Error() string {
 		"error to the client."
 }
 
+// ForbiddenError is returned by Oso.Authorize when the actor can read the
+// resource but is not allowed to perform the requested action on it.
 type ForbiddenError struct{}
 
 func (e *ForbiddenError) Error() string {
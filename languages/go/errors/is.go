@@ -0,0 +1,192 @@
+package errors
+
+// Sentinel errors for use with errors.Is. Each matches any error of the
+// corresponding type, whatever its details, e.g.
+//
+//	if errors.Is(err, osoErrors.ErrInlineQueryFailed) {
+//		...
+//	}
+//
+// Use errors.As to access the details of an error.
+var (
+	ErrClosed                        = &ClosedError{}
+	ErrConflictingClassRegistration  = &ConflictingClassRegistrationError{}
+	ErrConstantRegistration          = &ConstantRegistrationError{}
+	ErrDuplicateClassAlias           = &DuplicateClassAliasError{}
+	ErrDuplicateFileLoad             = &DuplicateFileLoadError{}
+	ErrDuplicateInstanceRegistration = &DuplicateInstanceRegistrationError{}
+	ErrInlineQueryFailed             = &InlineQueryFailedError{}
+	ErrMissingRules                  = &MissingRulesError{}
+	ErrMissingAttribute              = &MissingAttributeError{}
+	ErrInvalidCall                   = &InvalidCallError{}
+	ErrInvalidIterator               = &InvalidIteratorError{}
+	ErrInvalidConstructor            = &InvalidConstructorError{}
+	ErrInvalidQueryEvent             = &InvalidQueryEventError{}
+	ErrKwargs                        = &KwargsError{}
+	ErrPanic                         = &PanicError{}
+	ErrPolarFileExtension            = &PolarFileExtensionError{}
+	ErrPolarFileNotFound             = &PolarFileNotFoundError{}
+	ErrPolarFileLoad                 = &PolarFileLoadError{}
+	ErrNoMatchingPolarFiles          = &NoMatchingPolarFilesError{}
+	ErrUnimplementedOperation        = &UnimplementedOperationError{}
+	ErrUnregisteredClass             = &UnregisteredClassError{}
+	ErrUnregisteredField             = &UnregisteredFieldError{}
+	ErrUnregisteredMethod            = &UnregisteredMethodError{}
+	ErrUnregisteredInstance          = &UnregisteredInstanceError{}
+	ErrPolar                         = &FormattedPolarError{}
+	ErrParse                         = &ParseError{}
+	ErrNotFound                      = &NotFoundError{}
+	ErrForbidden                     = &ForbiddenError{}
+)
+
+func (e *ConstantRegistrationError) Is(target error) bool {
+	_, ok := target.(*ConstantRegistrationError)
+	return ok
+}
+
+func (e *ConflictingClassRegistrationError) Is(target error) bool {
+	_, ok := target.(*ConflictingClassRegistrationError)
+	return ok
+}
+
+func (e *PanicError) Is(target error) bool {
+	_, ok := target.(*PanicError)
+	return ok
+}
+
+func (e *ClosedError) Is(target error) bool {
+	_, ok := target.(*ClosedError)
+	return ok
+}
+
+func (e *DuplicateClassAliasError) Is(target error) bool {
+	_, ok := target.(*DuplicateClassAliasError)
+	return ok
+}
+
+func (e *DuplicateFileLoadError) Is(target error) bool {
+	_, ok := target.(*DuplicateFileLoadError)
+	return ok
+}
+
+func (e *DuplicateInstanceRegistrationError) Is(target error) bool {
+	_, ok := target.(*DuplicateInstanceRegistrationError)
+	return ok
+}
+
+func (e *InlineQueryFailedError) Is(target error) bool {
+	_, ok := target.(*InlineQueryFailedError)
+	return ok
+}
+
+func (e *MissingRulesError) Is(target error) bool {
+	_, ok := target.(*MissingRulesError)
+	return ok
+}
+
+func (e *MissingAttributeError) Is(target error) bool {
+	_, ok := target.(*MissingAttributeError)
+	return ok
+}
+
+func (e *InvalidCallError) Is(target error) bool {
+	_, ok := target.(*InvalidCallError)
+	return ok
+}
+
+func (e *InvalidIteratorError) Is(target error) bool {
+	_, ok := target.(*InvalidIteratorError)
+	return ok
+}
+
+func (e *InvalidConstructorError) Is(target error) bool {
+	_, ok := target.(*InvalidConstructorError)
+	return ok
+}
+
+func (e *InvalidQueryEventError) Is(target error) bool {
+	_, ok := target.(*InvalidQueryEventError)
+	return ok
+}
+
+func (e *KwargsError) Is(target error) bool {
+	_, ok := target.(*KwargsError)
+	return ok
+}
+
+func (e *PolarFileExtensionError) Is(target error) bool {
+	_, ok := target.(*PolarFileExtensionError)
+	return ok
+}
+
+func (e *PolarFileNotFoundError) Is(target error) bool {
+	_, ok := target.(*PolarFileNotFoundError)
+	return ok
+}
+
+// A PolarFileLoadError for a file that does not exist also matches
+// ErrPolarFileNotFound.
+func (e *PolarFileLoadError) Is(target error) bool {
+	switch target.(type) {
+	case *PolarFileLoadError:
+		return true
+	case *PolarFileNotFoundError:
+		return e.notFound
+	}
+	return false
+}
+
+func (e *NoMatchingPolarFilesError) Is(target error) bool {
+	_, ok := target.(*NoMatchingPolarFilesError)
+	return ok
+}
+
+func (e *UnimplementedOperationError) Is(target error) bool {
+	_, ok := target.(*UnimplementedOperationError)
+	return ok
+}
+
+func (e *UnregisteredClassError) Is(target error) bool {
+	_, ok := target.(*UnregisteredClassError)
+	return ok
+}
+
+func (e *UnregisteredFieldError) Is(target error) bool {
+	_, ok := target.(*UnregisteredFieldError)
+	return ok
+}
+
+func (e *UnregisteredMethodError) Is(target error) bool {
+	_, ok := target.(*UnregisteredMethodError)
+	return ok
+}
+
+func (e *UnregisteredInstanceError) Is(target error) bool {
+	_, ok := target.(*UnregisteredInstanceError)
+	return ok
+}
+
+func (e *FormattedPolarError) Is(target error) bool {
+	_, ok := target.(*FormattedPolarError)
+	return ok
+}
+
+func (e *ParseError) Is(target error) bool {
+	_, ok := target.(*ParseError)
+	return ok
+}
+
+func (e *NotFoundError) Is(target error) bool {
+	_, ok := target.(*NotFoundError)
+	return ok
+}
+
+func (e *ForbiddenError) Is(target error) bool {
+	_, ok := target.(*ForbiddenError)
+	return ok
+}
+
+// Unwrap returns the error that additional information was added to.
+func (e *ErrorWithAdditionalInfo) Unwrap() error {
+	return e.Inner
+}
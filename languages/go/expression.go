@@ -0,0 +1,79 @@
+package oso
+
+import (
+	"github.com/osohq/go-oso/internal/host"
+	. "github.com/osohq/go-oso/types"
+)
+
+/*
+A partially evaluated constraint on a variable that a query left unbound,
+returned as the value of a binding by queries created with
+QueryOptions.AcceptExpressions.
+
+Operator is the name of a Polar operator, such as "And", "Or", "Not", "Unify",
+"Eq", "Neq", "Lt", "Leq", "Gt", "Geq", "In", "Isa" or "Dot". Args are the
+operands, each of which is a Go value, a nested Expression, an
+ExpressionPattern (the right-hand side of "Isa"), or a types.ValueVariable for
+a variable. The variable "_this" stands for the variable the binding is for:
+
+	// allow(_, "read", post) if post.Public = true;
+	Expression{Operator: "And", Args: []interface{}{
+		Expression{Operator: "Unify", Args: []interface{}{
+			Expression{Operator: "Dot", Args: []interface{}{types.ValueVariable("_this"), "Public"}},
+			true,
+		}},
+	}}
+*/
+type Expression struct {
+	Operator string
+	Args     []interface{}
+}
+
+/*
+A pattern that a variable is constrained to match by an "Isa" Expression. Tag
+is the name of the class the variable must be an instance of, or "" for
+dictionary patterns, and Fields are the values its fields must have.
+*/
+type ExpressionPattern struct {
+	Tag    string
+	Fields map[string]interface{}
+}
+
+func toExpression(h host.Host, op Operation) (Expression, error) {
+	args := make([]interface{}, len(op.Args))
+	for i, arg := range op.Args {
+		converted, err := expressionArgToGo(h, arg)
+		if err != nil {
+			return Expression{}, err
+		}
+		args[i] = converted
+	}
+	return Expression{Operator: operatorName(op.Operator), Args: args}, nil
+}
+
+func expressionArgToGo(h host.Host, term Term) (interface{}, error) {
+	switch value := term.Value.ValueVariant.(type) {
+	case ValueExpression:
+		return toExpression(h, Operation(value))
+	case ValuePattern:
+		var pattern ExpressionPattern
+		var fields Dictionary
+		switch p := value.PatternVariant.(type) {
+		case PatternInstance:
+			pattern.Tag = string(p.Tag)
+			fields = p.Fields
+		case PatternDictionary:
+			fields = Dictionary(p)
+		}
+		pattern.Fields = make(map[string]interface{}, len(fields.Fields))
+		for name, field := range fields.Fields {
+			converted, err := expressionArgToGo(h, field)
+			if err != nil {
+				return nil, err
+			}
+			pattern.Fields[string(name)] = converted
+		}
+		return pattern, nil
+	}
+	return h.ToGo(term)
+}
@@ -0,0 +1,373 @@
+package oso
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/osohq/go-oso/errors"
+	. "github.com/osohq/go-oso/types"
+)
+
+// The operator of a Filter.
+type FilterOp string
+
+const (
+	// Matches if all of the filter's Children match.
+	FilterAnd FilterOp = "and"
+	// Matches if any of the filter's Children match.
+	FilterOr FilterOp = "or"
+	// Matches if the filter's only child does not match.
+	FilterNot FilterOp = "not"
+	// Compare the filter's Field to its Value.
+	FilterEq  FilterOp = "eq"
+	FilterNeq FilterOp = "neq"
+	FilterLt  FilterOp = "lt"
+	FilterLeq FilterOp = "leq"
+	FilterGt  FilterOp = "gt"
+	FilterGeq FilterOp = "geq"
+	// Matches if the filter's Field is one of the elements of its Value, a
+	// list.
+	FilterIn FilterOp = "in"
+	// Matches if the filter's Field, a collection, contains its Value.
+	FilterContains FilterOp = "contains"
+	// Matches if the filter's Field is an instance of the class named by its
+	// Value.
+	FilterIsa FilterOp = "isa"
+)
+
+var filterOpSymbols = map[FilterOp]string{
+	FilterEq:       "=",
+	FilterNeq:      "!=",
+	FilterLt:       "<",
+	FilterLeq:      "<=",
+	FilterGt:       ">",
+	FilterGeq:      ">=",
+	FilterIn:       "in",
+	FilterContains: "contains",
+	FilterIsa:      "matches",
+}
+
+/*
+A Filter describes the resources an actor is allowed to access as a tree of
+constraints on the fields of those resources, which can be translated into a
+query against the store holding them, e.g. a SQL WHERE clause.
+
+Filters with the FilterAnd, FilterOr and FilterNot operators combine their
+Children. Every other filter compares a Field of the resource to a Value. The
+Field is a dot-separated path from the resource, such as "Owner.Name", or ""
+for the resource itself. A FilterAnd with no children matches every resource,
+and a FilterOr with no children matches none.
+*/
+type Filter struct {
+	Op       FilterOp
+	Field    string
+	Value    interface{}
+	Children []*Filter
+}
+
+func (f *Filter) String() string {
+	switch f.Op {
+	case FilterAnd, FilterOr:
+		if len(f.Children) == 0 {
+			return fmt.Sprintf("%v", f.Op == FilterAnd)
+		}
+		children := make([]string, len(f.Children))
+		for i, child := range f.Children {
+			children[i] = child.String()
+		}
+		return "(" + strings.Join(children, fmt.Sprintf(" %s ", f.Op)) + ")"
+	case FilterNot:
+		return fmt.Sprintf("not %v", f.Children[0])
+	}
+	field := "resource"
+	if f.Field != "" {
+		field += "." + f.Field
+	}
+	return fmt.Sprintf("%s %s %#v", field, filterOpSymbols[f.Op], f.Value)
+}
+
+// Constrain the resource matched by `filter` to be of type `resourceType`.
+func withResourceType(filter *Filter, resourceType string) *Filter {
+	isa := &Filter{Op: FilterIsa, Value: resourceType}
+	if filter.Op == FilterAnd {
+		return &Filter{Op: FilterAnd, Children: append([]*Filter{isa}, filter.Children...)}
+	}
+	return &Filter{Op: FilterAnd, Children: []*Filter{isa, filter}}
+}
+
+// The variable standing for the resource in partially evaluated results.
+const filterResourceVar = "_this"
+
+// Translates the constraints Polar places on a resource into Filters. Methods
+// return a nil Filter for constraints that every resource satisfies.
+type filterBuilder struct {
+	resourceType string
+}
+
+// Translate the value a query bound to the resource.
+func (b filterBuilder) fromBinding(binding interface{}) (*Filter, error) {
+	switch binding := binding.(type) {
+	case Expression:
+		return b.fromExpression(binding)
+	case ValueVariable:
+		// The resource was left unconstrained.
+		return nil, nil
+	default:
+		// The query bound the resource to a particular value.
+		return &Filter{Op: FilterEq, Value: binding}, nil
+	}
+}
+
+func (b filterBuilder) fromConstraint(constraint interface{}) (*Filter, error) {
+	switch constraint := constraint.(type) {
+	case Expression:
+		return b.fromExpression(constraint)
+	case bool:
+		if constraint {
+			return nil, nil
+		}
+		return &Filter{Op: FilterOr}, nil
+	}
+	return nil, fmt.Errorf("Cannot translate %v to a filter", constraint)
+}
+
+func (b filterBuilder) fromExpression(expr Expression) (*Filter, error) {
+	switch expr.Operator {
+	case "And", "Or":
+		filter := &Filter{Op: FilterAnd}
+		if expr.Operator == "Or" {
+			filter.Op = FilterOr
+		}
+		for _, arg := range expr.Args {
+			child, err := b.fromConstraint(arg)
+			if err != nil {
+				return nil, err
+			}
+			if child == nil {
+				if filter.Op == FilterOr {
+					return nil, nil
+				}
+				continue
+			}
+			filter.Children = append(filter.Children, child)
+		}
+		switch len(filter.Children) {
+		case 0:
+			if filter.Op == FilterAnd {
+				return nil, nil
+			}
+		case 1:
+			return filter.Children[0], nil
+		}
+		return filter, nil
+	case "Not":
+		child, err := b.fromConstraint(expr.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		if child == nil {
+			return &Filter{Op: FilterOr}, nil
+		}
+		return &Filter{Op: FilterNot, Children: []*Filter{child}}, nil
+	case "Isa":
+		return b.fromIsa(expr.Args[0], expr.Args[1])
+	case "In":
+		return b.fromIn(expr.Args[0], expr.Args[1])
+	}
+	if op, ok := comparisonFilterOps[expr.Operator]; ok {
+		return b.fromComparison(op, expr.Args[0], expr.Args[1])
+	}
+	return nil, errors.NewUnimplementedOperationError(fmt.Sprintf("Data filters using the %s operator", expr.Operator))
+}
+
+func (b filterBuilder) fromComparison(op FilterOp, left interface{}, right interface{}) (*Filter, error) {
+	leftField, leftIsField := fieldPath(left)
+	rightField, rightIsField := fieldPath(right)
+	switch {
+	case leftIsField && rightIsField:
+		return nil, errors.NewUnimplementedOperationError("Data filters comparing two fields")
+	case leftIsField:
+		value, err := filterValue(right)
+		if err != nil {
+			return nil, err
+		}
+		return &Filter{Op: op, Field: leftField, Value: value}, nil
+	case rightIsField:
+		value, err := filterValue(left)
+		if err != nil {
+			return nil, err
+		}
+		return &Filter{Op: flipFilterOp(op), Field: rightField, Value: value}, nil
+	}
+	return nil, errors.NewUnimplementedOperationError("Data filters comparing values other than fields of the resource")
+}
+
+func (b filterBuilder) fromIn(item interface{}, collection interface{}) (*Filter, error) {
+	itemField, itemIsField := fieldPath(item)
+	collectionField, collectionIsField := fieldPath(collection)
+	switch {
+	case itemIsField && collectionIsField:
+		return nil, errors.NewUnimplementedOperationError("Data filters comparing two fields")
+	case itemIsField:
+		value, err := filterValue(collection)
+		if err != nil {
+			return nil, err
+		}
+		return &Filter{Op: FilterIn, Field: itemField, Value: value}, nil
+	case collectionIsField:
+		value, err := filterValue(item)
+		if err != nil {
+			return nil, err
+		}
+		return &Filter{Op: FilterContains, Field: collectionField, Value: value}, nil
+	}
+	return nil, errors.NewUnimplementedOperationError("Data filters comparing values other than fields of the resource")
+}
+
+func (b filterBuilder) fromIsa(instance interface{}, pattern interface{}) (*Filter, error) {
+	field, ok := fieldPath(instance)
+	if !ok {
+		return nil, errors.NewUnimplementedOperationError("Data filters matching values other than fields of the resource")
+	}
+	p, ok := pattern.(ExpressionPattern)
+	if !ok {
+		return nil, fmt.Errorf("Cannot translate %v to a filter", pattern)
+	}
+	filter := &Filter{Op: FilterAnd}
+	// Every resource is an instance of the resource type.
+	if p.Tag != "" && (field != "" || p.Tag != b.resourceType) {
+		filter.Children = append(filter.Children, &Filter{Op: FilterIsa, Field: field, Value: p.Tag})
+	}
+	for name, value := range p.Fields {
+		value, err := filterValue(value)
+		if err != nil {
+			return nil, err
+		}
+		child := &Filter{Op: FilterEq, Field: name, Value: value}
+		if field != "" {
+			child.Field = field + "." + child.Field
+		}
+		filter.Children = append(filter.Children, child)
+	}
+	switch len(filter.Children) {
+	case 0:
+		return nil, nil
+	case 1:
+		return filter.Children[0], nil
+	}
+	return filter, nil
+}
+
+// Check that a value a field is compared to is known.
+func filterValue(value interface{}) (interface{}, error) {
+	switch value.(type) {
+	case ValueVariable, Expression, ExpressionPattern:
+		return nil, errors.NewUnimplementedOperationError("Data filters comparing fields to unbound variables")
+	}
+	return value, nil
+}
+
+// Get the dot-separated path of the field of the resource `value` refers to.
+func fieldPath(value interface{}) (string, bool) {
+	switch value := value.(type) {
+	case ValueVariable:
+		return "", value == filterResourceVar
+	case Expression:
+		if value.Operator != "Dot" || len(value.Args) != 2 {
+			return "", false
+		}
+		prefix, ok := fieldPath(value.Args[0])
+		if !ok {
+			return "", false
+		}
+		field, ok := value.Args[1].(string)
+		if !ok {
+			return "", false
+		}
+		if prefix == "" {
+			return field, true
+		}
+		return prefix + "." + field, true
+	}
+	return "", false
+}
+
+var comparisonFilterOps = map[string]FilterOp{
+	"Unify": FilterEq,
+	"Eq":    FilterEq,
+	"Neq":   FilterNeq,
+	"Lt":    FilterLt,
+	"Leq":   FilterLeq,
+	"Gt":    FilterGt,
+	"Geq":   FilterGeq,
+}
+
+// Get the operator that compares the operands of `op` the other way around.
+func flipFilterOp(op FilterOp) FilterOp {
+	switch op {
+	case FilterLt:
+		return FilterGt
+	case FilterLeq:
+		return FilterGeq
+	case FilterGt:
+		return FilterLt
+	case FilterGeq:
+		return FilterLeq
+	}
+	return op
+}
+
+func operatorName(operator Operator) string {
+	return strings.TrimPrefix(reflect.TypeOf(operator.OperatorVariant).Name(), "Operator")
+}
+
+func (p *Polar) authorizedFilter(actor interface{}, action interface{}, resourceType string) (*Filter, error) {
+	resource := ValueVariable("resource")
+	query, err := p.queryRule("allow", actor, action, resource)
+	if err != nil {
+		return nil, err
+	}
+	query.acceptExpressions = true
+	// Constrain the resource to be an instance of the resource type, so that
+	// only rules that apply to it match.
+	isa := ValueExpression{
+		Operator: Operator{OperatorIsa{}},
+		Args: []Term{
+			{Value{resource}},
+			{Value{ValuePattern{PatternInstance{
+				Tag:    Symbol(resourceType),
+				Fields: Dictionary{Fields: map[Symbol]Term{}},
+			}}}},
+		},
+	}
+	constraint := ValueExpression{
+		Operator: Operator{OperatorAnd{}},
+		Args:     []Term{{Value{isa}}},
+	}
+	if err = query.bind(string(resource), constraint); err != nil {
+		query.Cleanup()
+		return nil, err
+	}
+	results, err := query.GetAllResults()
+	if err != nil {
+		return nil, err
+	}
+
+	builder := filterBuilder{resourceType: resourceType}
+	filter := &Filter{Op: FilterOr}
+	for _, result := range results {
+		child, err := builder.fromBinding(result[string(resource)])
+		if err != nil {
+			return nil, err
+		}
+		if child == nil {
+			return &Filter{Op: FilterAnd}, nil
+		}
+		filter.Children = append(filter.Children, child)
+	}
+	if len(filter.Children) == 1 {
+		return filter.Children[0], nil
+	}
+	return filter, nil
+}
@@ -0,0 +1,54 @@
+//go:build go1.16
+// +build go1.16
+
+package oso
+
+import (
+	"io/fs"
+	"sort"
+
+	"github.com/osohq/go-oso/errors"
+)
+
+func (p *Polar) loadFS(fsys fs.FS, patterns ...string) error {
+	seen := make(map[string]struct{})
+	filenames := []string{}
+	for _, pattern := range patterns {
+		matches, err := fs.Glob(fsys, pattern)
+		if err != nil {
+			return err
+		}
+		for _, match := range matches {
+			if _, ok := seen[match]; !ok {
+				seen[match] = struct{}{}
+				filenames = append(filenames, match)
+			}
+		}
+	}
+	if len(filenames) == 0 {
+		return errors.NewNoMatchingPolarFilesError(patterns)
+	}
+	sort.Strings(filenames)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.loadFilesWith(filenames, func(name string) ([]byte, error) {
+		return fs.ReadFile(fsys, name)
+	})
+}
+
+/*
+Load Polar policy from the ".polar" files in `fsys` matching any of the given
+glob patterns, checking that all inline queries succeed. Matching files are
+loaded together in sorted order. This works with an `embed.FS`:
+
+	//go:embed policies/*.polar
+	var policies embed.FS
+
+	err := o.LoadFS(policies, "policies/*.polar")
+
+Returns an error if no files match.
+*/
+func (o Oso) LoadFS(fsys fs.FS, patterns ...string) error {
+	return (*o.p).loadFS(fsys, patterns...)
+}
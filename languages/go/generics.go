@@ -0,0 +1,90 @@
+//go:build go1.18
+// +build go1.18
+
+package oso
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/osohq/go-oso/internal/host"
+)
+
+// Get the reflect.Type of `T`, which works for interface types as well.
+func typeOf[T any]() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
+
+/*
+Register the Go type `T` so that it can be referenced within Polar files by its
+type name. Accepts a constructor function or nil if no constructor is required.
+
+	err := oso.RegisterClassT[User](&o, nil)
+*/
+func RegisterClassT[T any](o *Oso, ctor interface{}) error {
+	return o.RegisterClass(typeOf[T](), ctor)
+}
+
+/*
+Register the Go type `T` under a certain name/alias so that it can be
+referenced within Polar files by that name. Accepts a constructor function or
+nil if no constructor is required.
+
+	err := oso.RegisterClassWithNameT[User](&o, nil, "Account")
+*/
+func RegisterClassWithNameT[T any](o *Oso, ctor interface{}, name string) error {
+	return o.RegisterClassWithName(typeOf[T](), ctor, name)
+}
+
+/*
+Get every result of the query and decode the value bound to `varName` in each
+into a `T`, the same way FromPolarValue does:
+
+	query, err := o.NewQueryFromRule("readable", user, types.ValueVariable("post"))
+	...
+	posts, err := oso.QueryAll[*Post](query, "post")
+
+Returns an error, and cleans up the query, if a result doesn't bind `varName`
+or its value can't be decoded into a `T`.
+*/
+func QueryAll[T any](q *Query, varName string) ([]T, error) {
+	values := make([]T, 0)
+	for {
+		result, err := q.Next()
+		if err != nil {
+			return nil, err
+		} else if result == nil {
+			return values, nil
+		}
+		binding, ok := (*result)[varName]
+		if !ok {
+			q.Cleanup()
+			return nil, fmt.Errorf("Query result has no binding for %s", varName)
+		}
+		var value T
+		if err = host.SetFieldTo(reflect.ValueOf(&value).Elem(), binding); err != nil {
+			q.Cleanup()
+			return nil, err
+		}
+		values = append(values, value)
+	}
+}
+
+/*
+Query the rule `rule` with `args`, which should include the variable
+`outVar`, and decode the value bound to it in every result into a `T`, as
+QueryAll does:
+
+	posts, err := oso.QueryRuleInto[*Post](&o, "readable", "post", user, types.ValueVariable("post"))
+
+Polar dictionaries bound to `outVar` are decoded into struct types by `json`
+tag or field name. Returns an error if a result doesn't bind `outVar` or its
+value can't be decoded into a `T`.
+*/
+func QueryRuleInto[T any](o *Oso, rule, outVar string, args ...interface{}) ([]T, error) {
+	query, err := o.NewQueryFromRule(rule, args...)
+	if err != nil {
+		return nil, err
+	}
+	return QueryAll[T](query, outVar)
+}
@@ -17,3 +17,11 @@ type Iterator interface {
 	// Return a read-only channel of the iterator values.
 	Iter() <-chan interface{}
 }
+
+/*
+Interface for values that yield their values one at a time, such as cursors.
+*/
+type Nexter interface {
+	// Return the next value and `true`, or `false` once there are no more values.
+	Next() (interface{}, bool)
+}
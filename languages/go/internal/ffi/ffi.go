@@ -12,6 +12,8 @@ import "C"
 import (
 	"encoding/json"
 	"fmt"
+	"runtime"
+	"sync"
 	"unsafe"
 
 	"github.com/osohq/go-oso/errors"
@@ -36,22 +38,133 @@ func ffiSerialize(input interface{}) (*C.char, error) {
 	return C.CString(string(json)), nil
 }
 
-type PolarFfi struct {
+// The pointer to a Polar instance, shared by every copy of a PolarFfi and the
+// queries created from it.
+type polarHandle struct {
+	// Held for reading by every call into the Polar core, and for writing
+	// while the instance and its queries are freed.
+	mu  sync.RWMutex
 	ptr *C.polar_Polar
+	// Queries created from this instance that have not been freed yet.
+	queriesMu sync.Mutex
+	queries   map[*C.polar_Query]struct{}
+	// Whether the instance has been replaced, so that it's freed as soon as
+	// its last query is. Guarded by queriesMu.
+	retired bool
+}
+
+type PolarFfi struct {
+	handle *polarHandle
 }
 
 func NewPolarFfi() PolarFfi {
-	polarPtr := C.polar_new()
+	return newPolarFfi(C.polar_new())
+}
+
+func newPolarFfi(polarPtr *C.polar_Polar) PolarFfi {
+	handle := &polarHandle{
+		ptr:     polarPtr,
+		queries: make(map[*C.polar_Query]struct{}),
+	}
+	// Free the instance if it's garbage collected without being closed.
+	runtime.SetFinalizer(handle, func(h *polarHandle) { h.free() })
 	return PolarFfi{
-		ptr: polarPtr,
+		handle: handle,
+	}
+}
+
+// Free the Polar instance and any queries created from it that have not been
+// freed. Freeing an instance more than once does nothing.
+func (h *polarHandle) free() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.ptr == nil {
+		return
+	}
+	h.queriesMu.Lock()
+	for queryPtr := range h.queries {
+		C.query_free(queryPtr)
+	}
+	h.queries = nil
+	h.queriesMu.Unlock()
+	C.polar_free(h.ptr)
+	h.ptr = nil
+}
+
+// Lock the instance for a call into the Polar core. Fails if it has been
+// freed; otherwise the caller must call unlock once the call is finished.
+func (h *polarHandle) lock() error {
+	h.mu.RLock()
+	if h.ptr == nil {
+		h.mu.RUnlock()
+		return errors.NewClosedError()
+	}
+	return nil
+}
+
+func (h *polarHandle) unlock() {
+	h.mu.RUnlock()
+}
+
+// Record a query created from this instance, so that it is freed along with
+// the instance. The caller must hold the lock.
+func (h *polarHandle) newQueryFfi(queryPtr *C.polar_Query) *QueryFfi {
+	h.queriesMu.Lock()
+	h.queries[queryPtr] = struct{}{}
+	h.queriesMu.Unlock()
+	return &QueryFfi{
+		polar: h,
+		ptr:   queryPtr,
 	}
 }
 
-func (p *PolarFfi) delete() {
-	C.polar_free(p.ptr)
-	p = nil
+// Free the Polar instance along with any outstanding queries. Any later use of
+// the instance or its queries returns a ClosedError.
+func (p PolarFfi) Close() {
+	p.handle.free()
 }
 
+// Create a Polar instance with the same constants and MROs as this one but no
+// rules, e.g. to load a policy into before swapping it in. The new instance
+// draws instance IDs from the same counter, so the IDs handed out by the two
+// never collide.
+func (p PolarFfi) Fork() (PolarFfi, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := p.handle.lock(); err != nil {
+		return PolarFfi{}, err
+	}
+	defer p.handle.unlock()
+	polarPtr := C.polar_fork(p.handle.ptr)
+	if polarPtr == nil {
+		return PolarFfi{}, getError()
+	}
+	return newPolarFfi(polarPtr), nil
+}
+
+// Mark the instance as replaced: it's freed now if it has no outstanding
+// queries, and otherwise as soon as the last of them is deleted.
+func (p PolarFfi) Retire() {
+	p.handle.queriesMu.Lock()
+	p.handle.retired = true
+	idle := len(p.handle.queries) == 0
+	p.handle.queriesMu.Unlock()
+	if idle {
+		p.handle.free()
+	}
+}
+
+// Whether every query created from the instance has been freed.
+func (p PolarFfi) Idle() bool {
+	p.handle.queriesMu.Lock()
+	defer p.handle.queriesMu.Unlock()
+	return len(p.handle.queries) == 0
+}
+
+// The Polar C API keeps the last error in thread-local storage, so a call that
+// may fail must retrieve its error on the same OS thread: callers lock the
+// goroutine to its thread before calling into the C API, and unlock it once any
+// error has been retrieved.
 func getError() error {
 	err := C.polar_get_error()
 	errStr := readStr(err)
@@ -63,12 +176,21 @@ func getError() error {
 	return &polarError
 }
 
+// Get the version of the Polar core library that is linked in.
+func Version() string {
+	return readStr(C.polar_version())
+}
+
 type ffiInterface interface {
 	nextMessage() *C.char
+	handleMessage(message types.Message)
 }
 
+// Handles a message printed by the Polar VM.
+type MessageHandler func(message types.Message)
+
 func (p PolarFfi) nextMessage() *C.char {
-	return C.polar_next_polar_message(p.ptr)
+	return C.polar_next_polar_message(p.handle.ptr)
 }
 
 func processMessages(i ffiInterface) {
@@ -84,21 +206,35 @@ func processMessages(i ffiInterface) {
 		if err != nil {
 			panic(err)
 		}
-		switch messageStruct.Kind.MessageKindVariant.(type) {
-		case types.MessageKindPrint:
-			fmt.Printf("%s\n", messageStruct.Msg)
-			break
-		case types.MessageKindWarning:
-			fmt.Printf("WARNING: %s\n", messageStruct.Msg)
-			break
-		default:
-			fmt.Printf("Unexpected message: %#v\n", messageStruct)
-		}
+		i.handleMessage(messageStruct)
+	}
+}
+
+// Print a message from the Polar VM to standard output, as the VM does when no
+// handler is set.
+func PrintMessage(message types.Message) {
+	switch message.Kind.MessageKindVariant.(type) {
+	case types.MessageKindPrint:
+		fmt.Printf("%s\n", message.Msg)
+	case types.MessageKindWarning:
+		fmt.Printf("WARNING: %s\n", message.Msg)
+	default:
+		fmt.Printf("Unexpected message: %#v\n", message)
 	}
 }
 
+func (p PolarFfi) handleMessage(message types.Message) {
+	PrintMessage(message)
+}
+
 func (p PolarFfi) NewId() (uint64, error) {
-	id := C.polar_get_external_id(p.ptr)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := p.handle.lock(); err != nil {
+		return 0, err
+	}
+	defer p.handle.unlock()
+	id := C.polar_get_external_id(p.handle.ptr)
 	if id == 0 {
 		return 0, getError()
 	}
@@ -106,12 +242,18 @@ func (p PolarFfi) NewId() (uint64, error) {
 }
 
 func (p PolarFfi) Load(sources []types.Source) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := p.handle.lock(); err != nil {
+		return err
+	}
+	defer p.handle.unlock()
 	json, err := ffiSerialize(sources)
 	defer C.free(unsafe.Pointer(json))
 	if err != nil {
 		return err
 	}
-	result := C.polar_load(p.ptr, json)
+	result := C.polar_load(p.handle.ptr, json)
 	processMessages(p)
 	if result == 0 {
 		return getError()
@@ -119,8 +261,45 @@ func (p PolarFfi) Load(sources []types.Source) error {
 	return nil
 }
 
+// A problem found while loading a policy: exactly one of Error and Warning is
+// set.
+type Diagnostic struct {
+	Error   *errors.FormattedPolarError `json:"Error"`
+	Warning *string                     `json:"Warning"`
+}
+
+func (p PolarFfi) LoadWithDiagnostics(sources []types.Source) ([]Diagnostic, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := p.handle.lock(); err != nil {
+		return nil, err
+	}
+	defer p.handle.unlock()
+	sourcesJSON, err := ffiSerialize(sources)
+	defer C.free(unsafe.Pointer(sourcesJSON))
+	if err != nil {
+		return nil, err
+	}
+	diagnosticsPtr := C.polar_load_with_diagnostics(p.handle.ptr, sourcesJSON)
+	processMessages(p)
+	if diagnosticsPtr == nil {
+		return nil, getError()
+	}
+	var diagnostics []Diagnostic
+	if err := json.Unmarshal([]byte(readStr(diagnosticsPtr)), &diagnostics); err != nil {
+		return nil, err
+	}
+	return diagnostics, nil
+}
+
 func (p PolarFfi) ClearRules() error {
-	result := C.polar_clear_rules(p.ptr)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := p.handle.lock(); err != nil {
+		return err
+	}
+	defer p.handle.unlock()
+	result := C.polar_clear_rules(p.handle.ptr)
 	processMessages(p)
 	if result == 0 {
 		return getError()
@@ -129,41 +308,151 @@ func (p PolarFfi) ClearRules() error {
 }
 
 func (p PolarFfi) NewQueryFromStr(queryStr string) (*QueryFfi, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := p.handle.lock(); err != nil {
+		return nil, err
+	}
+	defer p.handle.unlock()
 	cs := C.CString(queryStr)
 	defer C.free(unsafe.Pointer(cs))
-	result := C.polar_new_query(p.ptr, cs, 0)
+	result := C.polar_new_query(p.handle.ptr, cs, 0)
 	processMessages(p)
 	if result == nil {
 		return nil, getError()
 	}
-	return newQueryFfi(result), nil
+	return p.handle.newQueryFfi(result), nil
 }
 
-func (p PolarFfi) NewQueryFromTerm(queryTerm types.Term) (*QueryFfi, error) {
+// Create a query for a term. If `trace` is true, results include a trace of
+// the rules and terms that produced them.
+func (p PolarFfi) NewQueryFromTerm(queryTerm types.Term, trace bool) (*QueryFfi, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := p.handle.lock(); err != nil {
+		return nil, err
+	}
+	defer p.handle.unlock()
 	json, err := ffiSerialize(queryTerm)
 	defer C.free(unsafe.Pointer(json))
 	if err != nil {
 		return nil, err
 	}
-	result := C.polar_new_query_from_term(p.ptr, json, 0)
+	var cTrace C.uint32_t
+	if trace {
+		cTrace = 1
+	}
+	result := C.polar_new_query_from_term(p.handle.ptr, json, cTrace)
 	processMessages(p)
 	if result == nil {
 		return nil, getError()
 	}
-	return newQueryFfi(result), nil
+	return p.handle.newQueryFfi(result), nil
 }
 
 func (p PolarFfi) NextInlineQuery() (*QueryFfi, error) {
-	queryPtr := C.polar_next_inline_query(p.ptr, 0)
+	if err := p.handle.lock(); err != nil {
+		return nil, err
+	}
+	defer p.handle.unlock()
+	queryPtr := C.polar_next_inline_query(p.handle.ptr, 0)
 	processMessages(p)
 	if queryPtr == nil {
 		// TODO: we don't have any way of signaling this failing?
 		return nil, nil
 	}
-	return newQueryFfi(queryPtr), nil
+	return p.handle.newQueryFfi(queryPtr), nil
+}
+
+func (p PolarFfi) RuleNames() ([]string, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := p.handle.lock(); err != nil {
+		return nil, err
+	}
+	defer p.handle.unlock()
+	namesPtr := C.polar_rule_names(p.handle.ptr)
+	if namesPtr == nil {
+		return nil, getError()
+	}
+	var names []string
+	err := json.Unmarshal([]byte(readStr(namesPtr)), &names)
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+func (p PolarFfi) UnregisteredClasses() ([]string, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := p.handle.lock(); err != nil {
+		return nil, err
+	}
+	defer p.handle.unlock()
+	classesPtr := C.polar_unregistered_classes(p.handle.ptr)
+	if classesPtr == nil {
+		return nil, getError()
+	}
+	var classes []string
+	err := json.Unmarshal([]byte(readStr(classesPtr)), &classes)
+	if err != nil {
+		return nil, err
+	}
+	return classes, nil
+}
+
+func (p PolarFfi) ReferencedClasses() ([]string, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := p.handle.lock(); err != nil {
+		return nil, err
+	}
+	defer p.handle.unlock()
+	classesPtr := C.polar_referenced_classes(p.handle.ptr)
+	if classesPtr == nil {
+		return nil, getError()
+	}
+	var classes []string
+	err := json.Unmarshal([]byte(readStr(classesPtr)), &classes)
+	if err != nil {
+		return nil, err
+	}
+	return classes, nil
+}
+
+// A field that a rule looks up on a parameter specialized on a class.
+type FieldReference struct {
+	Class string `json:"class"`
+	Field string `json:"field"`
+}
+
+func (p PolarFfi) ReferencedFields() ([]FieldReference, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := p.handle.lock(); err != nil {
+		return nil, err
+	}
+	defer p.handle.unlock()
+	fieldsPtr := C.polar_referenced_fields(p.handle.ptr)
+	if fieldsPtr == nil {
+		return nil, getError()
+	}
+	var fields []FieldReference
+	err := json.Unmarshal([]byte(readStr(fieldsPtr)), &fields)
+	if err != nil {
+		return nil, err
+	}
+	return fields, nil
 }
 
 func (p PolarFfi) RegisterConstant(term types.Term, name string) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := p.handle.lock(); err != nil {
+		return err
+	}
+	defer p.handle.unlock()
 	cName := C.CString(name)
 	defer C.free(unsafe.Pointer(cName))
 	cTerm, err := ffiSerialize(term)
@@ -171,7 +460,7 @@ func (p PolarFfi) RegisterConstant(term types.Term, name string) error {
 	if err != nil {
 		return err
 	}
-	result := C.polar_register_constant(p.ptr, cName, cTerm)
+	result := C.polar_register_constant(p.handle.ptr, cName, cTerm)
 	processMessages(p)
 	if result == 0 {
 		return getError()
@@ -180,6 +469,12 @@ func (p PolarFfi) RegisterConstant(term types.Term, name string) error {
 }
 
 func (p PolarFfi) RegisterMro(name string, mro []uint64) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := p.handle.lock(); err != nil {
+		return err
+	}
+	defer p.handle.unlock()
 	cName := C.CString(name)
 	defer C.free(unsafe.Pointer(cName))
 	cMro, err := ffiSerialize(mro)
@@ -187,7 +482,7 @@ func (p PolarFfi) RegisterMro(name string, mro []uint64) error {
 	if err != nil {
 		return err
 	}
-	result := C.polar_register_mro(p.ptr, cName, cMro)
+	result := C.polar_register_mro(p.handle.ptr, cName, cMro)
 	processMessages(p)
 	if result == 0 {
 		return getError()
@@ -196,18 +491,65 @@ func (p PolarFfi) RegisterMro(name string, mro []uint64) error {
 }
 
 type QueryFfi struct {
-	ptr *C.polar_Query
+	polar *polarHandle
+	ptr   *C.polar_Query
+	// Handles messages printed while running the query, or nil to print them
+	// to stdout.
+	messageHandler MessageHandler
 }
 
-func newQueryFfi(ptr *C.polar_Query) *QueryFfi {
-	return &QueryFfi{
-		ptr: ptr,
+// Handle messages printed while running the query with `handler` instead of
+// printing them to stdout.
+func (q *QueryFfi) SetMessageHandler(handler MessageHandler) {
+	q.messageHandler = handler
+}
+
+func (q QueryFfi) handleMessage(message types.Message) {
+	if q.messageHandler != nil {
+		q.messageHandler(message)
+	} else {
+		PrintMessage(message)
 	}
 }
 
+// Lock the query's Polar instance for a call into the Polar core. Fails if the
+// query or the instance has been freed; otherwise the caller must call unlock
+// once the call is finished.
+func (q QueryFfi) lock() error {
+	if err := q.polar.lock(); err != nil {
+		return err
+	}
+	if q.ptr == nil {
+		q.polar.unlock()
+		return errors.NewClosedError()
+	}
+	return nil
+}
+
+func (q QueryFfi) unlock() {
+	q.polar.unlock()
+}
+
 func (q *QueryFfi) Delete() {
-	C.query_free(q.ptr)
-	q = nil
+	if q.ptr == nil {
+		return
+	}
+	// Queries are freed along with their Polar instance, so there's nothing
+	// to do if it has already been freed.
+	var freePolar bool
+	if err := q.polar.lock(); err == nil {
+		q.polar.queriesMu.Lock()
+		delete(q.polar.queries, q.ptr)
+		freePolar = q.polar.retired && len(q.polar.queries) == 0
+		q.polar.queriesMu.Unlock()
+		C.query_free(q.ptr)
+		q.polar.unlock()
+	}
+	q.ptr = nil
+	// A retired instance is freed along with its last query.
+	if freePolar {
+		q.polar.free()
+	}
 }
 
 func (q QueryFfi) nextMessage() *C.char {
@@ -215,6 +557,12 @@ func (q QueryFfi) nextMessage() *C.char {
 }
 
 func (q QueryFfi) CallResult(callID uint64, term *types.Term) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := q.lock(); err != nil {
+		return err
+	}
+	defer q.unlock()
 	var s *C.char
 	var err error
 	if term != nil {
@@ -233,6 +581,12 @@ func (q QueryFfi) CallResult(callID uint64, term *types.Term) error {
 }
 
 func (q QueryFfi) QuestionResult(callID uint64, answer bool) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := q.lock(); err != nil {
+		return err
+	}
+	defer q.unlock()
 	var intAnswer int
 	if answer {
 		intAnswer = 1
@@ -247,6 +601,12 @@ func (q QueryFfi) QuestionResult(callID uint64, answer bool) error {
 }
 
 func (q QueryFfi) ApplicationError(message string) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := q.lock(); err != nil {
+		return err
+	}
+	defer q.unlock()
 	cMessage := C.CString(message)
 	defer C.free(unsafe.Pointer(cMessage))
 	result := C.polar_application_error(q.ptr, cMessage)
@@ -257,6 +617,12 @@ func (q QueryFfi) ApplicationError(message string) error {
 }
 
 func (q QueryFfi) NextEvent() (*string, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := q.lock(); err != nil {
+		return nil, err
+	}
+	defer q.unlock()
 	event := C.polar_next_query_event(q.ptr)
 	processMessages(q)
 	if event == nil {
@@ -267,6 +633,12 @@ func (q QueryFfi) NextEvent() (*string, error) {
 }
 
 func (q QueryFfi) DebugCommand(command *string) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := q.lock(); err != nil {
+		return err
+	}
+	defer q.unlock()
 	term := types.Term{types.Value{types.ValueString(*command)}}
 	cStr, err := ffiSerialize(term)
 	defer C.free(unsafe.Pointer(cStr))
@@ -282,6 +654,12 @@ func (q QueryFfi) DebugCommand(command *string) error {
 }
 
 func (q QueryFfi) Source() (*string, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := q.lock(); err != nil {
+		return nil, err
+	}
+	defer q.unlock()
 	source := C.polar_query_source_info(q.ptr)
 	if source == nil {
 		return nil, getError()
@@ -289,3 +667,74 @@ func (q QueryFfi) Source() (*string, error) {
 	goSource := readStr(source)
 	return &goSource, nil
 }
+
+// Cancels a query from any goroutine, even while NextEvent is running, after
+// which the query fails with an error.
+type CancelHandle struct {
+	ptr *C.polar_CancelHandle
+}
+
+// Get a handle that cancels the query. It stays valid after the query is
+// freed, and is freed itself once it is garbage collected.
+func (q QueryFfi) CancelHandle() (*CancelHandle, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := q.lock(); err != nil {
+		return nil, err
+	}
+	defer q.unlock()
+	ptr := C.polar_query_cancel_handle(q.ptr)
+	if ptr == nil {
+		return nil, getError()
+	}
+	handle := &CancelHandle{ptr: ptr}
+	runtime.SetFinalizer(handle, func(h *CancelHandle) { C.cancel_handle_free(h.ptr) })
+	return handle, nil
+}
+
+// Cancel the query. The Polar VM stops before its next goal.
+func (h *CancelHandle) Cancel() {
+	C.polar_cancel(h.ptr)
+}
+
+// Enable or disable tracing of policy evaluation for the query, overriding the
+// POLAR_LOG environment variable. Trace messages are passed to the query's
+// message handler.
+func (q QueryFfi) SetPolarLog(enabled bool) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := q.lock(); err != nil {
+		return err
+	}
+	defer q.unlock()
+	var cEnabled C.uint32_t
+	if enabled {
+		cEnabled = 1
+	}
+	result := C.polar_set_polar_log(q.ptr, cEnabled)
+	if result == 0 {
+		return getError()
+	}
+	return nil
+}
+
+func (q QueryFfi) Bind(name string, value types.Term) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := q.lock(); err != nil {
+		return err
+	}
+	defer q.unlock()
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+	cValue, err := ffiSerialize(value)
+	defer C.free(unsafe.Pointer(cValue))
+	if err != nil {
+		return err
+	}
+	result := C.polar_bind(q.ptr, cName, cValue)
+	if result == 0 {
+		return getError()
+	}
+	return nil
+}
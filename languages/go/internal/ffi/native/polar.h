@@ -11,10 +11,19 @@ typedef struct polar_Polar polar_Polar;
 
 typedef struct polar_Query polar_Query;
 
+/**
+ * Cancels the query it was created for, from any thread.
+ */
+typedef struct polar_CancelHandle polar_CancelHandle;
+
 const char *polar_get_error(void);
 
+const char *polar_version(void);
+
 polar_Polar *polar_new(void);
 
+polar_Polar *polar_fork(polar_Polar *polar_ptr);
+
 int32_t polar_load(polar_Polar *polar_ptr, const char *sources);
 
 int32_t polar_clear_rules(polar_Polar *polar_ptr);
@@ -33,6 +42,16 @@ polar_Query *polar_new_query(polar_Polar *polar_ptr, const char *query_str, uint
 
 const char *polar_next_polar_message(polar_Polar *polar_ptr);
 
+const char *polar_rule_names(polar_Polar *polar_ptr);
+
+const char *polar_load_with_diagnostics(polar_Polar *polar_ptr, const char *sources);
+
+const char *polar_unregistered_classes(polar_Polar *polar_ptr);
+
+const char *polar_referenced_classes(polar_Polar *polar_ptr);
+
+const char *polar_referenced_fields(polar_Polar *polar_ptr);
+
 const char *polar_next_query_event(polar_Query *query_ptr);
 
 /**
@@ -61,8 +80,24 @@ const char *polar_next_query_message(polar_Query *query_ptr);
 
 const char *polar_query_source_info(polar_Query *query_ptr);
 
+/**
+ * Get a handle that stops `query` with an error once it is passed to `polar_cancel`, even while
+ * `polar_next_query_event` is running on another thread. The handle stays valid after the query
+ * is freed, and must be freed itself with `cancel_handle_free`.
+ */
+polar_CancelHandle *polar_query_cancel_handle(polar_Query *query_ptr);
+
+int32_t polar_cancel(const polar_CancelHandle *handle_ptr);
+
 int32_t polar_bind(polar_Query *query_ptr, const char *name, const char *value);
 
+/**
+ * Enable or disable tracing of policy evaluation for the given query,
+ * overriding the `POLAR_LOG` environment variable. `enabled` is treated as a
+ * bool. Trace messages are returned by `polar_next_query_message`.
+ */
+int32_t polar_set_polar_log(polar_Query *query_ptr, uint32_t enabled);
+
 uint64_t polar_get_external_id(polar_Polar *polar_ptr);
 
 /**
@@ -82,6 +117,12 @@ int32_t polar_free(polar_Polar *polar);
  */
 int32_t query_free(polar_Query *query);
 
+/**
+ * Recovers the original boxed version of `handle` so that
+ * it can be properly freed
+ */
+int32_t cancel_handle_free(polar_CancelHandle *handle);
+
 const char *polar_build_filter_plan(polar_Polar *polar_ptr,
                                     const char *types,
                                     const char *results,
@@ -3,9 +3,14 @@
 package host
 
 import (
+	"context"
 	"fmt"
 	"math"
+	"math/big"
 	"reflect"
+	"runtime/debug"
+	"sort"
+	"sync"
 
 	"github.com/osohq/go-oso/errors"
 	"github.com/osohq/go-oso/internal/ffi"
@@ -15,13 +20,119 @@ import (
 
 var CLASSES = make(map[string]reflect.Type)
 
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
 type None struct{}
 
-type Host struct {
-	ffiPolar     ffi.PolarFfi
+// The classes, constructors, fields and instances registered with a host.
+// A registry is shared by a host and all of its copies, so it is never
+// modified once created: registering something replaces it with an updated
+// clone instead.
+type registry struct {
 	classes      map[string]reflect.Type
 	constructors map[string]reflect.Value
-	instances    map[uint64]reflect.Value
+	// Classes whose constructors take a single struct, filled from the
+	// keyword arguments of `new`, keyed by class name.
+	structConstructors map[string]bool
+	// Declared fields for classes registered with fields, keyed by class name.
+	// Each entry maps a field name to its declared Polar type.
+	fields map[string]map[string]interface{}
+	// Methods Polar may call on instances of classes registered with a list of
+	// methods, keyed by class name.
+	methods map[string]map[string]bool
+	// Custom equality functions for classes registered with one, keyed by the
+	// class's type (or the type it points to).
+	equals map[reflect.Type]func(a, b interface{}) bool
+	// Fields of classes registered with JSONTags, keyed by the class's type
+	// (or the type it points to) and then by the name in their `json` tag.
+	jsonFields map[reflect.Type]map[string]reflect.StructField
+	// Error classes whose errors are returned to the policy when a method
+	// returns them, keyed by the class's type (or the type it points to).
+	errorValues map[reflect.Type]bool
+	// The types of the values registered as constants, keyed by name.
+	constants map[string]reflect.Type
+	// The names functions were registered under, keyed by the ID of the
+	// instance registered for each.
+	functions map[uint64]string
+	// Instances cached when registering constants, which every copy of the
+	// host must be able to see. The table is shared by clones of the registry
+	// rather than copied.
+	instances *instanceTable
+	// The value of the `nil` constant, which Go nil values are converted to.
+	none *Value
+}
+
+func (r *registry) clone() *registry {
+	classes := make(map[string]reflect.Type, len(r.classes))
+	for k, v := range r.classes {
+		classes[k] = v
+	}
+	constructors := make(map[string]reflect.Value, len(r.constructors))
+	for k, v := range r.constructors {
+		constructors[k] = v
+	}
+	structConstructors := make(map[string]bool, len(r.structConstructors))
+	for k, v := range r.structConstructors {
+		structConstructors[k] = v
+	}
+	fields := make(map[string]map[string]interface{}, len(r.fields))
+	for k, v := range r.fields {
+		fields[k] = v
+	}
+	methods := make(map[string]map[string]bool, len(r.methods))
+	for k, v := range r.methods {
+		methods[k] = v
+	}
+	equals := make(map[reflect.Type]func(a, b interface{}) bool, len(r.equals))
+	for k, v := range r.equals {
+		equals[k] = v
+	}
+	jsonFields := make(map[reflect.Type]map[string]reflect.StructField, len(r.jsonFields))
+	for k, v := range r.jsonFields {
+		jsonFields[k] = v
+	}
+	errorValues := make(map[reflect.Type]bool, len(r.errorValues))
+	for k, v := range r.errorValues {
+		errorValues[k] = v
+	}
+	constants := make(map[string]reflect.Type, len(r.constants))
+	for k, v := range r.constants {
+		constants[k] = v
+	}
+	functions := make(map[uint64]string, len(r.functions))
+	for k, v := range r.functions {
+		functions[k] = v
+	}
+	return &registry{
+		classes:            classes,
+		constructors:       constructors,
+		structConstructors: structConstructors,
+		fields:             fields,
+		methods:            methods,
+		equals:             equals,
+		jsonFields:         jsonFields,
+		errorValues:        errorValues,
+		constants:          constants,
+		functions:          functions,
+		instances:          r.instances,
+		none:               r.none,
+	}
+}
+
+type Host struct {
+	ffiPolar ffi.PolarFfi
+	registry *registry
+	// Instances cached by this copy of the host, e.g. query arguments and
+	// values returned from method calls.
+	instances map[uint64]reflect.Value
+	// Whether looking up a field that doesn't exist yields nil instead of an
+	// error.
+	unknownAttributesAsNil bool
+	// Whether []byte values are converted to lists of integers instead of
+	// strings.
+	bytesAsList bool
 }
 
 func NewHost(polar ffi.PolarFfi) Host {
@@ -29,51 +140,505 @@ func NewHost(polar ffi.PolarFfi) Host {
 	for k, v := range CLASSES {
 		classes[k] = v
 	}
-	instances := make(map[uint64]reflect.Value)
-	constructors := make(map[string]reflect.Value)
 	return Host{
-		ffiPolar:     polar,
-		classes:      classes,
-		instances:    instances,
-		constructors: constructors,
+		ffiPolar: polar,
+		registry: &registry{
+			classes:            classes,
+			constructors:       make(map[string]reflect.Value),
+			structConstructors: make(map[string]bool),
+			fields:             make(map[string]map[string]interface{}),
+			methods:            make(map[string]map[string]bool),
+			equals:             make(map[reflect.Type]func(a, b interface{}) bool),
+			jsonFields:         make(map[reflect.Type]map[string]reflect.StructField),
+			errorValues:        make(map[reflect.Type]bool),
+			constants:          make(map[string]reflect.Type),
+			functions:          make(map[uint64]string),
+			instances:          &instanceTable{instances: make(map[uint64]reflect.Value)},
+		},
+		instances: make(map[uint64]reflect.Value),
 	}
 }
 
+// Copy the host for use by a single query. The registry is shared with the
+// copy rather than duplicated; only the table of instances is new.
 func (h Host) Copy() Host {
-	classes := make(map[string]reflect.Type)
-	for k, v := range h.classes {
-		classes[k] = v
-	}
-	instances := make(map[uint64]reflect.Value)
-	for k, v := range h.instances {
-		instances[k] = v
-	}
-	constructors := make(map[string]reflect.Value)
-	for k, v := range h.constructors {
-		constructors[k] = v
-	}
 	return Host{
-		ffiPolar:     h.ffiPolar,
-		classes:      classes,
-		instances:    instances,
-		constructors: constructors,
+		ffiPolar:               h.ffiPolar,
+		registry:               h.registry,
+		instances:              make(map[uint64]reflect.Value),
+		unknownAttributesAsNil: h.unknownAttributesAsNil,
+		bytesAsList:            h.bytesAsList,
 	}
 }
 
+// Get a copy of the host that registers MROs and hands out instance IDs with
+// `polar`, e.g. once a policy loaded into a fork of its instance is swapped in.
+func (h Host) WithPolar(polar ffi.PolarFfi) Host {
+	h.ffiPolar = polar
+	return h
+}
+
+// Set whether looking up a field that doesn't exist yields nil instead of an
+// error.
+func (h *Host) SetUnknownAttributesAsNil(asNil bool) {
+	h.unknownAttributesAsNil = asNil
+}
+
+// Whether looking up a field that doesn't exist yields nil; see
+// SetUnknownAttributesAsNil.
+func (h Host) UnknownAttributesAsNil() bool {
+	return h.unknownAttributesAsNil
+}
+
+// Set whether []byte values are converted to lists of integers instead of
+// strings.
+func (h *Host) SetBytesAsList(asList bool) {
+	h.bytesAsList = asList
+}
+
 func (h Host) getClass(name string) (*reflect.Type, error) {
-	if v, ok := h.classes[name]; ok {
+	if v, ok := h.registry.classes[name]; ok {
 		return &v, nil
 	}
 	return nil, errors.NewUnregisteredClassError(name)
 }
 
-func (h Host) CacheClass(cls reflect.Type, name string, constructor reflect.Value) error {
-	if v, ok := h.classes[name]; ok {
-		return errors.NewDuplicateClassAliasError(name, cls, v)
+// A class to cache with CacheClass.
+type Class struct {
+	Type reflect.Type
+	Name string
+	// The class's constructor, if it has one.
+	Constructor reflect.Value
+	// Whether the constructor takes a single struct (or pointer to one),
+	// filled from the keyword arguments of `new`, instead of positional
+	// arguments.
+	StructConstructor bool
+	// The fields Polar may look up on instances of the class, mapped to their
+	// declared types, or nil to allow any field.
+	Fields map[string]interface{}
+	// The methods Polar may call on instances of the class, or nil to allow
+	// any exported method.
+	Methods []string
+	// Compares instances of the class for equality, if non-nil.
+	Equals func(a, b interface{}) bool
+	// Whether to look up attributes by the names given in the `json` struct
+	// tags of the class's fields.
+	JSONTags bool
+	// Whether errors of the class returned by methods are passed to the
+	// policy instead of failing the query.
+	ErrorValue bool
+}
+
+// Cache a class under its name. Caching the same type under the same name
+// again with the same options does nothing, but with different options fails
+// with a ConflictingClassRegistrationError, so that a later registration can't
+// quietly drop e.g. the methods an earlier one allowed. Caching a different
+// type under a name that's already taken fails with a
+// DuplicateClassAliasError.
+func (h *Host) CacheClass(class Class) error {
+	if v, ok := h.registry.classes[class.Name]; ok && v != class.Type {
+		return errors.NewDuplicateClassAliasError(class.Name, class.Type, v)
+	}
+	var declared map[string]interface{}
+	if class.Fields != nil {
+		var err error
+		declared, err = validateFields(class.Type, class.Fields)
+		if err != nil {
+			return err
+		}
+	}
+	var methods map[string]bool
+	if class.Methods != nil {
+		var err error
+		methods, err = validateMethods(class.Type, class.Methods)
+		if err != nil {
+			return err
+		}
+	}
+	var jsonFields map[string]reflect.StructField
+	if class.JSONTags {
+		var err error
+		jsonFields, err = JSONFields(class.Type)
+		if err != nil {
+			return err
+		}
+	}
+	if class.StructConstructor {
+		if err := validateStructConstructor(class.Constructor); err != nil {
+			return err
+		}
+	}
+	if class.ErrorValue && !class.Type.Implements(errorType) && !reflect.PtrTo(class.Type).Implements(errorType) {
+		return fmt.Errorf("Cannot register %v as an error value class; it does not implement error", class.Type)
+	}
+	if _, ok := h.registry.classes[class.Name]; ok {
+		if h.registry.sameClass(class, declared, methods) {
+			return nil
+		}
+		return errors.NewConflictingClassRegistrationError(class.Name, class.Type)
+	}
+	registry := h.registry.clone()
+	registry.classes[class.Name] = class.Type
+	if class.Constructor.IsValid() {
+		registry.constructors[class.Name] = class.Constructor
+	}
+	if class.StructConstructor {
+		registry.structConstructors[class.Name] = true
+	}
+	if declared != nil {
+		registry.fields[class.Name] = declared
+	}
+	if methods != nil {
+		registry.methods[class.Name] = methods
+	}
+	if class.Equals != nil {
+		registry.equals[IndirectType(class.Type)] = class.Equals
+	}
+	if jsonFields != nil {
+		registry.jsonFields[IndirectType(class.Type)] = jsonFields
+	}
+	if class.ErrorValue {
+		registry.errorValues[IndirectType(class.Type)] = true
+	}
+	h.registry = registry
+	return nil
+}
+
+// Whether `class`, with its validated fields and methods, is registered
+// exactly as it is already.
+func (r *registry) sameClass(class Class, declared map[string]interface{}, methods map[string]bool) bool {
+	ctor, hasCtor := r.constructors[class.Name]
+	if hasCtor != class.Constructor.IsValid() || (hasCtor && ctor.Pointer() != class.Constructor.Pointer()) {
+		return false
 	}
-	h.classes[name] = cls
-	if constructor.IsValid() {
-		h.constructors[name] = constructor
+	typ := IndirectType(class.Type)
+	equals, hasEquals := r.equals[typ]
+	if hasEquals != (class.Equals != nil) || (hasEquals && reflect.ValueOf(equals).Pointer() != reflect.ValueOf(class.Equals).Pointer()) {
+		return false
+	}
+	_, jsonTags := r.jsonFields[typ]
+	return r.structConstructors[class.Name] == class.StructConstructor &&
+		reflect.DeepEqual(r.fields[class.Name], declared) &&
+		reflect.DeepEqual(r.methods[class.Name], methods) &&
+		jsonTags == class.JSONTags &&
+		r.errorValues[typ] == class.ErrorValue
+}
+
+// Check that a constructor takes a single struct, or pointer to one.
+func validateStructConstructor(ctor reflect.Value) error {
+	if !ctor.IsValid() {
+		return fmt.Errorf("A class constructed from a struct must have a constructor")
+	}
+	typ := ctor.Type()
+	if typ.NumIn() != 1 || typ.IsVariadic() || IndirectType(typ.In(0)).Kind() != reflect.Struct {
+		return fmt.Errorf("Constructor %v must take a single struct to be constructed from a struct", typ)
+	}
+	return nil
+}
+
+// Whether the constructor of the class `name` takes a single struct filled
+// from the keyword arguments of `new`.
+func (h Host) HasStructConstructor(name string) bool {
+	return h.registry.structConstructors[name]
+}
+
+// Convert a value to Polar to register it as a constant. Any instances cached
+// along the way are added to the registry, so that all copies of the host made
+// from now on can see them.
+func (h *Host) ConstantToPolar(v interface{}) (*Value, error) {
+	scratch := h.Copy()
+	value, err := scratch.ToPolar(v)
+	if err != nil {
+		return nil, err
+	}
+	h.registry.instances.add(scratch.instances)
+	if _, isNone := v.(None); isNone {
+		registry := h.registry.clone()
+		registry.none = value
+		h.registry = registry
+	}
+	return value, nil
+}
+
+// Forget the instances in `term` that were cached by ConstantToPolar, so that
+// they can be garbage collected.
+func (h Host) ReleaseInstances(term Term) {
+	var ids []uint64
+	collectInstanceIDs(term, &ids)
+	h.registry.instances.remove(ids)
+}
+
+func collectInstanceIDs(term Term, ids *[]uint64) {
+	switch inner := term.Value.ValueVariant.(type) {
+	case ValueExternalInstance:
+		*ids = append(*ids, inner.InstanceId)
+	case ValueList:
+		for _, t := range inner {
+			collectInstanceIDs(t, ids)
+		}
+	case ValueDictionary:
+		for _, t := range inner.Fields {
+			collectInstanceIDs(t, ids)
+		}
+	}
+}
+
+// A table of instances that may be added to or removed from while it is shared.
+type instanceTable struct {
+	mu        sync.RWMutex
+	instances map[uint64]reflect.Value
+}
+
+func (t *instanceTable) get(id uint64) (reflect.Value, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	v, ok := t.instances[id]
+	return v, ok
+}
+
+func (t *instanceTable) add(instances map[uint64]reflect.Value) {
+	if len(instances) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k, v := range instances {
+		t.instances[k] = v
+	}
+}
+
+func (t *instanceTable) remove(ids []uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, id := range ids {
+		delete(t.instances, id)
+	}
+}
+
+// Reports whether `err` is an instance of a class registered with ErrorValue,
+// which should be passed to the policy rather than fail the query.
+func (h Host) IsErrorValue(err error) bool {
+	return h.registry.errorValues[IndirectType(reflect.TypeOf(err))]
+}
+
+// Get the custom equality function for comparing `left` and `right`, if they
+// are instances of the same class and it was registered with one.
+func (h Host) EqualsFunc(left interface{}, right interface{}) (func(a, b interface{}) bool, bool) {
+	if left == nil || right == nil {
+		return nil, false
+	}
+	typ := IndirectType(reflect.TypeOf(left))
+	if typ != IndirectType(reflect.TypeOf(right)) {
+		return nil, false
+	}
+	equals, ok := h.registry.equals[typ]
+	return equals, ok
+}
+
+// Record that a value of type `typ` was registered as the constant `name`,
+// converted to Polar as `value`.
+func (h *Host) CacheConstant(name string, typ reflect.Type, value *Value) {
+	registry := h.registry.clone()
+	registry.constants[name] = typ
+	if instance, ok := value.ValueVariant.(ValueExternalInstance); ok && typ != nil && typ.Kind() == reflect.Func {
+		registry.functions[instance.InstanceId] = name
+	}
+	h.registry = registry
+}
+
+// Get the name that the function `term` refers to was registered under with
+// RegisterFunction, if it was.
+func (h Host) FunctionName(term types.Term) (string, bool) {
+	instance, ok := term.Value.ValueVariant.(ValueExternalInstance)
+	if !ok {
+		return "", false
+	}
+	name, ok := h.registry.functions[instance.InstanceId]
+	return name, ok
+}
+
+// Get the registered classes, keyed by name.
+func (h Host) Classes() map[string]reflect.Type {
+	classes := make(map[string]reflect.Type, len(h.registry.classes))
+	for k, v := range h.registry.classes {
+		classes[k] = v
+	}
+	return classes
+}
+
+// Get the types of the registered constants, keyed by name.
+func (h Host) Constants() map[string]reflect.Type {
+	constants := make(map[string]reflect.Type, len(h.registry.constants))
+	for k, v := range h.registry.constants {
+		constants[k] = v
+	}
+	return constants
+}
+
+// Validate the fields that Polar may look up on instances of `cls`, along
+// with their declared Polar types. Each type must be either a reflect.Type
+// that the field's values can be used as, or the name of a class, which may
+// be registered later and is checked by Lint instead.
+func validateFields(cls reflect.Type, fields map[string]interface{}) (map[string]interface{}, error) {
+	structType := cls
+	if structType.Kind() == reflect.Ptr {
+		structType = structType.Elem()
+	}
+	if structType.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("Cannot register fields for %v; it is not a struct", cls)
+	}
+
+	declared := make(map[string]interface{})
+	for field, typ := range fields {
+		f, ok := structType.FieldByName(field)
+		if !ok || f.PkgPath != "" {
+			return nil, fmt.Errorf("%v has no exported field '%s'", cls, field)
+		}
+		switch typ := typ.(type) {
+		case reflect.Type:
+			if !fieldHasType(f.Type, typ) {
+				return nil, fmt.Errorf("Field '%s' of %v has type %v, which can't be used as its declared type %v", field, cls, f.Type, typ)
+			}
+			declared[field] = typ
+		case string:
+			declared[field] = typ
+		default:
+			return nil, fmt.Errorf("Type of field '%s' must be a reflect.Type or class name, got: %T", field, typ)
+		}
+	}
+	return declared, nil
+}
+
+// Whether the values of a struct field of type `field` can be used as values
+// of the declared type `declared`. Pointers are looked through, as Polar sees
+// the values they point to, and numbers may be converted to numbers of other
+// kinds, as they are when passed to Go.
+func fieldHasType(field reflect.Type, declared reflect.Type) bool {
+	field, declared = IndirectType(field), IndirectType(declared)
+	switch {
+	case field.AssignableTo(declared):
+		return true
+	case field.Kind() == reflect.Interface:
+		// The field may hold values of the declared type.
+		return declared.AssignableTo(field)
+	default:
+		return isNumber(field) && isNumber(declared) && field.ConvertibleTo(declared)
+	}
+}
+
+func isNumber(typ reflect.Type) bool {
+	switch typ.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func validateMethods(cls reflect.Type, names []string) (map[string]bool, error) {
+	// Methods with pointer receivers can be called on any instance, since
+	// methods are called through a pointer to the instance.
+	methodSet := cls
+	if cls.Kind() != reflect.Interface && cls.Kind() != reflect.Ptr {
+		methodSet = reflect.PtrTo(cls)
+	}
+	methods := make(map[string]bool, len(names))
+	for _, name := range names {
+		if _, ok := methodSet.MethodByName(name); !ok {
+			return nil, fmt.Errorf("%v has no exported method '%s'", cls, name)
+		}
+		methods[name] = true
+	}
+	return methods, nil
+}
+
+// Find the field of the struct type `typ` that the Polar attribute `name`
+// refers to. Classes registered with JSONTags look up the names in their `json`
+// struct tags first; otherwise fields are found by FieldForAttribute. Either
+// way, fields hidden or renamed by their `polar` tags aren't found by their Go
+// or `json` names.
+func (h Host) FieldForAttribute(typ reflect.Type, name string) (reflect.StructField, bool) {
+	if field, ok := h.registry.jsonFields[typ][name]; ok {
+		return field, !HiddenByTag(typ, field)
+	}
+	return FieldForAttribute(typ, name)
+}
+
+// Check that `field` may be looked up on `instance`. Instances of classes that
+// were registered without fields may have any field looked up.
+func (h Host) CheckField(instance interface{}, field string) error {
+	if instance == nil {
+		return nil
+	}
+	instanceType := IndirectType(reflect.TypeOf(instance))
+	for name, declared := range h.registry.fields {
+		if !isInstanceOf(instanceType, h.registry.classes[name]) {
+			continue
+		}
+		if _, ok := declared[field]; !ok {
+			return errors.NewUnregisteredFieldError(name, field)
+		}
+	}
+	return nil
+}
+
+// The fields declared with the name of a class that isn't registered, as a map
+// from the name of the class declaring them to the field names and the class
+// names they were declared with.
+func (h Host) UnregisteredFieldTypes() map[string]map[string]string {
+	unregistered := make(map[string]map[string]string)
+	for class, declared := range h.registry.fields {
+		for field, typ := range declared {
+			name, ok := typ.(string)
+			if !ok {
+				continue
+			}
+			if _, ok := h.registry.classes[name]; ok {
+				continue
+			}
+			if unregistered[class] == nil {
+				unregistered[class] = make(map[string]string)
+			}
+			unregistered[class][field] = name
+		}
+	}
+	return unregistered
+}
+
+// Check that the Polar attribute `name` may be looked up on instances of the
+// class `class`, as CheckField does for a particular instance. Classes that
+// aren't registered or were registered without fields may have any field
+// looked up.
+func (h Host) CheckClassField(class string, name string) error {
+	declared, ok := h.registry.fields[class]
+	if !ok {
+		return nil
+	}
+	if field, ok := h.FieldForAttribute(IndirectType(h.registry.classes[class]), name); ok {
+		if _, ok := declared[field.Name]; ok {
+			return nil
+		}
+	}
+	return errors.NewUnregisteredFieldError(class, name)
+}
+
+// Check that the method `name` may be called on `instance`. Instances of
+// classes that were registered without a list of methods may have any exported
+// method called. An instance of several classes with lists of methods, e.g. a
+// struct and an interface it implements, may only call methods on all of them.
+func (h Host) CheckMethod(instance interface{}, name string) error {
+	if instance == nil {
+		return nil
+	}
+	instanceType := IndirectType(reflect.TypeOf(instance))
+	for class, methods := range h.registry.methods {
+		if !isInstanceOf(instanceType, h.registry.classes[class]) {
+			continue
+		}
+		if !methods[name] {
+			return errors.NewUnregisteredMethodError(class, name)
+		}
 	}
 	return nil
 }
@@ -81,7 +646,7 @@ func (h Host) CacheClass(cls reflect.Type, name string, constructor reflect.Valu
 func (h Host) RegisterMros() error {
 	// Go does not support inheritance, so all MROs are empty
 	var err error
-	for name, _ := range h.classes {
+	for name, _ := range h.registry.classes {
 		err = h.ffiPolar.RegisterMro(name, []uint64{})
 		if err != nil {
 			return err
@@ -94,12 +659,15 @@ func (h Host) getInstance(id uint64) (*reflect.Value, error) {
 	if v, ok := h.instances[id]; ok {
 		return &v, nil
 	}
+	if v, ok := h.registry.instances.get(id); ok {
+		return &v, nil
+	}
 	return nil, errors.NewUnregisteredInstanceError(id)
 }
 
 func (h Host) MakeInstance(call types.ValueCall, id uint64) error {
 	// Check for duplicate instance
-	if _, ok := h.instances[id]; ok {
+	if _, err := h.getInstance(id); err == nil {
 		return errors.NewDuplicateInstanceRegistrationError(id)
 	}
 	name := string(call.Name)
@@ -109,18 +677,38 @@ func (h Host) MakeInstance(call types.ValueCall, id uint64) error {
 	if err != nil {
 		return &errors.ErrorWithAdditionalInfo{Inner: errors.NewInvalidConstructorError(types.Value{ValueVariant: call}), Info: err.Error()}
 	}
-	if constructor, ok := h.constructors[name]; ok {
+	if constructor, ok := h.registry.constructors[name]; ok {
+		// Keyword arguments are passed to struct constructors as a
+		// dictionary, which is decoded into the struct.
+		if h.registry.structConstructors[name] && call.Kwargs != nil {
+			if len(args) > 0 {
+				return &errors.ErrorWithAdditionalInfo{Inner: errors.NewInvalidConstructorError(types.Value{ValueVariant: call}), Info: "Cannot pass both positional and keyword arguments to a constructor that takes a struct"}
+			}
+			args = []types.Term{{Value: types.Value{ValueVariant: types.ValueDictionary{Fields: *call.Kwargs}}}}
+		}
 		results, err := h.CallFunction(constructor, args)
 		if err != nil {
 			return &errors.ErrorWithAdditionalInfo{Inner: errors.NewInvalidConstructorError(types.Value{ValueVariant: call}), Info: err.Error()}
 		}
+		// Constructors may also return an error as their last result.
+		if len(results) == 2 && constructor.Type().Out(1) == errorType {
+			if err, _ := results[1].Interface().(error); err != nil {
+				return &errors.ErrorWithAdditionalInfo{Inner: errors.NewInvalidConstructorError(types.Value{ValueVariant: call}), Info: err.Error()}
+			}
+			results = results[:1]
+		}
 		if len(results) != 1 {
-			return &errors.ErrorWithAdditionalInfo{Inner: errors.NewInvalidConstructorError(types.Value{ValueVariant: call}), Info: fmt.Sprintf("Constructor must retun 1 result; returned %v", len(results))}
+			return &errors.ErrorWithAdditionalInfo{Inner: errors.NewInvalidConstructorError(types.Value{ValueVariant: call}), Info: fmt.Sprintf("Constructor must return 1 result, or a result and an error; returned %v", len(results))}
 		}
 		instance := results[0]
-		if instance.Type() != *cls {
+		if IndirectType(instance.Type()) != IndirectType(*cls) {
 			return &errors.ErrorWithAdditionalInfo{Inner: errors.NewInvalidConstructorError(types.Value{ValueVariant: call}), Info: fmt.Sprintf("Expected constructor to return %v; returned %v", *cls, instance.Type())}
 		}
+		if instance.Kind() == reflect.Ptr {
+			if instance.IsNil() {
+				return &errors.ErrorWithAdditionalInfo{Inner: errors.NewInvalidConstructorError(types.Value{ValueVariant: call}), Info: "Constructor returned a nil pointer"}
+			}
+		}
 		h.cacheInstance(instance.Interface(), &id)
 		return nil
 	} else {
@@ -129,30 +717,51 @@ func (h Host) MakeInstance(call types.ValueCall, id uint64) error {
 }
 
 func (h Host) CallFunction(fn reflect.Value, termArgs []types.Term) ([]reflect.Value, error) {
+	return h.callFunction(fn, nil, termArgs)
+}
+
+// Call a function with arguments from Polar, as CallFunction does. If the
+// function's first parameter is a context.Context, `ctx` is passed for it, and
+// the arguments from Polar are passed for the remaining parameters.
+func (h Host) CallFunctionWithContext(ctx context.Context, fn reflect.Value, termArgs []types.Term) ([]reflect.Value, error) {
+	if fn.Kind() == reflect.Func && fn.Type().NumIn() > 0 && fn.Type().In(0) == contextType {
+		return h.callFunction(fn, []reflect.Value{reflect.ValueOf(&ctx).Elem()}, termArgs)
+	}
+	return h.callFunction(fn, nil, termArgs)
+}
+
+// Call a function with the values `injected` followed by the arguments from
+// Polar.
+func (h Host) callFunction(fn reflect.Value, injected []reflect.Value, termArgs []types.Term) ([]reflect.Value, error) {
 	if fn.Kind() != reflect.Func {
 		panic(fmt.Errorf("CallFunction expects a reflect.Func value; got: %v", fn.Kind()))
 	}
-	args, err := h.ListToGo(termArgs)
+	polarArgs, err := h.ListToGo(termArgs)
 	if err != nil {
 		return nil, err
 	}
+	args := make([]interface{}, len(injected), len(injected)+len(polarArgs))
+	args = append(args, polarArgs...)
 	numIn := fn.Type().NumIn()
 	var end int
 	if !fn.Type().IsVariadic() {
 		if len(args) != numIn {
-			return nil, fmt.Errorf("incorrect number of arguments. Expected %v, got %v", numIn, len(args))
+			return nil, fmt.Errorf("incorrect number of arguments. Expected %v, got %v", numIn-len(injected), len(polarArgs))
 		}
 		end = numIn
 	} else {
 		// stop one before the end so we can make this a slice
 		end = numIn - 1
+		if len(args) < end {
+			return nil, fmt.Errorf("incorrect number of arguments. Expected at least %v, got %v", end-len(injected), len(polarArgs))
+		}
 	}
 
 	callArgs := make([]reflect.Value, numIn)
-	var results []reflect.Value
 
 	// construct callArgs by converting them to typed values, then call method to get results
-	for i := 0; i < end; i++ {
+	copy(callArgs, injected)
+	for i := len(injected); i < end; i++ {
 		arg := args[i]
 		callArgs[i] = reflect.New(fn.Type().In(i)).Elem()
 		err := SetFieldTo(callArgs[i], arg)
@@ -168,12 +777,21 @@ func (h Host) CallFunction(fn reflect.Value, termArgs []types.Term) ([]reflect.V
 		if err != nil {
 			return nil, err
 		}
-		results = fn.CallSlice(callArgs)
-	} else {
-		results = fn.Call(callArgs)
 	}
+	return call(fn, callArgs)
+}
 
-	return results, nil
+// Call `fn`, recovering from a panic in it as a PanicError.
+func call(fn reflect.Value, args []reflect.Value) (results []reflect.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			results, err = nil, errors.NewPanicError(r, debug.Stack())
+		}
+	}()
+	if fn.Type().IsVariadic() {
+		return fn.CallSlice(args), nil
+	}
+	return fn.Call(args), nil
 }
 
 func (h Host) cacheInstance(instance interface{}, id *uint64) (*uint64, error) {
@@ -201,10 +819,41 @@ func (h Host) Isa(value types.Term, classTag string) (bool, error) {
 		return false, err
 	}
 	instanceType := reflect.TypeOf(instance)
-	res := instanceType.ConvertibleTo(*class)
+	if instanceType == nil {
+		return false, nil
+	}
+	if (*class).Kind() == reflect.Interface {
+		return implements(instanceType, *class), nil
+	}
+	res := IndirectType(instanceType).ConvertibleTo(IndirectType(*class))
 	return res, nil
 }
 
+// Get the type a pointer type points to, or the type itself for any other
+// kind of type. Polar treats `T` and `*T` as the same class.
+func IndirectType(typ reflect.Type) reflect.Type {
+	if typ.Kind() == reflect.Ptr {
+		return typ.Elem()
+	}
+	return typ
+}
+
+// Check whether `typ` implements the interface `iface`. Methods are looked up
+// on a pointer to the value (as they are for method calls), so types that
+// implement an interface with pointer receivers match too.
+// Whether values of `typ`, which is not a pointer, are instances of the class
+// `cls`: it is the type `cls` is or points to, or an interface it implements.
+func isInstanceOf(typ reflect.Type, cls reflect.Type) bool {
+	if cls.Kind() == reflect.Interface {
+		return implements(typ, cls)
+	}
+	return IndirectType(cls) == typ
+}
+
+func implements(typ reflect.Type, iface reflect.Type) bool {
+	return typ.Implements(iface) || reflect.PtrTo(typ).Implements(iface)
+}
+
 func (h Host) IsSubclass(leftTag string, rightTag string) (bool, error) {
 	left, err := h.getClass(leftTag)
 	if err != nil {
@@ -215,7 +864,10 @@ func (h Host) IsSubclass(leftTag string, rightTag string) (bool, error) {
 		return false, err
 	}
 
-	return *left == *right, nil
+	if (*right).Kind() == reflect.Interface {
+		return *left == *right || implements(*left, *right), nil
+	}
+	return IndirectType(*left) == IndirectType(*right), nil
 }
 
 func (h Host) IsSubspecializer(instanceID int, leftTag string, rightTag string) (bool, error) {
@@ -230,6 +882,15 @@ func (h Host) ToPolar(v interface{}) (*Value, error) {
 	case bool:
 		inner := ValueBoolean(v)
 		return &Value{inner}, nil
+	case []byte:
+		if !h.bytesAsList {
+			return &Value{ValueString(v)}, nil
+		}
+		list := make([]interface{}, len(v))
+		for i, b := range v {
+			list[i] = b
+		}
+		return h.ToPolar(list)
 	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
 		var intVal int64
 		switch vv := v.(type) {
@@ -268,13 +929,38 @@ func (h Host) ToPolar(v interface{}) (*Value, error) {
 		case float64:
 			floatVal = float64(vv)
 		}
-		inner := ValueNumber{types.NumericInteger(floatVal)}
+		inner := ValueNumber{types.NumericFloat(floatVal)}
+		return &Value{inner}, nil
+	case *big.Int:
+		// Converted exactly, so only values that fit in an int64 are allowed.
+		if v == nil {
+			return h.ToPolar(None{})
+		}
+		if !v.IsInt64() {
+			return nil, fmt.Errorf("Invalid integer %v, min %v, max %v", v, math.MinInt64, math.MaxInt64)
+		}
+		inner := ValueNumber{types.NumericInteger(v.Int64())}
+		return &Value{inner}, nil
+	case *big.Float:
+		// Rounded to the nearest float64.
+		if v == nil {
+			return h.ToPolar(None{})
+		}
+		floatVal, _ := v.Float64()
+		inner := ValueNumber{types.NumericFloat(floatVal)}
 		return &Value{inner}, nil
 	case string:
 		inner := ValueString(v)
 		return &Value{inner}, nil
+	case None:
+		if h.registry.none != nil {
+			none := *h.registry.none
+			return &none, nil
+		}
 	case Value:
 		return &v, nil
+	case Term:
+		return &v.Value, nil
 	case ValueVariant:
 		// if its already a variant, return that
 		return &Value{v}, nil
@@ -289,6 +975,11 @@ func (h Host) ToPolar(v interface{}) (*Value, error) {
 			// TODO: Is `nil` a reflect.Ptr?
 			return h.ToPolar(None{})
 		}
+		if rt.Kind() == reflect.Ptr && isInstance(rtDeref) {
+			// Cache the pointer itself so that the same instance is returned
+			// to the application when it comes back from Polar.
+			return h.instanceToPolar(v, rtDeref.Interface())
+		}
 		return h.ToPolar(rtDeref.Interface())
 	}
 
@@ -307,13 +998,15 @@ func (h Host) ToPolar(v interface{}) (*Value, error) {
 		inner := ValueList(slice)
 		return &Value{inner}, nil
 	case reflect.Map:
+		// Polar dictionaries are keyed by symbols, so maps with other keys are
+		// passed as external instances. Policies iterate over them with `in`,
+		// which yields a [key, value] list for each entry.
+		if rt.Type().Key().Kind() != reflect.String {
+			return h.instanceToPolar(v, v)
+		}
 		fields := make(map[types.Symbol]types.Term)
 		iter := rt.MapRange()
 		for iter.Next() {
-			// TODO(gj): error on maps w/o string keys since we're just gonna
-			// stringify 'em here and something will blow up way later (probably in
-			// query.go where we call
-			// `reflect.ValueOf(instance).FieldByName(string(event.Attribute)`).
 			k := iter.Key().String()
 			v := iter.Value().Interface()
 			converted, err := h.ToPolar(v)
@@ -325,18 +1018,82 @@ func (h Host) ToPolar(v interface{}) (*Value, error) {
 		inner := ValueDictionary{Fields: fields}
 		return &Value{inner}, nil
 	default:
-		instanceID, err := h.cacheInstance(v, nil)
-		if err != nil {
-			return nil, err
+		return h.instanceToPolar(v, v)
+	}
+}
+
+// Caches instance and returns a Polar external instance referring to it,
+// represented by the value it points to.
+func (h Host) instanceToPolar(instance interface{}, value interface{}) (*Value, error) {
+	instanceID, err := h.cacheInstance(instance, nil)
+	if err != nil {
+		return nil, err
+	}
+	repr := fmt.Sprintf("%T%+v", value, value)
+	inner := ValueExternalInstance{
+		InstanceId:  *instanceID,
+		Constructor: nil,
+		Repr:        &repr,
+	}
+	return &Value{inner}, nil
+}
+
+// Reports whether v is converted to a Polar external instance rather than a
+// native Polar value.
+func isInstance(v reflect.Value) bool {
+	if v.Kind() != reflect.Struct {
+		return false
+	}
+	switch v.Interface().(type) {
+	case Value, ValueVariant, None:
+		return false
+	}
+	return true
+}
+
+// Get the name of the Polar class of `term`, given the Go value it converts
+// to. Instances are named by the class their type is registered as, preferring
+// the type's own name if it is registered under several, or by their Go type
+// if it isn't registered. Returns "" for values that aren't instances of a
+// class, such as variables.
+func (h Host) ClassOf(term types.Term, value interface{}) string {
+	switch inner := term.Value.ValueVariant.(type) {
+	case ValueBoolean:
+		return "Boolean"
+	case ValueNumber:
+		if _, ok := inner.NumericVariant.(NumericInteger); ok {
+			return "Integer"
 		}
-		repr := fmt.Sprintf("%T%+v", v, v)
-		inner := ValueExternalInstance{
-			InstanceId:  *instanceID,
-			Constructor: nil,
-			Repr:        &repr,
+		return "Float"
+	case ValueString:
+		return "String"
+	case ValueList:
+		return "List"
+	case ValueDictionary:
+		return "Dictionary"
+	case ValueExternalInstance:
+		if _, isNone := value.(None); value == nil || isNone {
+			return "nil"
 		}
-		return &Value{inner}, nil
+		typ := IndirectType(reflect.TypeOf(value))
+		var names []string
+		for name, cls := range h.registry.classes {
+			if cls == typ || cls == reflect.PtrTo(typ) {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			return reflect.TypeOf(value).String()
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if name == ClassName(typ) {
+				return name
+			}
+		}
+		return names[0]
 	}
+	return ""
 }
 
 func (h Host) ListToGo(v []types.Term) ([]interface{}, error) {
@@ -2,7 +2,14 @@ package host
 
 import (
 	"fmt"
+	"math"
+	"math/big"
 	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 func String(s string) *string {
@@ -10,51 +17,96 @@ func String(s string) *string {
 }
 
 func SetFieldTo(field reflect.Value, input interface{}) error {
+	return DecodeTo(field, input, false)
+}
+
+// Set `field` to `input`, as SetFieldTo does. If `strict` is true, decoding a
+// dictionary into a struct fails if the struct has no field for one of its
+// keys; otherwise those keys are ignored.
+func DecodeTo(field reflect.Value, input interface{}, strict bool) error {
 	// todo: explain how this works and why.
 	if !field.CanSet() {
 		return fmt.Errorf("cannot set field")
 	}
 	fieldType := field.Type()
+	if valInput := reflect.ValueOf(input); valInput.IsValid() && valInput.Type().AssignableTo(fieldType) {
+		field.Set(valInput)
+		return nil
+	}
+	if dict, ok := input.(map[string]interface{}); ok && fieldType.Kind() == reflect.Struct {
+		return decodeDictionary(field, dict, strict)
+	}
+	// Strings are decoded into byte slices as their UTF-8 bytes.
+	if str, ok := input.(string); ok && fieldType.Kind() == reflect.Slice && fieldType.Elem().Kind() == reflect.Uint8 {
+		field.Set(reflect.ValueOf([]byte(str)).Convert(fieldType))
+		return nil
+	}
+	if converted, ok := toBig(fieldType, input); ok {
+		if !converted.IsValid() {
+			return fmt.Errorf("cannot assign %v to %s", input, fieldType)
+		}
+		field.Set(converted)
+		return nil
+	}
 	switch fieldKind := field.Kind(); fieldKind {
 	case reflect.Array, reflect.Slice:
 		inputArray, ok := input.([]interface{})
-		field.Set(reflect.MakeSlice(field.Type(), len(inputArray), len(inputArray)))
 		if !ok {
-			return fmt.Errorf("Cannot assign to array from %s", reflect.TypeOf(input).Kind())
+			return fmt.Errorf("Cannot assign to array from %T", input)
 		}
+		field.Set(reflect.MakeSlice(field.Type(), len(inputArray), len(inputArray)))
 		for idx, v := range inputArray {
-			err := SetFieldTo(field.Index(idx), v)
+			err := DecodeTo(field.Index(idx), v, strict)
 			if err != nil {
 				return err
 			}
 		}
 		return nil
 	case reflect.Map:
-		inputMap := input.(map[string]interface{})
+		inputMap, ok := input.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("Cannot assign to map from %T", input)
+		}
 		field.Set(reflect.MakeMap(field.Type()))
 		for k, v := range inputMap {
-			entry := reflect.New(field.Type().Elem())
-			err := SetFieldTo(entry, v)
+			entry := reflect.New(field.Type().Elem()).Elem()
+			err := DecodeTo(entry, v, strict)
 			if err != nil {
 				return err
 			}
 			field.SetMapIndex(reflect.ValueOf(k), entry)
 		}
 	case reflect.Ptr:
+		if _, isNone := input.(None); input == nil || isNone {
+			field.Set(reflect.Zero(fieldType))
+			return nil
+		}
+		if field.IsNil() {
+			field.Set(reflect.New(fieldType.Elem()))
+		}
 		deref := field.Elem()
-		return SetFieldTo(deref, input)
-	case reflect.Bool:
-		field.SetBool(reflect.ValueOf(input).Convert(fieldType).Bool())
-	case reflect.Float32, reflect.Float64:
-		field.SetFloat(reflect.ValueOf(input).Convert(fieldType).Float())
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		field.SetInt(reflect.ValueOf(input).Convert(fieldType).Int())
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		field.SetUint(reflect.ValueOf(input).Convert(fieldType).Uint())
-	case reflect.String:
-		field.SetString(reflect.ValueOf(input).Convert(fieldType).String())
+		return DecodeTo(deref, input, strict)
+	case reflect.Bool, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.String:
+		valInput := reflect.ValueOf(input)
+		// Only convert between values of the same family of kinds; e.g. Go
+		// would happily convert an integer to a string containing that rune.
+		if !valInput.IsValid() || kindFamily(valInput.Kind()) != kindFamily(fieldKind) {
+			return fmt.Errorf("cannot assign %T to %s", input, fieldType)
+		}
+		field.Set(valInput.Convert(fieldType))
 	default:
 		valInput := reflect.ValueOf(input)
+		if !valInput.IsValid() {
+			field.Set(reflect.Zero(fieldType))
+			return nil
+		}
+		if valInput.Kind() == reflect.Ptr && !valInput.IsNil() && !valInput.Type().ConvertibleTo(fieldType) {
+			// Instances passed to Polar by pointer may be passed back by value.
+			valInput = valInput.Elem()
+		}
 		valid := field.IsValid()
 		canSet := field.CanSet()
 		inputType := valInput.Type()
@@ -66,3 +118,288 @@ func SetFieldTo(field reflect.Value, input interface{}) error {
 	}
 	return nil
 }
+
+// Decode a Polar dictionary into the struct `v`. Each key is assigned to the
+// field whose `json` struct tag names it or, failing that, to the field
+// FieldForAttribute finds for it, so that keys like `created_at` fill fields
+// like `CreatedAt`.
+func decodeDictionary(v reflect.Value, dict map[string]interface{}, strict bool) error {
+	jsonFields, err := JSONFields(v.Type())
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(dict))
+	for key := range dict {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		field, ok := jsonFields[key]
+		if !ok {
+			field, ok = FieldForAttribute(v.Type(), key)
+		}
+		if !ok {
+			if strict {
+				return fmt.Errorf("%v has no field for key %s", v.Type(), key)
+			}
+			continue
+		}
+		target, ok := FieldValue(v, field)
+		if !ok {
+			return fmt.Errorf("cannot set field %s of %v for key %s", field.Name, v.Type(), key)
+		}
+		if err := DecodeTo(target, dict[key], strict); err != nil {
+			return fmt.Errorf("cannot assign key %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// Get the default Polar class name for `typ`, its Go type name. The names of
+// instantiations of generic types, like `Repository[example.com/app.User]`,
+// are turned into identifiers by dropping the package paths of their type
+// arguments and joining the rest with underscores: `Repository_User`.
+func ClassName(typ reflect.Type) string {
+	name := IndirectType(typ).Name()
+	if !strings.Contains(name, "[") {
+		return name
+	}
+	name = packageQualifier.ReplaceAllString(name, "")
+	name = nonIdentifierChars.ReplaceAllString(name, "_")
+	return strings.TrimRight(name, "_")
+}
+
+var packageQualifier = regexp.MustCompile(`(?:[\w\-.]+/)*[\w\-]+\.`)
+var nonIdentifierChars = regexp.MustCompile(`[^\w]+`)
+
+func kindFamily(kind reflect.Kind) reflect.Kind {
+	switch kind {
+	case reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return reflect.Float64
+	default:
+		return kind
+	}
+}
+
+// Find the exported field of the struct type `typ` that the Polar attribute
+// `name` refers to, including fields promoted from embedded structs following
+// Go's rules for promotion. A field whose `polar` struct tag gives it that name
+// is preferred, then a field with exactly that name; otherwise a field whose
+// name matches ignoring case and underscores is used, so that idiomatic Polar
+// names like `created_at` find Go fields like `CreatedAt`. Fields tagged
+// `polar:"-"`, and fields promoted through them, are hidden, and fields renamed
+// by their tag can't be found by their Go names. Returns false if there is no
+// such field or the name is ambiguous.
+func FieldForAttribute(typ reflect.Type, name string) (reflect.StructField, bool) {
+	if field, ok := taggedField(typ, name); ok {
+		return field, true
+	}
+	field, ok := typ.FieldByName(name)
+	if !ok || field.PkgPath != "" {
+		normalized := normalizeFieldName(name)
+		field, ok = typ.FieldByNameFunc(func(n string) bool {
+			return isExported(n) && normalizeFieldName(n) == normalized
+		})
+	}
+	if !ok || HiddenByTag(typ, field) {
+		return reflect.StructField{}, false
+	}
+	return field, true
+}
+
+// Get the name given in the `polar` struct tag of `field`, if it has one.
+// The name "-" hides the field from Polar.
+func PolarTag(field reflect.StructField) (string, bool) {
+	tag, ok := field.Tag.Lookup("polar")
+	return strings.Split(tag, ",")[0], ok
+}
+
+// Whether `field` of the struct type `typ` can't be looked up by its Go name
+// because it, or an embedded struct it is promoted through, is tagged
+// `polar:"-"`, or because its tag gives it a different name.
+func HiddenByTag(typ reflect.Type, field reflect.StructField) bool {
+	for i, index := range field.Index {
+		f := typ.Field(index)
+		tag, _ := PolarTag(f)
+		if tag == "-" || (i == len(field.Index)-1 && tag != "" && tag != f.Name) {
+			return true
+		}
+		typ = IndirectType(f.Type)
+	}
+	return false
+}
+
+// Find the exported field of the struct type `typ` whose `polar` tag names it
+// `name`, at the shallowest depth at which there is one, as Go promotes
+// fields. Returns false if there is none, or more than one at that depth.
+func taggedField(typ reflect.Type, name string) (reflect.StructField, bool) {
+	type embedded struct {
+		typ   reflect.Type
+		index []int
+	}
+	level := []embedded{{typ, nil}}
+	visited := make(map[reflect.Type]bool)
+	for len(level) > 0 {
+		var found []reflect.StructField
+		var next []embedded
+		for _, e := range level {
+			if visited[e.typ] {
+				continue
+			}
+			visited[e.typ] = true
+			for i := 0; i < e.typ.NumField(); i++ {
+				field := e.typ.Field(i)
+				field.Index = append(append([]int{}, e.index...), i)
+				tag, ok := PolarTag(field)
+				if ok && tag == name && tag != "-" && isExported(field.Name) {
+					found = append(found, field)
+				}
+				if tag == "-" {
+					continue
+				}
+				if embeddedType := IndirectType(field.Type); field.Anonymous && embeddedType.Kind() == reflect.Struct {
+					next = append(next, embedded{embeddedType, field.Index})
+				}
+			}
+		}
+		switch len(found) {
+		case 0:
+			level = next
+		case 1:
+			return found[0], true
+		default:
+			return reflect.StructField{}, false
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func normalizeFieldName(name string) string {
+	return strings.ToLower(strings.Replace(name, "_", "", -1))
+}
+
+func isExported(name string) bool {
+	r, _ := utf8.DecodeRuneInString(name)
+	return unicode.IsUpper(r)
+}
+
+// Get the value of `field` in the struct `v`, following any embedded pointers
+// it is promoted through. Returns false if one of them is nil.
+func FieldValue(v reflect.Value, field reflect.StructField) (reflect.Value, bool) {
+	for i, index := range field.Index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(index)
+	}
+	return v, v.CanInterface()
+}
+
+// Look up the field of the struct `v` that the Polar attribute `name` refers
+// to, as found by FieldForAttribute.
+func FieldByName(v reflect.Value, name string) (reflect.Value, bool) {
+	field, ok := FieldForAttribute(v.Type(), name)
+	if !ok {
+		return reflect.Value{}, false
+	}
+	return FieldValue(v, field)
+}
+
+// Map the names given in the `json` struct tags of the exported fields of the
+// struct type `typ` to those fields, including fields promoted from embedded
+// structs without a tag. As with encoding/json, a shallower field hides deeper
+// fields with the same name, and fields tagged "-" or without a name in their
+// tag are skipped. Two fields at the same depth with the same name are an
+// error.
+func JSONFields(typ reflect.Type) (map[string]reflect.StructField, error) {
+	structType := IndirectType(typ)
+	if structType.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("Cannot use json tags for %v; it is not a struct", typ)
+	}
+
+	candidates := make(map[string][]reflect.StructField)
+	visited := make(map[reflect.Type]bool)
+	var walk func(t reflect.Type, index []int)
+	walk = func(t reflect.Type, index []int) {
+		if visited[t] {
+			return
+		}
+		visited[t] = true
+		defer delete(visited, t)
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			field.Index = append(append([]int{}, index...), i)
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name == "-" {
+				continue
+			}
+			if field.Anonymous && name == "" {
+				if embedded := IndirectType(field.Type); embedded.Kind() == reflect.Struct {
+					walk(embedded, field.Index)
+				}
+				continue
+			}
+			if name != "" && isExported(field.Name) {
+				candidates[name] = append(candidates[name], field)
+			}
+		}
+	}
+	walk(structType, nil)
+
+	fields := make(map[string]reflect.StructField, len(candidates))
+	for name, found := range candidates {
+		var shallowest []reflect.StructField
+		for _, field := range found {
+			if len(shallowest) == 0 || len(field.Index) < len(shallowest[0].Index) {
+				shallowest = []reflect.StructField{field}
+			} else if len(field.Index) == len(shallowest[0].Index) {
+				shallowest = append(shallowest, field)
+			}
+		}
+		if len(shallowest) > 1 {
+			return nil, fmt.Errorf("%v has conflicting json tags: fields %s and %s are both named '%s'",
+				typ, shallowest[0].Name, shallowest[1].Name, name)
+		}
+		fields[name] = shallowest[0]
+	}
+	return fields, nil
+}
+
+var bigIntType = reflect.TypeOf((*big.Int)(nil))
+var bigFloatType = reflect.TypeOf((*big.Float)(nil))
+
+// Convert a number from Polar to a *big.Int or *big.Float, if that's what
+// `typ` is. Returns false if `typ` is neither or `input` isn't a number, and an
+// invalid value if the number can't be converted, e.g. a non-integral float to
+// a *big.Int.
+func toBig(typ reflect.Type, input interface{}) (reflect.Value, bool) {
+	switch typ {
+	case bigIntType:
+		switch n := input.(type) {
+		case int64:
+			return reflect.ValueOf(big.NewInt(n)), true
+		case float64:
+			if math.IsInf(n, 0) || math.IsNaN(n) || n != math.Trunc(n) {
+				return reflect.Value{}, true
+			}
+			i, _ := big.NewFloat(n).Int(nil)
+			return reflect.ValueOf(i), true
+		}
+	case bigFloatType:
+		switch n := input.(type) {
+		case int64:
+			return reflect.ValueOf(new(big.Float).SetInt64(n)), true
+		case float64:
+			if math.IsNaN(n) {
+				return reflect.Value{}, true
+			}
+			return reflect.ValueOf(big.NewFloat(n)), true
+		}
+	}
+	return reflect.Value{}, false
+}
@@ -0,0 +1,114 @@
+package oso
+
+import (
+	"fmt"
+	"sort"
+)
+
+// The kind of a LintWarning.
+type LintKind string
+
+const (
+	// Rules specialize on or match against a class that isn't registered, so
+	// they can never match.
+	LintUnregisteredClass LintKind = "unregistered_class"
+	// A registered class that the policy never refers to.
+	LintUnusedClass LintKind = "unused_class"
+	// Rules look up a field that isn't one of the fields their class was
+	// registered with, so the lookup fails with an UnregisteredFieldError.
+	LintUnregisteredField LintKind = "unregistered_field"
+	// A field registered with RegisterClassWithFields is declared with the
+	// name of a class that isn't registered.
+	LintUnregisteredFieldType LintKind = "unregistered_field_type"
+)
+
+/*
+A likely mistake in the loaded policy, found by Oso.Lint.
+*/
+type LintWarning struct {
+	Kind LintKind
+	// The name of the class the warning is about.
+	Class string
+	// For LintUnregisteredField and LintUnregisteredFieldType warnings, the
+	// name of the field.
+	Field string
+	// A description of the problem.
+	Message string
+}
+
+func (w LintWarning) String() string {
+	return w.Message
+}
+
+func (p *Polar) lint() ([]LintWarning, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	unregistered, err := p.ffiPolar.UnregisteredClasses()
+	if err != nil {
+		return nil, err
+	}
+	referenced, err := p.ffiPolar.ReferencedClasses()
+	if err != nil {
+		return nil, err
+	}
+	fields, err := p.ffiPolar.ReferencedFields()
+	if err != nil {
+		return nil, err
+	}
+
+	warnings := make([]LintWarning, 0)
+	for _, class := range unregistered {
+		warnings = append(warnings, LintWarning{
+			Kind:    LintUnregisteredClass,
+			Class:   class,
+			Message: fmt.Sprintf("Rules referring to %s can never match; no class is registered with that name", class),
+		})
+	}
+	used := make(map[string]bool, len(referenced))
+	for _, class := range referenced {
+		used[class] = true
+	}
+	for _, class := range sortedNames(p.host.Classes()) {
+		if _, builtin := builtinClasses[class]; builtin || used[class] {
+			continue
+		}
+		warnings = append(warnings, LintWarning{
+			Kind:    LintUnusedClass,
+			Class:   class,
+			Message: fmt.Sprintf("%s is registered but the policy never refers to it", class),
+		})
+	}
+	for _, ref := range fields {
+		if err := p.host.CheckClassField(ref.Class, ref.Field); err != nil {
+			warnings = append(warnings, LintWarning{
+				Kind:    LintUnregisteredField,
+				Class:   ref.Class,
+				Field:   ref.Field,
+				Message: fmt.Sprintf("Rules look up %s on %s, which isn't one of the fields %s was registered with", ref.Field, ref.Class, ref.Class),
+			})
+		}
+	}
+	unregisteredTypes := p.host.UnregisteredFieldTypes()
+	classes := make([]string, 0, len(unregisteredTypes))
+	for class := range unregisteredTypes {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		declared := unregisteredTypes[class]
+		names := make([]string, 0, len(declared))
+		for field := range declared {
+			names = append(names, field)
+		}
+		sort.Strings(names)
+		for _, field := range names {
+			warnings = append(warnings, LintWarning{
+				Kind:    LintUnregisteredFieldType,
+				Class:   class,
+				Field:   field,
+				Message: fmt.Sprintf("%s.%s is declared as a %s, but no class is registered with that name", class, field, declared[field]),
+			})
+		}
+	}
+	return warnings, nil
+}
@@ -0,0 +1,73 @@
+package oso
+
+import "io"
+
+/*
+An Option configures an Oso instance created with NewOso. Each option has the
+same effect as calling the corresponding setter on the instance:
+
+	o, err := oso.NewOso(
+		oso.WithResultCache(1000),
+		oso.WithDataFilteringAdapter(oso.NewMemoryAdapter(posts)),
+	)
+*/
+type Option func(o *Oso)
+
+// Override the "read" action, as with Oso.SetReadAction.
+func WithReadAction(readAction interface{}) Option {
+	return func(o *Oso) { o.SetReadAction(readAction) }
+}
+
+// Override the default ForbiddenError, as with Oso.SetForbiddenError.
+func WithForbiddenError(forbiddenError func() error) Option {
+	return func(o *Oso) { o.SetForbiddenError(forbiddenError) }
+}
+
+// Override the default NotFoundError, as with Oso.SetNotFoundError.
+func WithNotFoundError(notFoundError func() error) Option {
+	return func(o *Oso) { o.SetNotFoundError(notFoundError) }
+}
+
+// Cache the results of IsAllowed, as with Oso.EnableResultCache.
+func WithResultCache(size int) Option {
+	return func(o *Oso) { o.EnableResultCache(size) }
+}
+
+// Receive TraceEvents from queries, as with Oso.SetLogger.
+func WithLogger(logger func(event TraceEvent)) Option {
+	return func(o *Oso) { o.SetLogger(logger) }
+}
+
+// Fail to load policies that refer to unregistered classes, as with
+// Oso.SetStrictClassChecks.
+func WithStrictClassChecks() Option {
+	return func(o *Oso) { o.SetStrictClassChecks(true) }
+}
+
+// Look up fields that don't exist as nil, as with
+// Oso.TreatUnknownAttributesAsNil.
+func WithUnknownAttributesAsNil() Option {
+	return func(o *Oso) { o.TreatUnknownAttributesAsNil(true) }
+}
+
+// Pass []byte values to Polar as lists of integers, as with
+// Oso.SetBytesAsList.
+func WithBytesAsList() Option {
+	return func(o *Oso) { o.SetBytesAsList(true) }
+}
+
+// Trace policy evaluation, as with Oso.SetTraceEnabled.
+func WithTraceEnabled(enabled bool) Option {
+	return func(o *Oso) { o.SetTraceEnabled(enabled) }
+}
+
+// Write traces to `writer`, as with Oso.SetTraceWriter.
+func WithTraceWriter(writer io.Writer) Option {
+	return func(o *Oso) { o.SetTraceWriter(writer) }
+}
+
+// Set the Adapter used for data filtering, as with
+// Oso.SetDataFilteringAdapter.
+func WithDataFilteringAdapter(adapter Adapter) Option {
+	return func(o *Oso) { o.SetDataFilteringAdapter(adapter) }
+}
@@ -1,45 +1,94 @@
 package oso
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"reflect"
 
 	osoErrors "github.com/osohq/go-oso/errors"
 	"github.com/osohq/go-oso/types"
+	"github.com/peterh/liner"
 )
 
 /*
 The central object to manage policy state and verify requests.
+
+An Oso instance may be shared between goroutines: queries (including
+IsAllowed, Authorize and friends) may run concurrently with each other and with
+loading policies or registering classes. Classes and constants may also be
+registered from several goroutines at once, e.g. by packages that each
+register their own types during startup.
+
+Loading, reloading, unloading or clearing the policy swaps in a new Polar
+instance rather than changing the rules in place, so a query keeps evaluating
+the rules that were loaded when it was created. Classes and constants should
+be registered before creating the queries that use them. Individual Query
+values are not safe for concurrent use, and settings such as SetReadAction
+should be configured before the instance is shared.
 */
 type Oso struct {
 	p              *Polar
 	readAction     interface{}
 	forbiddenError func() error
 	notFoundError  func() error
+	adapter        Adapter
 }
 
 /*
-Construct a new Oso instance.
+Construct a new Oso instance, configured by any Options given.
 
 	import oso "github.com/osohq/go-oso"
 	if o, err := oso.NewOso(); err != nil {
 		t.Fatalf("Failed to set up Oso: %v", err)
 	}
 */
-func NewOso() (Oso, error) {
+func NewOso(opts ...Option) (Oso, error) {
 	if p, e := newPolar(); e != nil {
 		return Oso{}, e
 	} else {
-		return Oso{
+		o := Oso{
 			p:              p,
 			readAction:     "read",
 			forbiddenError: func() error { return &osoErrors.ForbiddenError{} },
 			notFoundError:  func() error { return &osoErrors.NotFoundError{} },
-		}, nil
+		}
+		for _, opt := range opts {
+			opt(&o)
+		}
+		return o, nil
 	}
 }
 
+/*
+Free the resources held by the Polar VM, along with any queries that are still
+outstanding. An Oso instance is freed automatically once it is garbage
+collected, but Close frees it deterministically, e.g. in tests that create many
+instances.
+
+Using an Oso instance, or a query created from it, after calling Close returns
+an errors.ClosedError. Calling Close more than once does nothing.
+
+	o, _ := oso.NewOso()
+	defer o.Close()
+*/
+func (o Oso) Close() error {
+	(*o.p).close()
+	return nil
+}
+
+/*
+Get the version of the Polar core library that Oso is built with, e.g. to
+include in bug reports.
+*/
+func (o Oso) PolarVersion() string {
+	return (*o.p).version()
+}
+
 /*
 Override the "read" action, which is used to differentiate between a
 NotFoundError and a ForbiddenError on authorization failures.
@@ -74,11 +123,27 @@ func (o *Oso) SetNotFoundError(notFoundError func() error) {
 
 /*
 Load Polar policy from ".polar" files, checking that all inline queries succeed.
+
+All files are validated and read before any of them are loaded, so an invalid
+filename or unreadable file leaves the knowledge base untouched.
 */
 func (o Oso) LoadFiles(files []string) error {
 	return (*o.p).loadFiles(files)
 }
 
+/*
+Load Polar policy from the ".polar" files matching a glob pattern, as accepted
+by filepath.Glob. Matching files are loaded together in sorted order, like with
+LoadFiles:
+
+	err := o.LoadGlob("policies/*.polar")
+
+Returns a NoMatchingPolarFilesError if no files match the pattern.
+*/
+func (o Oso) LoadGlob(pattern string) error {
+	return (*o.p).loadGlob(pattern)
+}
+
 /*
 Load Polar policy from a ".polar" file, checking that all inline queries succeed.
 
@@ -100,6 +165,185 @@ func (o Oso) LoadString(s string) error {
 	return (*o.p).loadString(s)
 }
 
+/*
+Load several strings together as one policy, e.g. fragments assembled from
+database rows. Inline queries are checked once all of them are loaded. If any
+fragment fails to parse, or an inline query fails, none of them are loaded and
+the policy that was loaded before is kept.
+
+	err := o.LoadStrings([]string{baseRules, tenantRules})
+*/
+func (o Oso) LoadStrings(sources []string) error {
+	return (*o.p).loadStrings(sources)
+}
+
+/*
+Load Polar policy from a string, like LoadString, using `name` to identify the
+source in error messages just as a filename would be for a policy loaded with
+LoadFiles. This gives generated or templated policies a logical name, e.g. the
+template they came from:
+
+	err := o.LoadStringNamed(rendered, "templates/tenant.polar")
+
+Names aren't checked for duplicates the way filenames are.
+*/
+func (o Oso) LoadStringNamed(s string, name string) error {
+	return (*o.p).loadStringNamed(s, name)
+}
+
+/*
+Load Polar policy from an io.Reader, checking that all inline queries succeed.
+The reader is consumed in full before anything is loaded. If `filename` is
+non-empty it is used to identify the source in error messages, just as it would
+be for a policy loaded with LoadFiles.
+*/
+func (o Oso) LoadReader(r io.Reader, filename string) error {
+	return (*o.p).loadReader(r, filename)
+}
+
+/*
+Load Polar policy from a string, returning every error and warning found in it
+rather than failing at the first error, e.g. to show them all in an editor. The
+Polar parser stops at the first syntax error in the source, so at most one
+parse error is reported. If `filename` is non-empty it identifies the source
+in messages.
+
+The policy is loaded only if none of the diagnostics are errors; inline
+queries are then checked, and an error is returned if one fails.
+
+	diagnostics, err := o.LoadWithDiagnostics(src, "policy.polar")
+	for _, d := range diagnostics {
+		fmt.Printf("%s:%d:%d: %s\n", d.Filename, d.Line, d.Column, d.Message)
+	}
+*/
+func (o Oso) LoadWithDiagnostics(src string, filename string) ([]Diagnostic, error) {
+	return (*o.p).loadWithDiagnostics(src, filename)
+}
+
+/*
+Reload every policy file loaded with LoadFiles since the last call to
+ClearRules, picking up any changes made to them on disk. The files are loaded
+in their original order and all inline queries are checked again. Does nothing
+if no files have been loaded.
+
+The files are loaded into a separate Polar instance, which replaces the current
+one only once they have loaded and their inline queries have passed. If any
+file can no longer be read or loaded, the previously loaded policy is left in
+place and the error is returned. Queries that are already running finish
+against the policy they were created with.
+*/
+func (o Oso) Reload() error {
+	return (*o.p).reload()
+}
+
+/*
+Remove the rules loaded from one policy file with LoadFiles, keeping the rest
+of the loaded policy, e.g. to unload a plugin's policy:
+
+	err := o.UnloadFile("plugins/billing.polar")
+
+The remaining files are loaded again and their inline queries checked. If they
+fail to load on their own, e.g. because an inline query depends on a rule from
+the unloaded file, the policy is left as it was and an error is returned.
+Returns an error if the file has not been loaded.
+*/
+func (o Oso) UnloadFile(filename string) error {
+	return (*o.p).unloadFile(filename)
+}
+
+/*
+Return the names of the rules defined by the loaded policy, in sorted order.
+*/
+func (o Oso) RuleNames() ([]string, error) {
+	return (*o.p).ffiPolar.RuleNames()
+}
+
+/*
+Return the names of the classes that the loaded policy specializes on or
+matches against but that haven't been registered, in sorted order. A policy
+referring to an unregistered class loads, but queries reaching the reference
+fail, so checking for them, e.g. in a test, catches typos and forgotten calls
+to RegisterClass early:
+
+	if classes, err := o.UnregisteredClasses(); err != nil || len(classes) > 0 {
+		t.Errorf("Unregistered classes: %v", classes)
+	}
+*/
+func (o Oso) UnregisteredClasses() ([]string, error) {
+	return (*o.p).ffiPolar.UnregisteredClasses()
+}
+
+/*
+Check the loaded policy for likely mistakes, e.g. before deploying it or in CI:
+
+	if warnings, err := o.Lint(); err != nil || len(warnings) > 0 {
+		t.Errorf("Policy warnings: %v", warnings)
+	}
+
+Warns about rules that can never match because they refer to classes that
+haven't been registered (see UnregisteredClasses), about registered classes
+that the policy never refers to, about rules looking up fields that aren't
+among those their class was registered with by RegisterClassWithFields, and
+about fields registered with the name of a class that isn't registered.
+Mistakes that prevent a policy from loading, such as resource blocks referring
+to undefined permissions or calls to undefined rules, are reported by
+LoadWithDiagnostics instead.
+*/
+func (o Oso) Lint() ([]LintWarning, error) {
+	return (*o.p).lint()
+}
+
+/*
+Make loading a policy fail with an errors.UnregisteredClassError listing the
+classes it refers to that haven't been registered (see UnregisteredClasses),
+leaving the previously loaded policy in place. Classes must then be registered
+before the policies using them are loaded.
+Strict checks are disabled by default.
+*/
+func (o *Oso) SetStrictClassChecks(strict bool) {
+	(*o.p).setStrictClasses(strict)
+}
+
+/*
+Make policies that look up a field a Go value doesn't have, e.g.
+`resource.nonexistent_field`, get nil instead of failing the query, so that
+policies can be written against data whose schema varies:
+
+	o.TreatUnknownAttributesAsNil(true)
+	// allow(_, "read", doc) if doc.Archived = nil or doc.Archived = false;
+
+Only field lookups are affected: calling a method that doesn't exist, or
+looking up a field not declared with RegisterClassWithFields, still fails.
+Unknown attributes are errors by default.
+*/
+func (o *Oso) TreatUnknownAttributesAsNil(asNil bool) {
+	(*o.p).setUnknownAttributesAsNil(asNil)
+}
+
+/*
+Pass []byte values to Polar as lists of integers, one per byte, instead of as
+strings. By default a []byte is passed as a string of its bytes, so that
+`body = "ok"` matches a []byte("ok"); use lists for binary data, as bytes that
+aren't valid UTF-8 are not preserved in strings. Either way, Polar strings and
+lists of integers can be passed back to []byte parameters and fields.
+*/
+func (o *Oso) SetBytesAsList(asList bool) {
+	(*o.p).setBytesAsList(asList)
+}
+
+/*
+Check that the loaded policy defines each of the given rules, e.g.
+
+	err := o.Validate("allow", "has_role")
+
+Returns a MissingRulesError naming the rules that are not defined, which helps
+catch misspelled rule names that would otherwise make queries silently return
+no results.
+*/
+func (o Oso) Validate(rules ...string) error {
+	return (*o.p).validate(rules)
+}
+
 /*
 Clear all rules from the Oso knowledge base (i.e., remove all loaded policies).
 */
@@ -111,9 +355,30 @@ func (o Oso) ClearRules() error {
 Register a Go type so that it can be referenced within Polar files. Accepts a
 concrete value of the Go type and a constructor function or nil if no
 constructor is required.
+
+An interface type may be registered by passing its reflect.Type:
+
+	o.RegisterClass(reflect.TypeOf((*Animal)(nil)).Elem(), nil)
+
+Any value whose type implements the interface (with either value or pointer
+receivers) then matches it in the policy, e.g. `x matches Animal`.
+
+The constructor may return either the new value, or the new value and an
+error. If it returns a non-nil error, the query calling `new` fails with that
+error.
+
+The class is named after the Go type. Instantiations of generic types are
+named after the type and its type arguments, joined by underscores, so
+`Repository[User]` is registered as `Repository_User`; use
+RegisterClassWithName to choose a different name.
+
+Registering the same type again with the same constructor and options is a
+no-op, but registering it with different ones returns a
+ConflictingClassRegistrationError. Registering a different type under a name
+that is already in use returns a DuplicateClassAliasError.
 */
 func (o Oso) RegisterClass(cls interface{}, ctor interface{}) error {
-	return (*o.p).registerClass(cls, ctor, nil)
+	return (*o.p).registerClass(cls, ctor, ClassOptions{})
 }
 
 /*
@@ -122,16 +387,242 @@ within Polar files by that name. Accepts a concrete value of the Go type and a
 constructor function or nil if no constructor is required.
 */
 func (o Oso) RegisterClassWithName(cls interface{}, ctor interface{}, name string) error {
-	return (*o.p).registerClass(cls, ctor, &name)
+	return (*o.p).registerClass(cls, ctor, ClassOptions{Name: name})
+}
+
+/*
+Register a Go type under several names, so that a policy can refer to it by
+any of them. Instances of the type match every name:
+
+	o.RegisterClassAliases(reflect.TypeOf(models.User{}), "User", "Account")
+	// allow(actor: Account, ...) matches a models.User
+
+Fails with a DuplicateClassAliasError, without registering any of the names,
+if one of them is already in use by a different type.
+*/
+func (o Oso) RegisterClassAliases(cls interface{}, names ...string) error {
+	return (*o.p).registerClassAliases(cls, names)
+}
+
+/*
+Register a Go struct type along with the fields that Polar may look up on its
+instances. `fields` maps each field name to its declared Polar type, given
+either as a reflect.Type or as the name of a registered class:
+
+	o.RegisterClassWithFields(reflect.TypeOf(Repo{}), nil, map[string]interface{}{
+		"Name":  "String",
+		"Owner": reflect.TypeOf(User{}),
+	})
+
+Every declared field must be an exported field of the struct, and a type given
+as a reflect.Type must be one the field's values can be used as. Types given by
+name are checked by Lint, which warns about names that no class is registered
+with. Looking up any other field from a policy fails with an
+UnregisteredFieldError. Lint reports such lookups ahead of time when they are
+made directly on a rule parameter specialized on the class, e.g. `x.Secret` in
+`f(x: Repo) if x.Secret = 1;`.
+*/
+func (o Oso) RegisterClassWithFields(cls interface{}, ctor interface{}, fields map[string]interface{}) error {
+	return (*o.p).registerClass(cls, ctor, ClassOptions{Fields: fields})
+}
+
+/*
+Register a Go type along with a function that Polar uses to compare its
+instances for equality, e.g. when unifying them or comparing them with `==`:
+
+	o.RegisterClassWithEquals(reflect.TypeOf(Money{}), nil, func(a, b interface{}) bool {
+		return a.(Money).Amount == b.(Money).Amount && a.(Money).Currency == b.(Money).Currency
+	})
+
+`equals` is only called when both operands are instances of the type, and is
+passed them by value even if they were passed to Polar by pointer. Instances of
+types registered without one are compared with reflect.DeepEqual, unless they
+implement interfaces.Comparer.
+*/
+func (o Oso) RegisterClassWithEquals(cls interface{}, ctor interface{}, equals func(a, b interface{}) bool) error {
+	return (*o.p).registerClass(cls, ctor, ClassOptions{Equals: equals})
+}
+
+/*
+Options for registering a class with Oso.RegisterClassWithOptions.
+*/
+type ClassOptions struct {
+	// The name to register the class under. Defaults to the name of the Go
+	// type, as for RegisterClass.
+	Name string
+	// The fields Polar may look up on instances of the class, as for
+	// RegisterClassWithFields. Nil allows any field to be looked up.
+	Fields map[string]interface{}
+	// The methods Polar may call on instances of the class, e.g.
+	// []string{"IsOwner"}. Calling any other method from a policy fails with
+	// an UnregisteredMethodError. For an interface, this applies to every
+	// type that implements it. Nil allows any exported method to be called.
+	Methods []string
+	// Compares instances of the class for equality, as for
+	// RegisterClassWithEquals. Nil uses the default comparison.
+	Equals func(a, b interface{}) bool
+	// Look up attributes by the names given in the `json` struct tags of the
+	// class's fields, so that `resource.owner_id` finds a field tagged
+	// `json:"owner_id"`. Fields can still be looked up by their Go names.
+	// Registering a struct with two fields tagged with the same name at the
+	// same depth returns an error.
+	JSONTags bool
+	// Pass errors of the class returned by methods to the policy as the
+	// method's result, instead of failing the query, so that the policy can
+	// match them: `x = resource.Fetch() and x matches NotFoundError`. The
+	// class must implement error, by value or by pointer.
+	ErrorValue bool
+	// How the arguments of `new` are passed to the class's constructor.
+	// Defaults to ConstructorPositional.
+	ConstructorStyle ConstructorStyle
+}
+
+// How the arguments of a Polar `new` call are passed to a class's constructor.
+type ConstructorStyle int
+
+const (
+	// Positional arguments are passed to the constructor's parameters in
+	// order, each converted to the parameter's type; `new Repo("oso", 1)`
+	// calls `NewRepo(name string, id int)`. Keyword arguments are an error.
+	ConstructorPositional ConstructorStyle = iota
+	// The constructor takes a single struct, or pointer to one, which is
+	// filled from keyword arguments by `json` tag or field name:
+	// `new Repo(name: "oso", id: 1)` calls `NewRepo(RepoOptions{Name: "oso",
+	// ID: 1})`. A single dictionary argument is decoded the same way.
+	ConstructorStruct
+)
+
+/*
+Register a Go type configured by ClassOptions. Accepts a concrete value of the
+Go type and a constructor function or nil if no constructor is required:
+
+	o.RegisterClassWithOptions(reflect.TypeOf(Repo{}), nil, oso.ClassOptions{
+		Name:     "Repository",
+		JSONTags: true,
+	})
+*/
+func (o Oso) RegisterClassWithOptions(cls interface{}, ctor interface{}, opts ClassOptions) error {
+	return (*o.p).registerClass(cls, ctor, opts)
 }
 
 /*
 Register a Go value as a Polar constant variable called `name`.
+
+Slices and arrays are registered as Polar lists, and maps with string keys as
+Polar dictionaries, so they can be used like literals in a policy:
+
+	o.RegisterConstant([]string{"us-east", "eu-west"}, "AllowedRegions")
+	// allow(_, "deploy", app) if app.Region in AllowedRegions;
+
+Maps with other keys, such as map[int]User, are registered as instances.
+Iterating over one with `in` yields a [key, value] list for each entry, in
+key order if the keys are numbers:
+
+	o.RegisterConstant(map[int]User{1: alice, 2: bob}, "UsersByID")
+	// user_id(user, id) if [id, user] in UsersByID;
+
+Any other value, such as a struct or a pointer to one, is registered as an
+instance, which matches its class like any other instance passed to Polar. A
+pointer is returned to Go as the same pointer:
+
+	o.RegisterConstant(&systemUser, "System")
+	// allow(actor, _, _) if actor = System and System matches User;
 */
 func (o Oso) RegisterConstant(value interface{}, name string) error {
 	return (*o.p).registerConstant(value, name)
 }
 
+/*
+Register each value in `constants` as a Polar constant named by its key, as
+RegisterConstant does:
+
+	o.RegisterConstants(map[string]interface{}{
+		"Read":  Permission("read"),
+		"Write": Permission("write"),
+	})
+
+Every value is converted before any is registered, so if one can't be, none
+are. The error is an errors.ConstantRegistrationError naming the constant.
+*/
+func (o Oso) RegisterConstants(constants map[string]interface{}) error {
+	return (*o.p).registerConstants(constants)
+}
+
+/*
+Register a Go function as a Polar constant called `name`, so that policies can
+call it with `name.Call(...)`:
+
+	o.RegisterFunction("IsBusinessHours", IsBusinessHours)
+	// allow(_, "edit", post) if IsBusinessHours.Call(post.CreatedAt);
+
+Arguments and results are converted the same way as for methods called from a
+policy, including a trailing `error` result. Note that a bare
+`IsBusinessHours(...)` in a policy queries a rule of that name instead.
+*/
+func (o Oso) RegisterFunction(name string, fn interface{}) error {
+	if fn == nil || reflect.TypeOf(fn).Kind() != reflect.Func {
+		return fmt.Errorf("Cannot register %T as a function; it is not a func", fn)
+	}
+	return (*o.p).registerConstant(fn, name)
+}
+
+/*
+Get the names of the classes registered with this Oso instance, in sorted
+order, including the built-in classes such as "String" and "List". Useful for
+diagnosing policies that use a class under a name it wasn't registered with.
+*/
+func (o Oso) RegisteredClasses() []string {
+	return (*o.p).registeredClasses()
+}
+
+/*
+Get the names of the constants (and functions) registered with this Oso
+instance, in sorted order, including the built-in "nil" constant.
+*/
+func (o Oso) RegisteredConstants() []string {
+	return (*o.p).registeredConstants()
+}
+
+/*
+Convert a Go value to a Polar term, the same way query arguments are
+converted. The term can be passed as an argument to any later query, so an
+expensive argument can be converted once and reused:
+
+	term, err := o.ToPolarValue(bigResource)
+	allowed, err := o.IsAllowed(user, "read", term)
+
+Instances in the value are kept, like those in constants, until the term is
+passed to ReleasePolarValue.
+*/
+func (o Oso) ToPolarValue(v interface{}) (types.Term, error) {
+	value, err := (*o.p).toPolarValue(v)
+	if err != nil {
+		return types.Term{}, err
+	}
+	return types.Term{Value: *value}, nil
+}
+
+/*
+Release the instances kept for a term returned by ToPolarValue, so that they can
+be garbage collected. The term must not be used again afterwards, including by
+queries that are still running.
+*/
+func (o Oso) ReleasePolarValue(t types.Term) {
+	(*o.p).releasePolarValue(t)
+}
+
+/*
+Convert a Polar term to Go and store it in the value `dest` points to, the same
+way arguments are converted for methods called from a policy. Instances in the
+term must have been converted with ToPolarValue or registered as constants.
+
+	var tags []string
+	err := o.FromPolarValue(term, &tags)
+*/
+func (o Oso) FromPolarValue(t types.Term, dest interface{}) error {
+	return (*o.p).fromPolarValue(t, dest)
+}
+
 /*
 Query the policy using a query string; the query is run in a new Go routine.
 Accepts the string to query for.
@@ -174,6 +665,31 @@ func (o Oso) QueryRule(name string, args ...interface{}) (<-chan map[string]inte
 	}
 }
 
+/*
+Query the policy for a rule with a context, like QueryRule. Methods called by
+the policy whose first parameter is a context.Context are passed `ctx`, so
+that request-scoped values, deadlines and tracing reach them, and the policy
+supplies the remaining arguments:
+
+	func (r Repo) HasMember(ctx context.Context, user User) (bool, error)
+	// allow(user, "read", repo) if repo.HasMember(user);
+
+The query stops once `ctx` is canceled or its deadline passes, and ctx.Err()
+is written to the error channel.
+*/
+func (o Oso) QueryRuleContext(ctx context.Context, name string, args ...interface{}) (<-chan map[string]interface{}, <-chan error) {
+	query, err := o.NewQueryFromRuleContext(ctx, name, args...)
+	if err != nil {
+		errors := make(chan error, 1)
+		go func() {
+			errors <- err
+			close(errors)
+		}()
+		return nil, errors
+	}
+	return query.ResultsChan(ctx)
+}
+
 /*
 Query the policy for a rule, and return true if there are any results. Returns
 false if there are no results.
@@ -195,6 +711,33 @@ func (o Oso) QueryRuleOnce(name string, args ...interface{}) (bool, error) {
 	}
 }
 
+/*
+Query the policy for a rule that binds a single output variable, and return
+the value bound to it by the first result. The variable is passed among the
+rule arguments as a types.ValueVariable named `outVar`:
+
+	level, ok, err := o.QueryRuleValue("role_level", "Level", user, types.ValueVariable("Level"))
+
+Returns false if there are no results, or if the first result doesn't bind
+`outVar`.
+*/
+func (o Oso) QueryRuleValue(name string, outVar string, args ...interface{}) (interface{}, bool, error) {
+	query, err := (*o.p).queryRule(name, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	results, err := query.Next()
+	if err != nil {
+		return nil, false, err
+	} else if results == nil {
+		return nil, false, nil
+	}
+	// Manually clean up query since we are not pulling all results.
+	defer query.Cleanup()
+	value, ok := (*results)[outVar]
+	return value, ok, nil
+}
+
 /*
 Create policy query from a query string.
 Accepts the string to query for.
@@ -215,18 +758,224 @@ func (o Oso) NewQueryFromRule(name string, args ...interface{}) (*Query, error)
 	return (*o.p).queryRule(name, args...)
 }
 
+/*
+Create policy query from a query string, bound to `ctx`.
+Behaves like NewQueryFromStr, except that once `ctx` is canceled or its
+deadline passes, `Next()` stops the Polar VM, even in the middle of evaluating
+rules, cleans up the query and returns `ctx.Err()`. Methods called by the policy whose first parameter is a
+context.Context are passed `ctx`, as for QueryRuleContext.
+*/
+func (o Oso) NewQueryFromStrContext(ctx context.Context, q string) (*Query, error) {
+	query, err := (*o.p).queryStr(q)
+	if err != nil {
+		return nil, err
+	}
+	query.ctx = ctx
+	return query, nil
+}
+
+/*
+Create policy query from a query string, with Polar variables in the query
+bound to the given values before it runs. Values are converted to Polar the
+same way as rule arguments. Naming each argument avoids mistakes when the
+signature of a rule changes:
+
+	query, err := o.QueryWithBindings("can_edit(user, post, team)", map[string]interface{}{
+		"user": user,
+		"post": post,
+		"team": team,
+	})
+*/
+func (o Oso) QueryWithBindings(q string, bindings map[string]interface{}) (*Query, error) {
+	return (*o.p).queryStrWithBindings(q, bindings)
+}
+
+/*
+Create policy query for a rule, bound to `ctx`.
+Behaves like NewQueryFromRule, except that once `ctx` is canceled or its
+deadline passes, `Next()` stops the Polar VM, even in the middle of evaluating
+rules, cleans up the query and returns `ctx.Err()`. Methods called by the policy whose first parameter is a
+context.Context are passed `ctx`, as for QueryRuleContext.
+*/
+func (o Oso) NewQueryFromRuleContext(ctx context.Context, name string, args ...interface{}) (*Query, error) {
+	query, err := (*o.p).queryRule(name, args...)
+	if err != nil {
+		return nil, err
+	}
+	query.ctx = ctx
+	return query, nil
+}
+
+/*
+Create policy query for a rule with the given options.
+Behaves like NewQueryFromRule, except as configured by `opts`. For example, to
+see the constraints a policy places on an argument left unbound:
+
+	query, err := o.QueryRuleWithOptions(oso.QueryOptions{AcceptExpressions: true},
+		"allow", user, "read", types.ValueVariable("post"))
+	result, err := query.Next()
+	// (*result)["post"] is an oso.Expression
+*/
+func (o Oso) QueryRuleWithOptions(opts QueryOptions, name string, args ...interface{}) (*Query, error) {
+	return (*o.p).queryRuleWithOptions(opts, name, args...)
+}
+
+/*
+Create policy query for a rule whose arguments have already been converted to
+Polar, e.g. with ToPolarValue. The arguments are passed to Polar as they are,
+so a hot path can convert its arguments once and query many times:
+
+	resource, err := o.ToPolarValue(bigResource)
+	query, err := o.QueryRuleTerms("allow", actorTerm, actionTerm, resource)
+*/
+func (o Oso) QueryRuleTerms(name string, args ...types.Term) (*Query, error) {
+	return (*o.p).queryRuleTerms(name, args)
+}
+
 /*
 Check if an (actor, action, resource) combination is allowed by the policy.
 Returns the result as a bool, or an error.
+
+Queries the `allow` rule once. If no `allow` rule matches, returns false with a
+nil error; an error is only returned if the arguments cannot be converted to
+Polar or the query itself fails.
+
+	if allowed, err := o.IsAllowed(user, "read", post); err != nil {
+		return err
+	} else if !allowed {
+		return ErrForbidden
+	}
 */
 func (o Oso) IsAllowed(actor interface{}, action interface{}, resource interface{}) (bool, error) {
-	return o.QueryRuleOnce("allow", actor, action, resource)
+	cache := (*o.p).resultCache()
+	if cache == nil {
+		return o.QueryRuleOnce("allow", actor, action, resource)
+	}
+	key := cacheKey(actor, action, resource)
+	allowed, generation, ok := cache.get(key)
+	if ok {
+		return allowed, nil
+	}
+	allowed, err := o.QueryRuleOnce("allow", actor, action, resource)
+	if err != nil {
+		return false, err
+	}
+	cache.put(key, generation, allowed)
+	return allowed, nil
+}
+
+/*
+Return the subset of `resources` on which `actor` is allowed to perform
+`action`, in their original order. The resources are checked with a single
+query rather than one query per resource, which saves the overhead of calling
+IsAllowed in a loop. Unlike IsAllowed, which stops at the first way the policy
+allows a resource, the query finds every way it allows each one, so for
+policies with many allow rules matching the same resources, IsAllowed in a loop
+may be cheaper. The result cache enabled with EnableResultCache is not
+consulted.
+
+	readable, err := o.FilterAllowed(user, "read", posts)
+*/
+func (o Oso) FilterAllowed(actor interface{}, action interface{}, resources []interface{}) ([]interface{}, error) {
+	filtered := make([]interface{}, 0, len(resources))
+	if len(resources) == 0 {
+		return filtered, nil
+	}
+	allowed, err := (*o.p).allowedIndices(actor, action, resources)
+	if err != nil {
+		return nil, err
+	}
+	for i, resource := range resources {
+		if allowed[int64(i)] {
+			filtered = append(filtered, resource)
+		}
+	}
+	return filtered, nil
+}
+
+/*
+Cache the results of IsAllowed (and Authorize) in a least-recently-used cache
+holding up to `size` results, or disable the cache if `size` is not positive.
+The cache is cleared whenever policies are loaded or cleared, classes or
+constants are registered, or options that change how values are converted, such
+as TreatUnknownAttributesAsNil and SetBytesAsList, are set.
+
+Results are keyed on the Go values of the actor, action and resource, including
+the values their pointers point to when IsAllowed is called, so only enable the
+cache if the result of the "allow" rule depends on nothing else: not on methods
+with side effects, the current time, or data that pointers inside the arguments
+point to changing after the result is cached.
+*/
+func (o *Oso) EnableResultCache(size int) {
+	if size <= 0 {
+		(*o.p).setResultCache(nil)
+	} else {
+		(*o.p).setResultCache(newResultCache(size))
+	}
+}
+
+/*
+Set a function to receive TraceEvents describing what happens while queries
+created from now on run, such as Polar calling methods on Go values, which
+helps debug why a rule doesn't match. Pass nil to stop logging, which is the
+default.
+
+	o.SetLogger(func(event oso.TraceEvent) {
+		log.Printf("%s: %s", event.Kind, event.Message)
+	})
+
+Messages from the Polar VM itself, such as each rule it queries, are only
+available when tracing is enabled with SetTraceEnabled or the POLAR_LOG
+environment variable. While a logger is set, they are passed to it as
+TraceMessage events.
+*/
+func (o *Oso) SetLogger(logger func(event TraceEvent)) {
+	(*o.p).setLogger(logger)
+}
+
+/*
+Enable or disable tracing of policy evaluation by the Polar VM for queries
+created from now on, e.g. to trace a single suspicious request without
+restarting the process with POLAR_LOG set:
+
+	o.SetTraceEnabled(true)
+	err := o.Authorize(user, "read", post)
+	o.SetTraceEnabled(false)
+
+While tracing is enabled, the VM's messages are written to the writer set with
+SetTraceWriter (stderr by default) and passed to the logger set with SetLogger.
+Disabling tracing returns to the default, where POLAR_LOG decides whether
+queries are traced.
+*/
+func (o *Oso) SetTraceEnabled(enabled bool) {
+	(*o.p).setTraceEnabled(enabled)
+}
+
+/*
+Set where trace messages are written while tracing is enabled with
+SetTraceEnabled. Passing nil restores the default, stderr.
+*/
+func (o *Oso) SetTraceWriter(writer io.Writer) {
+	(*o.p).setTraceWriter(writer)
+}
+
+/*
+Return the hit and miss counters of the result cache enabled with
+EnableResultCache.
+*/
+func (o Oso) ResultCacheStats() CacheStats {
+	return (*o.p).resultCache().getStats()
 }
 
 /*
 Return a set of actions allowed by the given (actor, resource) combination allowed
 by the policy.
 
+Actions are enumerated through whatever rules `allow` calls, so a policy that
+grants permissions with roles in resource blocks, by allowing actions if
+has_permission(actor, action, resource), returns every permission implied by
+each of the actor's roles.
+
 Deprecated: Use AuthorizedActions instead.
 */
 func (o Oso) GetAllowedActions(actor interface{}, resource interface{}, allowWildcard bool) (map[interface{}]struct{}, error) {
@@ -249,7 +998,7 @@ You can customize the errors returned by this function using the
 functions.
 */
 func (o Oso) Authorize(actor interface{}, action interface{}, resource interface{}) error {
-	isAllowed, err := o.QueryRuleOnce("allow", actor, action, resource)
+	isAllowed, err := o.IsAllowed(actor, action, resource)
 	if err != nil {
 		return err
 	}
@@ -263,7 +1012,7 @@ func (o Oso) Authorize(actor interface{}, action interface{}, resource interface
 	if action == o.readAction {
 		isNotFound = true
 	} else {
-		isReadAllowed, err := o.QueryRuleOnce("allow", actor, o.readAction, resource)
+		isReadAllowed, err := o.IsAllowed(actor, o.readAction, resource)
 		if err != nil {
 			return err
 		}
@@ -327,6 +1076,10 @@ func (o Oso) AuthorizeField(actor interface{}, action interface{}, resource inte
 /*
 Return a set of actions allowed by the given (actor, resource) combination allowed
 by the policy.
+
+If the policy allows any action at all (i.e., the action is left unbound), the
+returned set contains only the wildcard "*" when `allowWildcard` is true; when
+it is false an error is returned instead.
 */
 func (o Oso) AuthorizedActions(actor interface{}, resource interface{}, allowWildcard bool) (map[interface{}]struct{}, error) {
 	results := make(map[interface{}]struct{})
@@ -344,7 +1097,9 @@ func (o Oso) AuthorizedActions(actor interface{}, resource interface{}, allowWil
 			switch val := (action).(type) {
 			case types.ValueVariable:
 				if allowWildcard {
-					results["*"] = struct{}{}
+					// Clean up query since we are not pulling all results.
+					query.Cleanup()
+					return map[interface{}]struct{}{"*": {}}, nil
 				} else {
 					return nil, errors.New(`the result of AuthorizedActions() contained an
 												"unconstrained" action that could represent any
@@ -364,7 +1119,9 @@ func (o Oso) AuthorizedActions(actor interface{}, resource interface{}, allowWil
 Determine the fields of `resource` on which `actor` is allowed to perform
 `action`.
 
-Uses `allow_field` rules in the policy to find all allowed fields.
+Uses `allow_field` rules in the policy to find all allowed fields. Returns an
+empty set if no fields are allowed. Wildcards are handled the same way as in
+AuthorizedActions.
 */
 func (o Oso) AuthorizedFields(actor interface{}, action interface{}, resource interface{}, allowWildcard bool) (map[interface{}]struct{}, error) {
 	results := make(map[interface{}]struct{})
@@ -382,7 +1139,9 @@ func (o Oso) AuthorizedFields(actor interface{}, action interface{}, resource in
 			switch val := (field).(type) {
 			case types.ValueVariable:
 				if allowWildcard {
-					results["*"] = struct{}{}
+					// Clean up query since we are not pulling all results.
+					query.Cleanup()
+					return map[interface{}]struct{}{"*": {}}, nil
 				} else {
 					return nil, errors.New(`the result of AuthorizedFields() contained an
 												"unconstrained" field that could represent any
@@ -398,9 +1157,114 @@ func (o Oso) AuthorizedFields(actor interface{}, action interface{}, resource in
 	return results, nil
 }
 
+/*
+Determine the constraints on resources of type `resourceType` (the name of a
+registered class) under which `actor` is allowed to perform `action`, without
+loading any resources.
+
+Uses `allow` rules in the policy, evaluating them with the resource left
+unknown, and returns the constraints they place on the resource as a Filter
+that can be translated into a query against the store holding the resources:
+
+	filter, err := o.AuthorizedFilter(user, "read", "Post")
+	// e.g. (resource.Owner = "alice" or resource.Public = true)
+
+Returns an UnimplementedOperationError if the policy constrains resources in a
+way that can't be expressed as a Filter, e.g. by calling methods on them.
+*/
+func (o Oso) AuthorizedFilter(actor interface{}, action interface{}, resourceType string) (*Filter, error) {
+	return (*o.p).authorizedFilter(actor, action, resourceType)
+}
+
+/*
+Set the Adapter used by AuthorizedQuery and AuthorizedResources to query the
+store holding resources.
+
+	o, _ = oso.NewOso()
+	o.SetDataFilteringAdapter(oso.NewMemoryAdapter(posts))
+*/
+func (o *Oso) SetDataFilteringAdapter(adapter Adapter) {
+	o.adapter = adapter
+}
+
+/*
+Build a query for the resources of type `resourceType` on which `actor` is
+allowed to perform `action`, using the Adapter set with
+SetDataFilteringAdapter.
+*/
+func (o Oso) AuthorizedQuery(actor interface{}, action interface{}, resourceType string) (interface{}, error) {
+	if o.adapter == nil {
+		return nil, errors.New("no data filtering adapter has been set; call SetDataFilteringAdapter first")
+	}
+	filter, err := o.AuthorizedFilter(actor, action, resourceType)
+	if err != nil {
+		return nil, err
+	}
+	return o.adapter.BuildQuery(withResourceType(filter, resourceType)), nil
+}
+
+/*
+Fetch the resources of type `resourceType` on which `actor` is allowed to
+perform `action`, using the Adapter set with SetDataFilteringAdapter to build
+and run a query against the store holding them.
+
+	o.SetDataFilteringAdapter(oso.NewMemoryAdapter(posts))
+	readable, err := o.AuthorizedResources(user, "read", "Post")
+*/
+func (o Oso) AuthorizedResources(actor interface{}, action interface{}, resourceType string) ([]interface{}, error) {
+	query, err := o.AuthorizedQuery(actor, action, resourceType)
+	if err != nil {
+		return nil, err
+	}
+	return o.adapter.ExecuteQuery(query)
+}
+
 /*
 Start the oso repl where you can make queries and see results printed out.
+
+A query may span several lines; it runs once it is complete, once a line ends
+with a semicolon, or once a blank line is entered. When standard input is a
+terminal, lines can be edited and earlier queries recalled with the up and down
+arrows. Queries are appended to ~/.oso_history, and the history from earlier
+sessions is read back from it on startup.
 */
 func (o Oso) Repl() error {
-	return (*o.p).repl()
+	input := linerInput{liner.NewLiner()}
+	defer input.state.Close()
+	var history io.Writer
+	if home, err := os.UserHomeDir(); err == nil {
+		f, err := os.OpenFile(filepath.Join(home, ".oso_history"), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+		if err == nil {
+			defer f.Close()
+			input.state.ReadHistory(f)
+			history = f
+		}
+	}
+	return (*o.p).repl(input, os.Stdout, history, ReplOptions{})
+}
+
+/*
+Start the oso repl, reading queries from `in` and writing prompts and results to
+`out`, after loading the given Polar policy files. Queries may span several
+lines, as in Repl. Returns nil once `in` is exhausted.
+*/
+func (o Oso) ReplWithIO(in io.Reader, out io.Writer, files ...string) error {
+	return (*o.p).repl(readerInput{bufio.NewReader(in), out}, out, nil, ReplOptions{}, files...)
+}
+
+/*
+Like ReplWithIO, but configured by opts, e.g. to print results as JSON for
+tools wrapping the repl or to keep a history of queries in a file.
+*/
+func (o Oso) ReplWithOptions(in io.Reader, out io.Writer, opts ReplOptions, files ...string) error {
+	var history io.Writer
+	if opts.HistoryFile != "" {
+		f, err := os.OpenFile(opts.HistoryFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		history = f
+	}
+	return (*o.p).repl(readerInput{bufio.NewReader(in), out}, out, history, opts, files...)
 }
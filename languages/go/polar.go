@@ -3,24 +3,55 @@
 package oso
 
 import (
-	"bufio"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
+	"sync"
 
 	"github.com/osohq/go-oso/errors"
 	"github.com/osohq/go-oso/internal/ffi"
 	"github.com/osohq/go-oso/internal/host"
-	"github.com/osohq/go-oso/internal/util"
 	. "github.com/osohq/go-oso/types"
 )
 
 type Polar struct {
 	ffiPolar ffi.PolarFfi
 	host     host.Host
+	// Guards the host and the fields below, so that policies can be loaded and
+	// classes registered while other goroutines are creating queries. Queries
+	// work on their own copy of the host, so running them needs no locking.
+	mu *sync.RWMutex
+	// Files loaded with loadFiles since the last call to clearRules, in the
+	// order they were loaded.
+	loadedFiles []string
+	// The sources that are currently loaded, so that later loads can load
+	// them again alongside new sources.
+	loadedSources []Source
+	// Cache of IsAllowed results, or nil if caching is disabled. Cleared
+	// whenever the policy or registered classes change.
+	cache *resultCache
+	// How queries created from now on report what happens while they run.
+	tracer tracer
+	// Whether loading a policy that refers to unregistered classes fails.
+	strictClasses bool
+	// Polar instances replaced by loading a policy into a fork that still had
+	// queries running when they were replaced. Each is freed once its last
+	// query is, or along with p if that comes first.
+	retired []ffi.PolarFfi
+}
+
+// Classes registered with every Polar instance.
+var builtinClasses = map[string]reflect.Type{
+	"Boolean":    reflect.TypeOf(true),
+	"Integer":    reflect.TypeOf(int(1)),
+	"Float":      reflect.TypeOf(float64(1.0)),
+	"String":     reflect.TypeOf(""),
+	"List":       reflect.TypeOf(make([]interface{}, 0)),
+	"Dictionary": reflect.TypeOf(make(map[string]interface{})),
 }
 
 func newPolar() (*Polar, error) {
@@ -28,6 +59,8 @@ func newPolar() (*Polar, error) {
 	polar := Polar{
 		ffiPolar: ffiPolar,
 		host:     host.NewHost(ffiPolar),
+		mu:       &sync.RWMutex{},
+		tracer:   tracer{writer: os.Stderr},
 	}
 
 	err := polar.registerConstant(host.None{}, "nil")
@@ -35,17 +68,8 @@ func newPolar() (*Polar, error) {
 		return nil, err
 	}
 
-	builtinClasses := map[string]reflect.Type{
-		"Boolean":    reflect.TypeOf(true),
-		"Integer":    reflect.TypeOf(int(1)),
-		"Float":      reflect.TypeOf(float64(1.0)),
-		"String":     reflect.TypeOf(""),
-		"List":       reflect.TypeOf(make([]interface{}, 0)),
-		"Dictionary": reflect.TypeOf(make(map[string]interface{})),
-	}
-
 	for k, v := range builtinClasses {
-		err := polar.registerClass(v, nil, &k)
+		err := polar.registerClass(v, nil, ClassOptions{Name: k})
 		if err != nil {
 			return nil, err
 		}
@@ -55,7 +79,43 @@ func newPolar() (*Polar, error) {
 	return &polar, nil
 }
 
-func (p Polar) checkInlineQueries() error {
+// Frees the Polar VM and any queries created from it that are still
+// outstanding.
+func (p *Polar) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cache.clear()
+	p.ffiPolar.Close()
+	for _, retired := range p.retired {
+		retired.Close()
+	}
+	p.retired = nil
+}
+
+// Returns an error naming any of the given rules that the loaded policy does
+// not define.
+func (p *Polar) validate(rules []string) error {
+	names, err := p.ffiPolar.RuleNames()
+	if err != nil {
+		return err
+	}
+	defined := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		defined[name] = struct{}{}
+	}
+	var missing []string
+	for _, rule := range rules {
+		if _, ok := defined[rule]; !ok {
+			missing = append(missing, rule)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.NewMissingRulesError(missing)
+	}
+	return nil
+}
+
+func (p *Polar) checkInlineQueries() error {
 	for {
 		ffiQuery, err := p.ffiPolar.NextInlineQuery()
 		if err != nil {
@@ -64,7 +124,10 @@ func (p Polar) checkInlineQueries() error {
 		if ffiQuery == nil {
 			return nil
 		}
-		query := newQuery(*ffiQuery, p.host.Copy())
+		query, err := newQuery(*ffiQuery, p.host.Copy(), p.tracer)
+		if err != nil {
+			return err
+		}
 		res, err := query.Next()
 		if err != nil {
 			return err
@@ -79,10 +142,74 @@ func (p Polar) checkInlineQueries() error {
 	}
 }
 
-func (p Polar) loadFiles(filenames []string) error {
+// Get the version of the linked Polar core library.
+func (p *Polar) version() string {
+	return ffi.Version()
+}
+
+func (p *Polar) loadFiles(filenames []string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	absPaths := make(map[string]struct{})
+	for _, filename := range filenames {
+		absPath, err := filepath.Abs(filename)
+		if err != nil {
+			return err
+		}
+		if _, ok := absPaths[absPath]; ok {
+			return errors.NewDuplicateFileLoadError(filename)
+		}
+		for _, loaded := range p.loadedFiles {
+			if loadedPath, err := filepath.Abs(loaded); err == nil && loadedPath == absPath {
+				return errors.NewDuplicateFileLoadError(filename)
+			}
+		}
+		absPaths[absPath] = struct{}{}
+	}
+
+	err := p.loadFilesWith(filenames, ioutil.ReadFile)
+	if err != nil {
+		return err
+	}
+	p.loadedFiles = append(p.loadedFiles, filenames...)
+	return nil
+}
+
+func (p *Polar) loadGlob(pattern string) error {
+	filenames, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	if len(filenames) == 0 {
+		return errors.NewNoMatchingPolarFilesError([]string{pattern})
+	}
+	sort.Strings(filenames)
+	return p.loadFiles(filenames)
+}
+
+// Load the named files, using `readFile` to fetch the contents of each one.
+// The caller must hold p.mu.
+func (p *Polar) loadFilesWith(filenames []string, readFile func(string) ([]byte, error)) error {
 	if len(filenames) == 0 {
 		return nil
 	}
+	sources, err := readFiles(filenames, readFile)
+	if err != nil {
+		return err
+	}
+	return p.loadSources(sources)
+}
+
+// Read the named files into sources, using `readFile` to fetch the contents of
+// each one.
+func readFiles(filenames []string, readFile func(string) ([]byte, error)) ([]Source, error) {
+	// Check every extension up front so that a bad filename anywhere in the
+	// list fails the whole load before we touch the filesystem.
+	for _, filename := range filenames {
+		if filepath.Ext(filename) != ".polar" {
+			return nil, errors.NewPolarFileExtensionError(filename)
+		}
+	}
 
 	sources := []Source{}
 
@@ -93,51 +220,372 @@ func (p Polar) loadFiles(filenames []string) error {
 		// that's updated on each subsequent iteration.
 		localFilename := filename
 
-		if filepath.Ext(filename) != ".polar" {
-			return errors.NewPolarFileExtensionError(filename)
-		}
-
-		data, err := ioutil.ReadFile(filename)
+		data, err := readFile(filename)
 		if err != nil {
-			return err
+			return nil, errors.NewPolarFileLoadError(filename, err)
 		}
 		sources = append(sources, Source{Src: string(data), Filename: &localFilename})
 	}
 
-	return p.loadSources(sources)
+	return sources, nil
 }
 
-func (p Polar) loadString(str string) error {
+func (p *Polar) loadString(str string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	return p.loadSources([]Source{{Src: str, Filename: nil}})
 }
 
-// Register MROs, load Polar code, and check inline queries.
-func (p Polar) loadSources(sources []Source) error {
+// Load several strings together, as one policy. Like every load, they are
+// loaded into a fork of the Polar instance, so if they fail to load or an
+// inline query fails, the policy that was loaded before is left untouched.
+func (p *Polar) loadStrings(strs []string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(strs) == 0 {
+		return nil
+	}
+	sources := make([]Source, len(strs))
+	for i, str := range strs {
+		sources[i] = Source{Src: str, Filename: nil}
+	}
+	return p.loadSources(sources)
+}
+
+func (p *Polar) loadStringNamed(str string, name string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.loadSources([]Source{namedSource(str, name)})
+}
+
+func (p *Polar) loadWithDiagnostics(src string, filename string) ([]Diagnostic, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.loadSourcesWithDiagnostics([]Source{namedSource(src, filename)})
+}
+
+func (p *Polar) loadReader(r io.Reader, filename string) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.loadSources([]Source{namedSource(string(data), filename)})
+}
+
+// A source identified by `filename` in error messages, or by nothing if it is
+// "".
+func namedSource(src string, filename string) Source {
+	source := Source{Src: src, Filename: nil}
+	if filename != "" {
+		source.Filename = &filename
+	}
+	return source
+}
+
+// Load `sources` alongside the loaded policy, swapping it in as
+// replaceSources does. The caller must hold p.mu.
+func (p *Polar) loadSources(sources []Source) error {
+	// The core refuses to load more code once rules have been loaded, and
+	// fails without changing them, so let it report the error.
+	if names, err := p.ffiPolar.RuleNames(); err != nil {
+		return err
+	} else if len(names) > 0 {
+		return p.ffiPolar.Load(sources)
+	}
+	n := len(p.loadedSources)
+	return p.replaceSources(append(p.loadedSources[:n:n], sources...))
+}
+
+// Register MROs, load Polar code into an instance that has no rules, and
+// check inline queries.
+func (p *Polar) loadFresh(sources []Source) error {
 	err := p.host.RegisterMros()
 	if err != nil {
 		return err
 	}
 	err = p.ffiPolar.Load(sources)
+	if err != nil {
+		if polarErr, ok := err.(*errors.FormattedPolarError); ok {
+			if _, ok := polarErr.Kind.ErrorKindVariant.(ErrorKindParse); ok {
+				return errors.NewParseError(polarErr)
+			}
+		}
+		return err
+	}
+	return p.finishLoad(sources)
+}
+
+// Load Polar code alongside the loaded policy as loadSources does, returning
+// every error and warning found in it. The caller must hold p.mu.
+func (p *Polar) loadSourcesWithDiagnostics(sources []Source) ([]Diagnostic, error) {
+	if names, err := p.ffiPolar.RuleNames(); err != nil {
+		return nil, err
+	} else if len(names) > 0 {
+		_, err := p.ffiPolar.LoadWithDiagnostics(sources)
+		return nil, err
+	}
+	fork, err := p.fork()
+	if err != nil {
+		return nil, err
+	}
+	n := len(p.loadedSources)
+	diagnostics, err := fork.loadFreshWithDiagnostics(append(p.loadedSources[:n:n], sources...))
+	if err != nil || hasErrors(diagnostics) {
+		fork.ffiPolar.Close()
+		return diagnostics, err
+	}
+	p.swap(fork)
+	return diagnostics, nil
+}
+
+// Load Polar code into an instance that has no rules, returning every error
+// and warning found in it. If there are no errors, check inline queries as
+// loadFresh does.
+func (p *Polar) loadFreshWithDiagnostics(sources []Source) ([]Diagnostic, error) {
+	err := p.host.RegisterMros()
+	if err != nil {
+		return nil, err
+	}
+	ffiDiagnostics, err := p.ffiPolar.LoadWithDiagnostics(sources)
+	if err != nil {
+		return nil, err
+	}
+	diagnostics := make([]Diagnostic, len(ffiDiagnostics))
+	for i, d := range ffiDiagnostics {
+		diagnostics[i] = newDiagnostic(d)
+	}
+	if hasErrors(diagnostics) {
+		return diagnostics, nil
+	}
+	return diagnostics, p.finishLoad(sources)
+}
+
+func hasErrors(diagnostics []Diagnostic) bool {
+	for _, d := range diagnostics {
+		if d.Err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the sources that were just loaded, and record them if they pass.
+func (p *Polar) finishLoad(sources []Source) error {
+	if p.strictClasses {
+		if err := p.checkClassesRegistered(); err != nil {
+			return err
+		}
+	}
+	if err := p.checkInlineQueries(); err != nil {
+		return err
+	}
+	p.loadedSources = append(p.loadedSources, sources...)
+	return nil
+}
+
+// Re-read every file loaded with loadFiles and replace the loaded policy with
+// their current contents. If the new contents fail to load, the previously
+// loaded sources are restored.
+func (p *Polar) reload() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.loadedFiles) == 0 {
+		return nil
+	}
+	sources, err := readFiles(p.loadedFiles, ioutil.ReadFile)
+	if err != nil {
+		return err
+	}
+	return p.replaceSources(sources)
+}
+
+// Remove the rules loaded from the file `filename` by loadFiles, keeping the
+// rest of the loaded policy.
+func (p *Polar) unloadFile(filename string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	absPath, err := filepath.Abs(filename)
 	if err != nil {
 		return err
 	}
-	return p.checkInlineQueries()
+	index := -1
+	for i, loaded := range p.loadedFiles {
+		if loadedPath, err := filepath.Abs(loaded); err == nil && loadedPath == absPath {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("Cannot unload %s; it has not been loaded", filename)
+	}
+	loadedFile := p.loadedFiles[index]
+	var sources []Source
+	for _, source := range p.loadedSources {
+		if source.Filename == nil || *source.Filename != loadedFile {
+			sources = append(sources, source)
+		}
+	}
+	if err = p.replaceSources(sources); err != nil {
+		return err
+	}
+	p.loadedFiles = append(p.loadedFiles[:index:index], p.loadedFiles[index+1:]...)
+	return nil
+}
+
+// Replace the loaded policy with `sources`. They are loaded into a fork of the
+// Polar instance, which is swapped in only once they have loaded and passed
+// their checks, so a failed load leaves the policy as it was and queries that
+// are already running never see a partly loaded one. The caller must hold
+// p.mu.
+func (p *Polar) replaceSources(sources []Source) error {
+	fork, err := p.fork()
+	if err != nil {
+		return err
+	}
+	if len(sources) > 0 {
+		if err = fork.loadFresh(sources); err != nil {
+			fork.ffiPolar.Close()
+			return err
+		}
+	}
+	p.swap(fork)
+	return nil
+}
+
+// Get a Polar with the same classes, constants and settings as p but no
+// policy, to load a policy into before swapping it in. The caller must hold
+// p.mu.
+func (p *Polar) fork() (*Polar, error) {
+	ffiPolar, err := p.ffiPolar.Fork()
+	if err != nil {
+		return nil, err
+	}
+	return &Polar{
+		ffiPolar:      ffiPolar,
+		host:          p.host.WithPolar(ffiPolar),
+		mu:            p.mu,
+		tracer:        p.tracer,
+		strictClasses: p.strictClasses,
+	}, nil
+}
+
+// Swap in the Polar instance of `fork` along with the policy loaded into it.
+// Queries created from the instance it replaces keep running against it, and
+// it is freed as soon as they have all been freed. The caller must hold p.mu.
+func (p *Polar) swap(fork *Polar) {
+	p.ffiPolar.Retire()
+	// Forget retired instances that have since been freed.
+	retired := append(p.retired, p.ffiPolar)
+	p.retired = nil
+	for _, ffiPolar := range retired {
+		if !ffiPolar.Idle() {
+			p.retired = append(p.retired, ffiPolar)
+		}
+	}
+	p.ffiPolar = fork.ffiPolar
+	p.host = fork.host
+	p.loadedSources = fork.loadedSources
+	p.cache.clear()
+}
+
+func (p *Polar) clearRules() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Swap in an empty fork rather than clearing the rules in place, so that
+	// running queries keep their policy.
+	if err := p.replaceSources(nil); err != nil {
+		return err
+	}
+	p.loadedFiles = nil
+	return nil
+}
+
+func (p *Polar) setLogger(logger func(event TraceEvent)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tracer.logger = logger
+}
+
+func (p *Polar) setStrictClasses(strict bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.strictClasses = strict
+}
+
+func (p *Polar) setBytesAsList(asList bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cache.clear()
+	p.host.SetBytesAsList(asList)
+}
+
+func (p *Polar) setUnknownAttributesAsNil(asNil bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cache.clear()
+	p.host.SetUnknownAttributesAsNil(asNil)
+}
+
+// Check that every class the loaded policy refers to has been registered.
+func (p *Polar) checkClassesRegistered() error {
+	classes, err := p.ffiPolar.UnregisteredClasses()
+	if err != nil {
+		return err
+	}
+	if len(classes) > 0 {
+		return errors.NewUnregisteredClassesError(classes)
+	}
+	return nil
+}
+
+func (p *Polar) setTraceEnabled(enabled bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tracer.enabled = enabled
 }
 
-func (p Polar) clearRules() error {
-	return p.ffiPolar.ClearRules()
+func (p *Polar) setTraceWriter(writer io.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if writer == nil {
+		writer = os.Stderr
+	}
+	p.tracer.writer = writer
 }
 
-func (p Polar) queryStr(query string) (*Query, error) {
+func (p *Polar) queryStr(query string) (*Query, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 	ffiQuery, err := p.ffiPolar.NewQueryFromStr(query)
 	if err != nil {
 		return nil, err
 	}
-	newQuery := newQuery(*ffiQuery, p.host.Copy())
-	return &newQuery, nil
+	return newQuery(*ffiQuery, p.host.Copy(), p.tracer)
 }
 
-func (p Polar) queryRule(name string, args ...interface{}) (*Query, error) {
+func (p *Polar) queryStrWithBindings(query string, bindings map[string]interface{}) (*Query, error) {
+	newQuery, err := p.queryStr(query)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range bindings {
+		if err = newQuery.bind(name, value); err != nil {
+			newQuery.Cleanup()
+			return nil, err
+		}
+	}
+	return newQuery, nil
+}
+
+func (p *Polar) queryRule(name string, args ...interface{}) (*Query, error) {
+	return p.queryRuleWithOptions(QueryOptions{}, name, args...)
+}
+
+func (p *Polar) queryRuleWithOptions(opts QueryOptions, name string, args ...interface{}) (*Query, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 	host := p.host.Copy()
 	polarArgs := make([]Term, len(args))
 	for idx, arg := range args {
@@ -147,68 +595,109 @@ func (p Polar) queryRule(name string, args ...interface{}) (*Query, error) {
 		}
 		polarArgs[idx] = Term{*converted}
 	}
+	return p.newRuleQuery(opts, host, name, polarArgs)
+}
+
+func (p *Polar) queryRuleTerms(name string, args []Term) (*Query, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.newRuleQuery(QueryOptions{}, p.host.Copy(), name, args)
+}
+
+// Create a query for the rule `name` with arguments that have already been
+// converted to Polar. The caller must hold p.mu.
+func (p *Polar) newRuleQuery(opts QueryOptions, host host.Host, name string, args []Term) (*Query, error) {
 	query := Call{
 		Name: Symbol(name),
-		Args: polarArgs,
+		Args: args,
 	}
 	inner := ValueCall(query)
-	ffiQuery, err := p.ffiPolar.NewQueryFromTerm(Term{Value{inner}})
+	ffiQuery, err := p.ffiPolar.NewQueryFromTerm(Term{Value{inner}}, opts.RecordRuleSources)
+	if err != nil {
+		return nil, err
+	}
+	newQuery, err := newQuery(*ffiQuery, host, p.tracer)
 	if err != nil {
 		return nil, err
 	}
-	newQuery := newQuery(*ffiQuery, host)
-	return &newQuery, nil
+	newQuery.acceptExpressions = opts.AcceptExpressions
+	if opts.RecordExternalCalls {
+		newQuery.externalCalls = &[]ExternalCall{}
+	}
+	return newQuery, nil
 }
 
-func (p Polar) repl(files ...string) error {
-	reader := bufio.NewReader(os.Stdin)
-	for {
-		fmt.Print("query> ")
-		text, err := reader.ReadString('\n')
-		if err == io.EOF {
-			return nil
+// Run a single query checking `actor` may perform `action` on each of
+// `resources`, and return the indices of the resources it may. The query
+// finds every solution of `allow` for each resource rather than stopping at the
+// first, since a cut in a query, outside any rule body, would also cut the
+// choice of the later resources.
+func (p *Polar) allowedIndices(actor interface{}, action interface{}, resources []interface{}) (map[int64]bool, error) {
+	items := make([]interface{}, len(resources))
+	for i, resource := range resources {
+		items[i] = []interface{}{i, resource}
+	}
+	query, err := p.queryStrWithBindings("[index, resource] in items and allow(actor, action, resource)", map[string]interface{}{
+		"items":  items,
+		"actor":  actor,
+		"action": action,
+	})
+	if err != nil {
+		return nil, err
+	}
+	results, err := query.GetAllResults()
+	if err != nil {
+		return nil, err
+	}
+	allowed := make(map[int64]bool, len(results))
+	for _, result := range results {
+		index, ok := result["index"].(int64)
+		if !ok {
+			return nil, fmt.Errorf("Expected an integer index, got %v", result["index"])
 		}
-		text = util.QueryStrip(text)
+		allowed[index] = true
+	}
+	return allowed, nil
+}
 
-		ffiQuery, err := p.ffiPolar.NewQueryFromStr(text)
-		if err != nil {
-			fmt.Println(err)
-			continue
+/*
+Register a Go type with Polar so that it can be referenced within Polar files.
+Accepts a concrete value of the Go type (or its reflect.Type), a constructor
+function (or nil), and options for the class.
+*/
+func (p *Polar) registerClass(cls interface{}, ctor interface{}, opts ClassOptions) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.registerClassLocked(cls, ctor, opts)
+}
+
+// Register a Go type under each of `names`. Fails without registering any of
+// them if one is already in use by a different type.
+func (p *Polar) registerClassAliases(cls interface{}, names []string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	realType := classType(cls)
+	classes := p.host.Classes()
+	for _, name := range names {
+		if existing, ok := classes[name]; ok && existing != realType {
+			return errors.NewDuplicateClassAliasError(name, realType, existing)
 		}
-		query := newQuery(*ffiQuery, p.host.Copy())
-		results, err := query.GetAllResults()
-		if err != nil {
-			fmt.Println(err)
+	}
+	for _, name := range names {
+		// A name the type already has keeps the options it was registered
+		// with.
+		if _, ok := classes[name]; ok {
 			continue
 		}
-		if len(results) == 0 {
-			fmt.Println(false)
-		} else {
-			for _, bindings := range results {
-				if len(bindings) == 0 {
-					fmt.Println(true)
-				} else {
-					for k, v := range bindings {
-						switch v := v.(type) {
-						// print strings with quotes but not variables or other types represented by strings
-						case string:
-							fmt.Printf("%v = %#v\n", k, v)
-						default:
-							fmt.Printf("%v = %v\n", k, v)
-						}
-					}
-				}
-			}
+		if err := p.registerClassLocked(realType, nil, ClassOptions{Name: name}); err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
-/*
-Register a Go type with Polar so that it can be referenced within Polar files.
-Accepts a concrete value of the Go type, a constructor function (or nil), and a
-name (or nil).
-*/
-func (p Polar) registerClass(cls interface{}, ctor interface{}, name *string) error {
+// Register a Go type while holding the lock.
+func (p *Polar) registerClassLocked(cls interface{}, ctor interface{}, opts ClassOptions) error {
 	// Get constructor
 	constructor := reflect.ValueOf(nil)
 	if ctor != nil {
@@ -218,35 +707,140 @@ func (p Polar) registerClass(cls interface{}, ctor interface{}, name *string) er
 		}
 	}
 
-	// get real type
-	var realType reflect.Type
-	switch c := cls.(type) {
-	case reflect.Type:
-		realType = c
-	default:
-		realType = reflect.TypeOf(cls)
-	}
+	realType := classType(cls)
 
 	// Get class name
-	var className string
-	if name == nil {
-		className = realType.Name()
-	} else {
-		className = *name
+	className := opts.Name
+	if className == "" {
+		className = host.ClassName(realType)
 	}
 
-	err := p.host.CacheClass(realType, className, constructor)
+	err := p.host.CacheClass(host.Class{
+		Type:              realType,
+		Name:              className,
+		Constructor:       constructor,
+		Fields:            opts.Fields,
+		Methods:           opts.Methods,
+		Equals:            opts.Equals,
+		JSONTags:          opts.JSONTags,
+		ErrorValue:        opts.ErrorValue,
+		StructConstructor: opts.ConstructorStyle == ConstructorStruct,
+	})
 	if err != nil {
 		return err
 	}
+	p.cache.clear()
 	newVal := reflect.New(realType)
-	return p.registerConstant(newVal.Interface(), className)
+	polarValue, err := p.host.ConstantToPolar(newVal.Interface())
+	if err != nil {
+		return err
+	}
+	return p.ffiPolar.RegisterConstant(Term{*polarValue}, className)
+}
+
+// Get the type of a class given as a reflect.Type or a value of the type.
+func classType(cls interface{}) reflect.Type {
+	if c, ok := cls.(reflect.Type); ok {
+		return c
+	}
+	return reflect.TypeOf(cls)
+}
+
+func (p *Polar) registerConstant(value interface{}, name string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cache.clear()
+	polarValue, err := p.host.ConstantToPolar(value)
+	if err != nil {
+		return err
+	}
+	return p.registerConstantValue(value, polarValue, name)
+}
+
+// Register every constant in `constants`, in order of name. Converts all of
+// the values before registering any of them, so that a value that can't be
+// converted leaves the constants as they were.
+func (p *Polar) registerConstants(constants map[string]interface{}) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cache.clear()
+	names := make([]string, 0, len(constants))
+	for name := range constants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	polarValues := make([]*Value, len(names))
+	for i, name := range names {
+		polarValue, err := p.host.ConstantToPolar(constants[name])
+		if err != nil {
+			return errors.NewConstantRegistrationError(name, err)
+		}
+		polarValues[i] = polarValue
+	}
+	for i, name := range names {
+		if err := p.registerConstantValue(constants[name], polarValues[i], name); err != nil {
+			return errors.NewConstantRegistrationError(name, err)
+		}
+	}
+	return nil
 }
 
-func (p Polar) registerConstant(value interface{}, name string) error {
-	polarValue, err := p.host.ToPolar(value)
+func (p *Polar) registerConstantValue(value interface{}, polarValue *Value, name string) error {
+	if err := p.ffiPolar.RegisterConstant(Term{*polarValue}, name); err != nil {
+		return err
+	}
+	p.host.CacheConstant(name, reflect.TypeOf(value), polarValue)
+	return nil
+}
+
+// Get the names of the registered classes, in sorted order.
+func (p *Polar) registeredClasses() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return sortedNames(p.host.Classes())
+}
+
+// Get the names of the registered constants, in sorted order.
+func (p *Polar) registeredConstants() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return sortedNames(p.host.Constants())
+}
+
+func sortedNames(types map[string]reflect.Type) []string {
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Converts a value to Polar. Any instances are cached like those of constants,
+// so the result can be used in any query from now on.
+func (p *Polar) toPolarValue(value interface{}) (*Value, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.host.ConstantToPolar(value)
+}
+
+// Forgets the instances cached when converting term with toPolarValue.
+func (p *Polar) releasePolarValue(term Term) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	p.host.ReleaseInstances(term)
+}
+
+func (p *Polar) fromPolarValue(term Term, dest interface{}) error {
+	destValue := reflect.ValueOf(dest)
+	if destValue.Kind() != reflect.Ptr || destValue.IsNil() {
+		return fmt.Errorf("Cannot decode a Polar value into %T; expected a non-nil pointer", dest)
+	}
+	p.mu.RLock()
+	value, err := p.host.ToGo(term)
+	p.mu.RUnlock()
 	if err != nil {
 		return err
 	}
-	return p.ffiPolar.RegisterConstant(Term{*polarValue}, name)
+	return host.SetFieldTo(destValue.Elem(), value)
 }
@@ -2,10 +2,15 @@ package oso
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/osohq/go-oso/errors"
 	"github.com/osohq/go-oso/interfaces"
@@ -22,38 +27,182 @@ Execute a Polar query through the FFI/event interface.
 type Query struct {
 	ffiQuery ffi.QueryFfi
 	host     host.Host
-	calls    map[uint64]<-chan interface{}
+	calls    map[uint64]func() (interface{}, bool)
+	ctx      context.Context
+	// Stops the Polar VM once ctx is done, if ctx can be canceled.
+	cancel *ffi.CancelHandle
+	// Whether bindings may be partially evaluated expressions.
+	acceptExpressions bool
+	// How the query reports what happens while it runs.
+	tracer tracer
+	// The source of the rule that produced the last result, if known.
+	lastRuleSource *RuleSource
+	// The external calls made so far, if they are being recorded. Held by
+	// pointer since calls are handled on copies of the query.
+	externalCalls *[]ExternalCall
+}
+
+/*
+Options for creating a query with Oso.QueryRuleWithOptions.
+*/
+type QueryOptions struct {
+	// Return bindings for variables the policy constrains without binding them
+	// as Expressions describing the constraints, instead of failing the query.
+	// This allows policies to be partially evaluated.
+	AcceptExpressions bool
+	// Record the rule that produced each result, so that it can be retrieved
+	// with Query.LastRuleSource. This slows queries down, so it is intended
+	// for debugging.
+	RecordRuleSources bool
+	// Record every external call the query makes, so that they can be
+	// retrieved with Query.ExternalCalls.
+	RecordExternalCalls bool
+}
+
+/*
+An external call made by a query: a method called or a field looked up on an
+instance, or a call to a function registered with RegisterFunction. Class is
+the name of the instance's Polar class, as for TypedBinding, and Name is the
+method or field. For functions, Class is empty and Name is the name the
+function was registered under.
+
+Calls that fail before reaching Go, e.g. because the method doesn't exist or
+isn't in the class's list of methods, are not recorded.
+*/
+type ExternalCall struct {
+	Class    string
+	Name     string
+	IsMethod bool
 }
 
 // NATIVE_TYPES = [int, float, bool, str, dict, type(None), list]
 
-func newQuery(ffiQuery ffi.QueryFfi, host host.Host) Query {
-	return Query{
+func newQuery(ffiQuery ffi.QueryFfi, host host.Host, tracer tracer) (*Query, error) {
+	query := &Query{
 		ffiQuery: ffiQuery,
 		host:     host,
-		calls:    make(map[uint64]<-chan interface{}),
+		calls:    make(map[uint64]func() (interface{}, bool)),
+		ctx:      context.Background(),
+		tracer:   tracer,
+	}
+	if tracer.enabled {
+		if err := query.ffiQuery.SetPolarLog(true); err != nil {
+			query.Cleanup()
+			return nil, err
+		}
+	}
+	if tracer.enabled || tracer.logger != nil {
+		query.ffiQuery.SetMessageHandler(query.handleMessage)
+	}
+	// Free queries that are abandoned without being closed.
+	runtime.SetFinalizer(query, (*Query).Cleanup)
+	return query, nil
+}
+
+// Bind the Polar variable `name` to `value` before the query starts.
+func (q *Query) bind(name string, value interface{}) error {
+	converted, err := q.host.ToPolar(value)
+	if err != nil {
+		return err
 	}
+	return q.ffiQuery.Bind(name, Term{*converted})
+}
+
+// Convert a result binding to Go. Partially evaluated expressions are
+// returned as Expressions if the query accepts them.
+func (q *Query) bindingToGo(term Term) (interface{}, error) {
+	if expr, ok := term.Value.ValueVariant.(ValueExpression); ok && q.acceptExpressions {
+		return toExpression(q.host, Operation(expr))
+	}
+	return q.host.ToGo(term)
 }
 
 func (q *Query) Cleanup() {
 	q.ffiQuery.Delete()
 }
 
+/*
+Free the query. Queries free themselves once Next reports that they have no
+more results, but a query that is abandoned before then must be closed to free
+it promptly. It is safe to close a query more than once, or after it has been
+exhausted; calling Next on a closed query returns an error.
+
+	query, err := o.NewQueryFromRule("allow", user, "read", post)
+	if err != nil {
+		return err
+	}
+	defer query.Close()
+	result, err := query.Next()
+*/
+func (q *Query) Close() error {
+	q.Cleanup()
+	return nil
+}
+
 func (q *Query) resultsChannel() (<-chan map[string]interface{}, <-chan error) {
+	return q.ResultsChan(context.Background())
+}
+
+/*
+Streams query results over a channel. The query is stepped lazily, at most one
+result ahead of the receiver, so results can be processed in constant memory.
+
+Both channels are closed once the query is exhausted. If the query fails, or ctx
+is canceled before the query is exhausted, the query is cleaned up and the
+error is sent on the error channel before it is closed. Canceling ctx stops the
+query even while it is running towards its next result.
+
+Callers that stop receiving before both channels are closed must cancel ctx:
+otherwise the goroutine stepping the query blocks forever sending its next
+result, and the query is never cleaned up.
+*/
+func (q *Query) ResultsChan(ctx context.Context) (<-chan map[string]interface{}, <-chan error) {
+	// Buffer a single result, so that callers that check for an error before
+	// receiving the only result of a query don't block.
 	results := make(chan map[string]interface{}, 1)
 	errors := make(chan error, 1)
 
+	// Run each step under a context that's done once either ctx or the
+	// query's own context is, so that canceling ctx stops the Polar VM.
+	stepCtx, stop := context.WithCancel(q.ctx)
+	q.ctx = stepCtx
 	go func() {
-		r, err := q.Next()
-		for r != nil && err == nil {
-			results <- *r
-			r, err = q.Next()
+		select {
+		case <-ctx.Done():
+			stop()
+		case <-stepCtx.Done():
 		}
-		if err != nil {
-			errors <- err
+	}()
+
+	go func() {
+		defer stop()
+		defer close(errors)
+		defer close(results)
+		for {
+			if err := ctx.Err(); err != nil {
+				q.Cleanup()
+				errors <- err
+				return
+			}
+			r, err := q.Next()
+			if err != nil {
+				if ctxErr := ctx.Err(); ctxErr != nil {
+					err = ctxErr
+				}
+				errors <- err
+				return
+			}
+			if r == nil {
+				return
+			}
+			select {
+			case results <- *r:
+			case <-ctx.Done():
+				q.Cleanup()
+				errors <- ctx.Err()
+				return
+			}
 		}
-		close(results)
-		close(errors)
 	}()
 
 	return results, errors
@@ -64,8 +213,21 @@ Executes the query until all results have been returned, and returns results
 as a list of binding maps.
 */
 func (q *Query) GetAllResults() ([]map[string]interface{}, error) {
+	return q.GetResults(0)
+}
+
+/*
+Executes the query until at most limit results have been returned, and returns
+results as a list of binding maps. The query is cleaned up once limit results
+have been returned, so it can't be stepped further. A limit of zero or less
+returns all results, like GetAllResults.
+
+Useful for probing policies whose rules may have very many (or infinitely
+many) results.
+*/
+func (q *Query) GetResults(limit int) ([]map[string]interface{}, error) {
 	results := make([]map[string]interface{}, 0)
-	for {
+	for limit <= 0 || len(results) < limit {
 		if v, err := q.Next(); err != nil {
 			return nil, err
 		} else if v == nil {
@@ -74,25 +236,173 @@ func (q *Query) GetAllResults() ([]map[string]interface{}, error) {
 			results = append(results, *v)
 		}
 	}
+	if limit > 0 && len(results) == limit {
+		q.Cleanup()
+	}
 	return results, nil
 }
 
 /*
 Get the next query result. Returns a pointer to a map of result bindings,
 or a nil pointer if there are no results.
+
+If the query was created with a context, the Polar VM is stopped as soon as
+the context is canceled or its deadline passes, even while it is evaluating
+rules that make no calls into Go, e.g. deep recursion. The query is then
+cleaned up and the context's error is returned.
 */
 func (q *Query) Next() (*map[string]interface{}, error) {
 	if q == nil {
 		return nil, fmt.Errorf("query has already finished")
 	}
+	ev, err := q.nextResult()
+	if err != nil || ev == nil {
+		return nil, err
+	}
+	results := make(map[string]interface{})
+	for k, v := range ev.Bindings {
+		converted, err := q.bindingToGo(v)
+		if err != nil {
+			q.Cleanup()
+			return nil, err
+		}
+		results[string(k)] = converted
+	}
+	q.recordResult(ev, results)
+	return &results, nil
+}
+
+// Note the rule that produced a result and trace it.
+func (q *Query) recordResult(ev *QueryEventResult, results interface{}) {
+	q.lastRuleSource = nil
+	if ev.Trace != nil {
+		q.lastRuleSource = ev.Trace.RuleSource
+	}
+	q.trace(TraceEvent{Kind: TraceQueryResult, Message: fmt.Sprintf("result: %v", results)})
+}
+
+/*
+The value of a binding returned by GetAllResultsTyped, along with the name of
+its Polar class: "Boolean", "Integer", "Float", "String", "List" or
+"Dictionary" for Polar values, "nil" for nil, and the name of the registered
+class for instances of Go types. Instances of unregistered types are named by
+their Go type, e.g. "*main.User". Type is "" for values that aren't instances
+of a class, such as the expressions returned by queries that accept them.
+*/
+type TypedBinding struct {
+	Value interface{}
+	Type  string
+}
+
+/*
+Executes the query until all results have been returned, like GetAllResults,
+and returns each binding along with the name of its Polar class. This helps
+to debug policies where a variable may be bound to instances of different
+classes:
+
+	results, err := query.GetAllResultsTyped()
+	for _, result := range results {
+		fmt.Printf("%s: %v\n", result["resource"].Type, result["resource"].Value)
+	}
+
+When a type is registered under several names, its instances are named by the
+type's own name if it is one of them, or else by the first in sorted order.
+*/
+func (q *Query) GetAllResultsTyped() ([]map[string]TypedBinding, error) {
+	if q == nil {
+		return nil, fmt.Errorf("query has already finished")
+	}
+	results := make([]map[string]TypedBinding, 0)
+	for {
+		ev, err := q.nextResult()
+		if err != nil {
+			return nil, err
+		} else if ev == nil {
+			return results, nil
+		}
+		result := make(map[string]TypedBinding, len(ev.Bindings))
+		for k, v := range ev.Bindings {
+			converted, err := q.bindingToGo(v)
+			if err != nil {
+				q.Cleanup()
+				return nil, err
+			}
+			result[string(k)] = TypedBinding{Value: converted, Type: q.host.ClassOf(v, converted)}
+		}
+		q.recordResult(ev, result)
+		results = append(results, result)
+	}
+}
+
+/*
+Executes the query until all results have been returned, and returns the
+number of results. Bindings are discarded without being converted to Go, so
+this is cheaper than counting the results of GetAllResults. The query is
+cleaned up once it is exhausted.
+*/
+func (q *Query) Count() (int, error) {
+	if q == nil {
+		return 0, fmt.Errorf("query has already finished")
+	}
+	count := 0
 	for {
-		ffiEvent, err := q.ffiQuery.NextEvent()
+		if ev, err := q.nextResult(); err != nil {
+			return 0, err
+		} else if ev == nil {
+			return count, nil
+		}
+		count++
+	}
+}
+
+// Run the Polar VM until it emits its next event. If the query's context can be
+// canceled, the VM is canceled as soon as the context is done, rather than
+// once it next emits an event.
+func (q *Query) nextEvent() (*string, error) {
+	done := q.ctx.Done()
+	if done == nil {
+		return q.ffiQuery.NextEvent()
+	}
+	if q.cancel == nil {
+		cancel, err := q.ffiQuery.CancelHandle()
 		if err != nil {
 			return nil, err
 		}
+		q.cancel = cancel
+	}
+	finished := make(chan struct{})
+	defer close(finished)
+	go func(cancel *ffi.CancelHandle) {
+		select {
+		case <-done:
+			cancel.Cancel()
+		case <-finished:
+		}
+	}(q.cancel)
+	return q.ffiQuery.NextEvent()
+}
+
+// Run the query until it produces its next result, handling the events the
+// Polar VM emits along the way. Returns nil once the query is done, after
+// cleaning it up.
+func (q *Query) nextResult() (*QueryEventResult, error) {
+	for {
+		if err := q.ctx.Err(); err != nil {
+			defer q.Cleanup()
+			return nil, err
+		}
+		ffiEvent, err := q.nextEvent()
+		if err != nil {
+			defer q.Cleanup()
+			if ctxErr := q.ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			return nil, err
+		}
 		var event QueryEvent
 		err = json.Unmarshal([]byte(*ffiEvent), &event)
 		if err != nil {
+			defer q.Cleanup()
 			return nil, err
 		}
 
@@ -103,15 +413,7 @@ func (q *Query) Next() (*map[string]interface{}, error) {
 		case QueryEventDebug:
 			err = q.handleDebug(ev)
 		case QueryEventResult:
-			results := make(map[string]interface{})
-			for k, v := range ev.Bindings {
-				converted, err := q.host.ToGo(v)
-				if err != nil {
-					return nil, err
-				}
-				results[string(k)] = converted
-			}
-			return &results, nil
+			return &ev, nil
 		case QueryEventMakeExternal:
 			err = q.handleMakeExternal(ev)
 		case QueryEventExternalCall:
@@ -135,50 +437,263 @@ func (q *Query) Next() (*map[string]interface{}, error) {
 			return nil, err
 		}
 	}
+}
+
+/*
+Get where the rule that produced the last result returned by Next is defined,
+to find out which of several rules allowed a request:
+
+	query, err := o.QueryRuleWithOptions(oso.QueryOptions{RecordRuleSources: true},
+		"allow", user, "read", post)
+	if result, err := query.Next(); err == nil && result != nil {
+		source := query.LastRuleSource()
+		fmt.Printf("allowed by %s at line %d\n", source.Src, source.Line)
+	}
+
+The source's Src is the head of the rule, e.g. `allow(user: User, "read", _)`.
+Returns nil unless the query was created with QueryOptions.RecordRuleSources,
+or if the rule wasn't loaded from a policy.
+*/
+func (q *Query) LastRuleSource() *RuleSource {
+	return q.lastRuleSource
+}
+
+/*
+Get the external calls the query has made so far, in the order it made them.
+This shows which Go methods and fields a policy depends on, e.g. to check what
+a new policy would call before deploying it:
+
+	query, err := o.QueryRuleWithOptions(oso.QueryOptions{RecordExternalCalls: true}, "allow", user, "read", doc)
+	results, err := query.GetAllResults()
+	for _, call := range query.ExternalCalls() {
+		fmt.Printf("%s.%s\n", call.Class, call.Name)
+	}
+
+Calls are made as usual while they are recorded, so methods with side effects
+still have them. Returns nil unless the query was created with
+QueryOptions.RecordExternalCalls.
+*/
+func (q *Query) ExternalCalls() []ExternalCall {
+	if q.externalCalls == nil {
+		return nil
+	}
+	return append([]ExternalCall{}, *q.externalCalls...)
+}
+
+/*
+Get the Polar source of the query, e.g. for audit logging. Rule queries are
+written out with their arguments, with Go values shown by their type and
+fields, e.g. `allow(main.User{Name:alice}, "read", main.Post{ID:1})`. Queries
+parsed from a string return the string followed by its location, e.g.
+`f(1) at line 1, column 1`.
+
+Returns an error if the query has been closed.
+*/
+func (q *Query) Source() (string, error) {
+	source, err := q.ffiQuery.Source()
+	if err != nil {
+		return "", err
+	}
+	return *source, nil
+}
+
+/*
+Get the next query result and decode its bindings into dest, which must be a
+non-nil pointer to a struct. Each binding is assigned to the exported field
+whose `polar` struct tag matches the binding's name or, if no field has a
+matching tag, to the field whose `json` tag matches it, or else to the field
+whose name matches it ignoring case and underscores, so that a binding named
+`created_at` fills a field named `CreatedAt`. Bindings without a matching
+field are ignored, and fields without a binding are left unchanged.
+
+Polar dictionaries are decoded into struct fields the same way, by `json` tag
+or field name, ignoring keys without a matching field. Use
+NextIntoWithOptions to fail on unmatched bindings and keys instead.
+
+Returns false if there are no more results, and an error if a binding can't
+be assigned to its field.
+
+	var result struct {
+		Action string
+		Level  int `polar:"lvl"`
+	}
+	for {
+		if ok, err := query.NextInto(&result); err != nil {
+			return err
+		} else if !ok {
+			break
+		}
+		...
+	}
+*/
+func (q *Query) NextInto(dest interface{}) (bool, error) {
+	return q.NextIntoWithOptions(dest, DecodeOptions{})
+}
+
+// Options for decoding query results with NextIntoWithOptions.
+type DecodeOptions struct {
+	// Fail if a binding, or a key of a dictionary decoded into a struct, has
+	// no matching field, instead of ignoring it.
+	Strict bool
+}
+
+/*
+Get the next query result and decode its bindings into dest, as NextInto does,
+configured by DecodeOptions.
+*/
+func (q *Query) NextIntoWithOptions(dest interface{}, opts DecodeOptions) (bool, error) {
+	rv := reflect.ValueOf(dest)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return false, fmt.Errorf("NextInto requires a non-nil pointer to a struct, got %T", dest)
+	}
+	results, err := q.Next()
+	if err != nil || results == nil {
+		return false, err
+	}
+	for name, value := range *results {
+		field, ok := bindingField(rv.Elem(), name)
+		if !ok {
+			if opts.Strict {
+				return false, fmt.Errorf("%v has no field for binding %s", rv.Elem().Type(), name)
+			}
+			continue
+		}
+		if err := host.DecodeTo(field, value, opts.Strict); err != nil {
+			return false, fmt.Errorf("cannot assign binding %s: %v", name, err)
+		}
+	}
+	return true, nil
+}
 
+// Finds the field of the struct v to assign the binding name to.
+func bindingField(v reflect.Value, name string) (reflect.Value, bool) {
+	typ := v.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		if tag, ok := typ.Field(i).Tag.Lookup("polar"); ok && tag == name {
+			return v.Field(i), v.Field(i).CanSet()
+		}
+	}
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if _, tagged := f.Tag.Lookup("polar"); !tagged && strings.Split(f.Tag.Get("json"), ",")[0] == name {
+			return v.Field(i), v.Field(i).CanSet()
+		}
+	}
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if _, tagged := f.Tag.Lookup("polar"); !tagged && normalizeName(f.Name) == normalizeName(name) {
+			return v.Field(i), v.Field(i).CanSet()
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// Lower-case a name and drop its underscores, so that `created_at` matches
+// `CreatedAt`.
+func normalizeName(name string) string {
+	return strings.ToLower(strings.Replace(name, "_", "", -1))
 }
 
 func (q Query) handleMakeExternal(event types.QueryEventMakeExternal) error {
 	id := uint64(event.InstanceId)
 	call, _ := event.Constructor.Value.ValueVariant.(ValueCall)
-	if call.Kwargs != nil {
+	if call.Kwargs != nil && !q.host.HasStructConstructor(string(call.Name)) {
 		return &errors.KwargsError{}
 	}
+	q.trace(TraceEvent{Kind: TraceMakeExternal, Message: fmt.Sprintf("constructing %s", call.Name), Attribute: string(call.Name)})
 	return q.host.MakeInstance(call, id)
 }
 
+/*
+PolarAttributer is implemented by values that look up their own attributes,
+such as records backed by a map. When a policy looks up an attribute of a
+PolarAttributer, e.g. `record.owner`, GetPolarAttribute is called with the
+attribute's name instead of looking for a struct field. An error fails the
+query, as looking up a field that doesn't exist does. Method calls are not
+affected.
+*/
+type PolarAttributer interface {
+	GetPolarAttribute(name string) (interface{}, error)
+}
+
+// Get `instance` as a PolarAttributer, if it or a pointer to it is one.
+func asPolarAttributer(instance interface{}) (PolarAttributer, bool) {
+	if attributer, ok := instance.(PolarAttributer); ok {
+		return attributer, true
+	}
+	if instance == nil || reflect.TypeOf(instance).Kind() == reflect.Ptr {
+		return nil, false
+	}
+	ptr := reflect.New(reflect.TypeOf(instance))
+	ptr.Elem().Set(reflect.ValueOf(instance))
+	attributer, ok := ptr.Interface().(PolarAttributer)
+	return attributer, ok
+}
+
 func (q Query) handleExternalCall(event types.QueryEventExternalCall) error {
 	instance, err := q.host.ToGo(event.Instance)
 	if err != nil {
 		return err
 	}
+	q.traceExternalCall(event.Instance, instance, string(event.Attribute), event.Args != nil)
 
 	var result interface{}
 
 	// if we provided Args, it should be callable
 	if event.Args != nil {
 		// Check for the method on a pointer to the value, not the value itself.
-		typ := reflect.TypeOf(instance)
-		iv := reflect.New(typ)
-		iv.Elem().Set(reflect.ValueOf(instance))
-		method := iv.MethodByName(string(event.Attribute))
+		// Instances passed to Polar by pointer are called through that pointer,
+		// so methods with pointer receivers see the original value.
+		var method reflect.Value
+		if fn := reflect.ValueOf(instance); fn.Kind() == reflect.Func && event.Attribute == "Call" {
+			// Functions registered with RegisterFunction are called directly.
+			method = fn
+		} else {
+			iv := reflect.ValueOf(instance)
+			if iv.Kind() != reflect.Ptr {
+				iv = reflect.New(reflect.TypeOf(instance))
+				iv.Elem().Set(reflect.ValueOf(instance))
+			}
+			method = iv.MethodByName(string(event.Attribute))
+		}
 
 		if !method.IsValid() {
-			q.ffiQuery.ApplicationError((errors.NewMissingAttributeError(instance, string(event.Attribute))).Error())
-			q.ffiQuery.CallResult(event.CallId, nil)
-			return nil
+			return q.failCall(event.CallId, errors.NewMissingAttributeError(instance, string(event.Attribute)))
 		}
+		if err := q.host.CheckMethod(instance, string(event.Attribute)); err != nil {
+			return q.failCall(event.CallId, err)
+		}
+		q.recordExternalCall(event, instance)
 		if method.Kind() == reflect.Func {
-			results, err := q.host.CallFunction(method, *event.Args)
+			results, err := q.host.CallFunctionWithContext(q.ctx, method, *event.Args)
 			if err != nil {
-				return &errors.ErrorWithAdditionalInfo{Inner: errors.NewInvalidCallError(instance, string(event.Attribute)), Info: err.Error()}
+				callErr := &errors.ErrorWithAdditionalInfo{Inner: errors.NewInvalidCallError(instance, string(event.Attribute)), Info: err.Error()}
+				// A panic in the method fails the query like an error it
+				// returned, rather than the program.
+				if _, ok := err.(*errors.PanicError); ok {
+					return q.failCall(event.CallId, callErr)
+				}
+				return callErr
+			}
+
+			// A trailing error result is reported as an application error
+			// if it is non-nil, and dropped from the results otherwise.
+			// Errors of classes registered with ErrorValue replace the
+			// results instead, so that the policy can match them.
+			if n := method.Type().NumOut(); n > 0 && method.Type().Out(n-1) == errorType {
+				err, _ := results[n-1].Interface().(error)
+				switch {
+				case err == nil:
+					results = results[:n-1]
+				case q.host.IsErrorValue(err):
+					results = results[n-1:]
+				default:
+					return q.failCall(event.CallId, &errors.ErrorWithAdditionalInfo{Inner: errors.NewInvalidCallError(instance, string(event.Attribute)), Info: err.Error()})
+				}
 			}
 
-			// maybe: This is kind of odd, maybe error instead if len(results) > 1
-			// Right now if you called a function that returns an error you'll get back
-			// a list [result, nil] or something.
-			// It does work the same way in python if you return a tuple though so maybe it's fine.
-			// You could destructure it in polar if you want.
+			// Multiple results are returned to Polar as a list, which can be
+			// destructured in the policy.
 			if len(results) == 1 {
 				result = results[0].Interface()
 			} else {
@@ -191,15 +706,38 @@ func (q Query) handleExternalCall(event types.QueryEventExternalCall) error {
 		} else {
 			return errors.NewInvalidCallError(instance, string(event.Attribute))
 		}
+	} else if attributer, ok := asPolarAttributer(instance); ok {
+		q.recordExternalCall(event, instance)
+		attr, err := attributer.GetPolarAttribute(string(event.Attribute))
+		if err != nil {
+			return q.failCall(event.CallId, &errors.ErrorWithAdditionalInfo{Inner: errors.NewMissingAttributeError(instance, string(event.Attribute)), Info: err.Error()})
+		}
+		result = attr
 	} else {
 		// look up field
-		attr := reflect.ValueOf(instance).FieldByName(string(event.Attribute))
-		if !attr.IsValid() {
-			q.ffiQuery.ApplicationError((errors.NewMissingAttributeError(instance, string(event.Attribute))).Error())
-			q.ffiQuery.CallResult(event.CallId, nil)
-			return nil
+		iv := reflect.Indirect(reflect.ValueOf(instance))
+		var field reflect.StructField
+		ok := iv.Kind() == reflect.Struct
+		if ok {
+			field, ok = q.host.FieldForAttribute(iv.Type(), string(event.Attribute))
+		}
+		if !ok {
+			if !q.host.UnknownAttributesAsNil() {
+				return q.failCall(event.CallId, errors.NewMissingAttributeError(instance, string(event.Attribute)))
+			}
+			// Unknown fields are looked up as nil.
+			q.recordExternalCall(event, instance)
+		} else {
+			if err := q.host.CheckField(instance, field.Name); err != nil {
+				return q.failCall(event.CallId, err)
+			}
+			q.recordExternalCall(event, instance)
+			attr, ok := host.FieldValue(iv, field)
+			if !ok {
+				return q.failCall(event.CallId, errors.NewMissingAttributeError(instance, string(event.Attribute)))
+			}
+			result = attr.Interface()
 		}
-		result = attr.Interface()
 	}
 
 	polarValue, err := q.host.ToPolar(result)
@@ -208,7 +746,42 @@ func (q Query) handleExternalCall(event types.QueryEventExternalCall) error {
 	}
 	return q.ffiQuery.CallResult(event.CallId, &Term{*polarValue})
 }
+
+// Record an external call, if the query is recording them.
+func (q Query) recordExternalCall(event types.QueryEventExternalCall, instance interface{}) {
+	if q.externalCalls == nil {
+		return
+	}
+	call := ExternalCall{
+		Class:    q.host.ClassOf(event.Instance, instance),
+		Name:     string(event.Attribute),
+		IsMethod: event.Args != nil,
+	}
+	if name, ok := q.host.FunctionName(event.Instance); ok && call.IsMethod && call.Name == "Call" {
+		call.Class, call.Name = "", name
+	}
+	*q.externalCalls = append(*q.externalCalls, call)
+}
+
+// Fail an external call with an application error, which Polar raises in the
+// query.
+func (q Query) failCall(callID uint64, err error) error {
+	if appErr := q.ffiQuery.ApplicationError(err.Error()); appErr != nil {
+		return appErr
+	}
+	return q.ffiQuery.CallResult(callID, nil)
+}
+
 func (q Query) handleExternalIsa(event types.QueryEventExternalIsa) error {
+	if q.tracer.logger != nil {
+		instance, _ := q.host.ToGo(event.Instance)
+		q.trace(TraceEvent{
+			Kind:      TraceExternalIsa,
+			Message:   fmt.Sprintf("checking whether %s matches %s", q.host.ClassOf(event.Instance, instance), event.ClassTag),
+			Instance:  instance,
+			Attribute: string(event.ClassTag),
+		})
+	}
 	isa, err := q.host.Isa(event.Instance, string(event.ClassTag))
 	if err != nil {
 		return err
@@ -245,9 +818,44 @@ func (q Query) handleExternalOp(event types.QueryEventExternalOp) error {
 		return err
 	}
 
+	// Instances passed to Polar by pointer are compared by value.
+	left, right = derefInstance(left), derefInstance(right)
+	op := event.Operator.OperatorVariant
+	if q.tracer.logger != nil {
+		message := fmt.Sprintf("comparing %s %s %s", q.host.ClassOf(event.Args[0], left), operatorName(event.Operator), q.host.ClassOf(event.Args[1], right))
+		q.trace(TraceEvent{Kind: TraceExternalOp, Message: message})
+	}
+	if equals, ok := q.host.EqualsFunc(left, right); ok {
+		switch op.(type) {
+		case OperatorEq:
+			return q.answer(event, equals(left, right))
+		case OperatorNeq:
+			return q.answer(event, !equals(left, right))
+		}
+	}
+	if t, ok := left.(time.Time); ok {
+		left = timeComparer(t)
+	}
+	if t, ok := right.(time.Time); ok {
+		right = timeComparer(t)
+	}
+	if b, ok := toBasicComparer(left); ok {
+		left = b
+		// Compare plain values with named basic types as basic values too,
+		// so that every ordering works in both directions.
+		if b, ok := plainBasicComparer(right); ok {
+			right = b
+		}
+	}
+	if b, ok := toBasicComparer(right); ok {
+		right = b
+		if b, ok := plainBasicComparer(left); ok {
+			left = b
+		}
+	}
+
 	leftCmp, leftOk := left.(interfaces.Comparer)
 	rightCmp, rightOk := right.(interfaces.Comparer)
-	op := event.Operator.OperatorVariant
 
 	// this logic is kind of weird!
 	// the reason why we need so many different comparison
@@ -271,6 +879,144 @@ func (q Query) handleExternalOp(event types.QueryEventExternalOp) error {
 	return q.handleCmp(event, left, op, right)
 }
 
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+func derefInstance(v interface{}) interface{} {
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		return rv.Elem().Interface()
+	}
+	return v
+}
+
+// Compares time.Time values by the instant they represent, so two times in
+// different locations are equal if they refer to the same moment.
+type timeComparer time.Time
+
+func (t timeComparer) toTime(other interface{}) (time.Time, bool) {
+	switch other := other.(type) {
+	case time.Time:
+		return other, true
+	case timeComparer:
+		return time.Time(other), true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func (t timeComparer) Equal(other interface{}) bool {
+	o, ok := t.toTime(other)
+	return ok && time.Time(t).Equal(o)
+}
+
+func (t timeComparer) Lt(other interface{}) bool {
+	o, ok := t.toTime(other)
+	return ok && time.Time(t).Before(o)
+}
+
+// Compares values of named types with a basic underlying kind, such as
+// `type Role string`, by their underlying value. These are passed to Polar as
+// instances of their class so they can be matched against it, but should still
+// compare equal to the plain strings, numbers and booleans they represent.
+type basicComparer struct {
+	value interface{}
+}
+
+func toBasicComparer(v interface{}) (basicComparer, bool) {
+	if _, ok := v.(interfaces.Comparer); ok || v == nil {
+		return basicComparer{}, false
+	}
+	typ := reflect.TypeOf(v)
+	if typ.PkgPath() == "" {
+		// Not a named type.
+		return basicComparer{}, false
+	}
+	value, ok := basicValue(v)
+	return basicComparer{value}, ok
+}
+
+// Wraps a string, bool or number converted from Polar in a basicComparer.
+func plainBasicComparer(v interface{}) (basicComparer, bool) {
+	switch v.(type) {
+	case string, bool, int64, float64:
+		return basicComparer{v}, true
+	}
+	return basicComparer{}, false
+}
+
+// Returns the underlying value of v as a string, bool, int64 or float64.
+func basicValue(v interface{}) (interface{}, bool) {
+	if b, ok := v.(basicComparer); ok {
+		return b.value, true
+	}
+	if v == nil {
+		return nil, false
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String:
+		return rv.String(), true
+	case reflect.Bool:
+		return rv.Bool(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	default:
+		return nil, false
+	}
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	default:
+		return 0, false
+	}
+}
+
+func (b basicComparer) Equal(other interface{}) bool {
+	o, ok := basicValue(other)
+	if !ok {
+		return false
+	}
+	if l, ok := b.value.(int64); ok {
+		if r, ok := o.(int64); ok {
+			return l == r
+		}
+	}
+	if l, ok := toFloat(b.value); ok {
+		r, ok := toFloat(o)
+		return ok && l == r
+	}
+	return b.value == o
+}
+
+func (b basicComparer) Lt(other interface{}) bool {
+	o, ok := basicValue(other)
+	if !ok {
+		return false
+	}
+	if l, ok := b.value.(int64); ok {
+		if r, ok := o.(int64); ok {
+			return l < r
+		}
+	}
+	if l, ok := toFloat(b.value); ok {
+		r, ok := toFloat(o)
+		return ok && l < r
+	}
+	if l, ok := b.value.(string); ok {
+		r, ok := o.(string)
+		return ok && l < r
+	}
+	return false
+}
+
 func (q Query) answer(ev types.QueryEventExternalOp, b bool) error {
 	return q.ffiQuery.QuestionResult(ev.CallId, b)
 }
@@ -361,15 +1107,14 @@ func (q Query) handleNextExternal(event types.QueryEventNextExternal) error {
 		if err != nil {
 			return err
 		}
-		if iter, ok := instance.(interfaces.Iterator); ok {
-			q.calls[event.CallId] = iter.Iter()
-		} else {
+		next, ok := iterate(instance)
+		if !ok {
 			return errors.NewInvalidIteratorError(instance)
 		}
+		q.calls[event.CallId] = next
 	}
 
-	iter := q.calls[event.CallId]
-	nextValue, ok := <-iter
+	nextValue, ok := q.calls[event.CallId]()
 	if !ok { // iterator is done
 		return q.ffiQuery.CallResult(event.CallId, nil)
 	}
@@ -380,6 +1125,66 @@ func (q Query) handleNextExternal(event types.QueryEventNextExternal) error {
 	return q.ffiQuery.CallResult(event.CallId, &Term{*retValue})
 }
 
+// Returns a function yielding the values of instance one at a time, if it can
+// be iterated over. Values are only received from channels as Polar asks for
+// them; channels are never closed by the host. Maps yield a [key, value] list
+// for each entry.
+func iterate(instance interface{}) (func() (interface{}, bool), bool) {
+	switch instance := instance.(type) {
+	case interfaces.Iterator:
+		iter := instance.Iter()
+		return func() (interface{}, bool) {
+			v, ok := <-iter
+			return v, ok
+		}, true
+	case interfaces.Nexter:
+		return instance.Next, true
+	}
+	rv := reflect.ValueOf(instance)
+	if rv.Kind() == reflect.Chan && rv.Type().ChanDir()&reflect.RecvDir != 0 {
+		return func() (interface{}, bool) {
+			v, ok := rv.Recv()
+			if !ok {
+				return nil, false
+			}
+			return v.Interface(), true
+		}, true
+	}
+	if rv.Kind() == reflect.Map {
+		keys := sortedMapKeys(rv)
+		return func() (interface{}, bool) {
+			if len(keys) == 0 {
+				return nil, false
+			}
+			key := keys[0]
+			keys = keys[1:]
+			return []interface{}{key.Interface(), rv.MapIndex(key).Interface()}, true
+		}, true
+	}
+	return nil, false
+}
+
+// Returns the keys of a map, sorted if they are numbers or strings so that
+// iterating over the map from a policy is deterministic.
+func sortedMapKeys(m reflect.Value) []reflect.Value {
+	keys := m.MapKeys()
+	var less func(a, b reflect.Value) bool
+	switch m.Type().Key().Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		less = func(a, b reflect.Value) bool { return a.Int() < b.Int() }
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		less = func(a, b reflect.Value) bool { return a.Uint() < b.Uint() }
+	case reflect.Float32, reflect.Float64:
+		less = func(a, b reflect.Value) bool { return a.Float() < b.Float() }
+	case reflect.String:
+		less = func(a, b reflect.Value) bool { return a.String() < b.String() }
+	default:
+		return keys
+	}
+	sort.Slice(keys, func(i, j int) bool { return less(keys[i], keys[j]) })
+	return keys
+}
+
 func (q Query) handleDebug(event types.QueryEventDebug) error {
 	fmt.Printf("%s\n", event.Message)
 
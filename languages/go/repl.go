@@ -0,0 +1,254 @@
+package oso
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/osohq/go-oso/errors"
+	"github.com/osohq/go-oso/internal/util"
+	. "github.com/osohq/go-oso/types"
+	"github.com/peterh/liner"
+)
+
+/*
+Options for the oso repl.
+*/
+type ReplOptions struct {
+	// Print each result and error as a JSON object on its own line, instead
+	// of printing results for humans. No prompts are printed.
+	//
+	// Results are printed as `{"type": "result", "bindings": {...}}`, queries
+	// without results as `{"type": "no_results"}`, and errors as
+	// `{"type": "ParseError", "message": "..."}`.
+	JSON bool
+
+	// Append each query to the file at this path, creating it if necessary.
+	// Repl always keeps its history in ~/.oso_history.
+	HistoryFile string
+}
+
+type replPrinter interface {
+	prompt(continuation bool) string
+	printError(err error)
+	printResults(results []map[string]interface{})
+}
+
+// A source of REPL input lines.
+type replInput interface {
+	// Displays prompt, if it is not empty, and reads a line. Like
+	// bufio.Reader.ReadString, returns io.EOF along with the last line if it
+	// isn't terminated by a newline.
+	readLine(prompt string) (string, error)
+	// Records a complete query, which may be recalled by later reads.
+	addHistory(query string)
+}
+
+// Reads lines from a plain reader, echoing prompts to out.
+type readerInput struct {
+	reader *bufio.Reader
+	out    io.Writer
+}
+
+func (r readerInput) readLine(prompt string) (string, error) {
+	fmt.Fprint(r.out, prompt)
+	return r.reader.ReadString('\n')
+}
+
+func (r readerInput) addHistory(query string) {}
+
+// Reads lines from the terminal with line editing, so that earlier queries can
+// be recalled with the arrow keys.
+type linerInput struct {
+	state *liner.State
+}
+
+func (l linerInput) readLine(prompt string) (string, error) {
+	return l.state.Prompt(prompt)
+}
+
+func (l linerInput) addHistory(query string) {
+	l.state.AppendHistory(query)
+}
+
+// Run the REPL, reading queries from in and writing results to out. A query may
+// span several lines: lines are accumulated until the query parses, a line
+// ends with a semicolon, or a blank line is entered. Each query is added to the
+// input's history and appended to history, if it is not nil.
+func (p *Polar) repl(in replInput, out io.Writer, history io.Writer, opts ReplOptions, files ...string) error {
+	if len(files) > 0 {
+		if err := p.loadFiles(files); err != nil {
+			return err
+		}
+	}
+	var printer replPrinter = textPrinter{out}
+	if opts.JSON {
+		printer = jsonPrinter{out}
+	}
+	var lines []string
+	for {
+		line, err := in.readLine(printer.prompt(len(lines) > 0))
+		if err != nil && err != io.EOF {
+			return err
+		}
+		eof := err == io.EOF
+		if eof && strings.TrimSpace(line) == "" && len(lines) == 0 {
+			return nil
+		}
+		blank := strings.TrimSpace(line) == ""
+		if blank && len(lines) == 0 {
+			continue
+		}
+		if !blank {
+			lines = append(lines, util.QueryStrip(line))
+		}
+		terminated := eof || blank || strings.HasSuffix(strings.TrimSpace(line), ";")
+		text := strings.Join(lines, "\n")
+
+		query, err := p.queryStr(text)
+		if err != nil && !terminated && isIncomplete(err) {
+			continue
+		}
+		lines = nil
+		entry := strings.Replace(text, "\n", " ", -1)
+		in.addHistory(entry)
+		if history != nil {
+			fmt.Fprintln(history, entry)
+		}
+		if err != nil {
+			printer.printError(err)
+			continue
+		}
+		results, err := query.GetAllResults()
+		if err != nil {
+			printer.printError(err)
+			continue
+		}
+		printer.printResults(results)
+	}
+}
+
+// Reports whether err is a parse error caused by the end of the input being
+// reached before the query was complete.
+func isIncomplete(err error) bool {
+	polarErr, ok := err.(*errors.FormattedPolarError)
+	if !ok {
+		return false
+	}
+	parseErr, ok := polarErr.Kind.ErrorKindVariant.(ErrorKindParse)
+	if !ok {
+		return false
+	}
+	_, ok = parseErr.ParseErrorVariant.(ParseErrorUnrecognizedEOF)
+	return ok
+}
+
+type textPrinter struct {
+	out io.Writer
+}
+
+func (p textPrinter) prompt(continuation bool) string {
+	if continuation {
+		return "  ...> "
+	}
+	return "query> "
+}
+
+func (p textPrinter) printError(err error) {
+	fmt.Fprintln(p.out, err)
+}
+
+func (p textPrinter) printResults(results []map[string]interface{}) {
+	if len(results) == 0 {
+		fmt.Fprintln(p.out, false)
+		return
+	}
+	for _, bindings := range results {
+		if len(bindings) == 0 {
+			fmt.Fprintln(p.out, true)
+			continue
+		}
+		// print bindings in a stable order
+		keys := make([]string, 0, len(bindings))
+		for k := range bindings {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			switch v := bindings[k].(type) {
+			// print strings with quotes but not variables or other types represented by strings
+			case string:
+				fmt.Fprintf(p.out, "%v = %#v\n", k, v)
+			default:
+				fmt.Fprintf(p.out, "%v = %v\n", k, v)
+			}
+		}
+	}
+}
+
+type jsonPrinter struct {
+	out io.Writer
+}
+
+func (p jsonPrinter) prompt(continuation bool) string {
+	return ""
+}
+
+func (p jsonPrinter) print(v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(map[string]string{"type": "Error", "message": err.Error()})
+	}
+	fmt.Fprintln(p.out, string(b))
+}
+
+func (p jsonPrinter) printError(err error) {
+	message := err.Error()
+	if polarErr, ok := err.(*errors.FormattedPolarError); ok {
+		message = polarErr.Formatted
+	}
+	p.print(map[string]string{"type": errorKindName(err), "message": message})
+}
+
+func (p jsonPrinter) printResults(results []map[string]interface{}) {
+	if len(results) == 0 {
+		p.print(map[string]string{"type": "no_results"})
+		return
+	}
+	for _, bindings := range results {
+		converted := make(map[string]interface{}, len(bindings))
+		for k, v := range bindings {
+			// Fall back to the printed value for values JSON can't represent.
+			if _, err := json.Marshal(v); err != nil {
+				v = fmt.Sprint(v)
+			}
+			converted[k] = v
+		}
+		p.print(map[string]interface{}{"type": "result", "bindings": converted})
+	}
+}
+
+// Returns the name of the kind of err, e.g. "ParseError" for Polar parse
+// errors or "DuplicateFileLoadError".
+func errorKindName(err error) string {
+	if polarErr, ok := err.(*errors.FormattedPolarError); ok {
+		switch polarErr.Kind.ErrorKindVariant.(type) {
+		case ErrorKindParse:
+			return "ParseError"
+		case ErrorKindRuntime:
+			return "RuntimeError"
+		case ErrorKindOperational:
+			return "OperationalError"
+		case ErrorKindValidation:
+			return "ValidationError"
+		}
+	}
+	if name := reflect.Indirect(reflect.ValueOf(err)).Type().Name(); name != "" {
+		return name
+	}
+	return "Error"
+}
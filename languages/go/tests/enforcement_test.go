@@ -1,7 +1,9 @@
 package oso_test
 
 import (
+	"fmt"
 	"reflect"
+	"sync"
 	"testing"
 
 	oso "github.com/osohq/go-oso"
@@ -187,6 +189,17 @@ func TestAuthorizedActions(t *testing.T) {
 		t.Fatal("Expected an error from AuthorizedActions")
 	}
 
+	o.ClearRules()
+
+	o.LoadString("allow(_actor: User{Name: \"John\"}, \"READ\", _resource: Widget{Id: 1}); " +
+		"allow(_actor: User{Name: \"John\"}, _action, _resource: Widget{Id: 1});")
+
+	res, err = o.AuthorizedActions(actor, resource, true)
+	if err != nil {
+		t.Fatalf("Failed to get allowed actions: %v", err)
+	}
+	assertSetEqual(t, res, []string{"*"})
+
 	res, err = o.AuthorizedActions(actor, Widget{Id: 2}, false)
 	if err != nil {
 		t.Fatalf("Failed to get allowed actions: %v", err)
@@ -196,6 +209,63 @@ func TestAuthorizedActions(t *testing.T) {
 	}
 }
 
+type Repo struct {
+	Name string
+}
+
+type RepoRole struct {
+	Name string
+	Repo string
+}
+
+type RepoUser struct {
+	Roles []RepoRole
+}
+
+func TestAuthorizedActionsWithRoles(t *testing.T) {
+	o := getOso(t)
+	o.RegisterClass(reflect.TypeOf(Repo{}), nil)
+	o.RegisterClass(reflect.TypeOf(RepoUser{}), nil)
+
+	err := o.LoadString(`
+		actor RepoUser {}
+
+		resource Repo {
+			permissions = ["read", "push", "delete"];
+			roles = ["reader", "writer", "admin"];
+
+			"read" if "reader";
+			"push" if "writer";
+			"delete" if "admin";
+			"reader" if "writer";
+		}
+
+		has_role(user: RepoUser, name: String, repo: Repo) if
+			role in user.Roles and role.Name = name and role.Repo = repo.Name;
+
+		allow(actor, action, resource) if has_permission(actor, action, resource);`)
+	if err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+
+	repo := Repo{Name: "oso"}
+	tests := []struct {
+		roles    []RepoRole
+		expected []string
+	}{
+		{[]RepoRole{{"reader", "oso"}}, []string{"read"}},
+		{[]RepoRole{{"writer", "oso"}}, []string{"read", "push"}},
+		{[]RepoRole{{"writer", "oso"}, {"admin", "oso"}}, []string{"read", "push", "delete"}},
+		{[]RepoRole{{"admin", "other"}}, []string{}},
+	}
+	for _, test := range tests {
+		res, err := o.AuthorizedActions(RepoUser{Roles: test.roles}, repo, false)
+		if err != nil {
+			t.Fatalf("Failed to get allowed actions: %v", err)
+		}
+		assertSetEqual(t, res, test.expected)
+	}
+}
 func TestAuthorizedFields(t *testing.T) {
 	o := getOso(t)
 	var res map[interface{}]struct{}
@@ -229,6 +299,214 @@ func TestAuthorizedFields(t *testing.T) {
 	// Guests should be able to read public fields
 	res, _ = o.AuthorizedFields(guest, "read", widget, false)
 	assertSetEqual(t, res, []string{"name", "purpose"})
+
+	o.ClearRules()
+
+	// Admins can read any field
+	o.LoadString("allow_field(actor: User, \"read\", _widget: Widget, _field) if " +
+		"  actor.Name = \"admin\";")
+
+	res, err := o.AuthorizedFields(admin, "read", widget, true)
+	if err != nil {
+		t.Fatalf("Failed to get allowed fields: %v", err)
+	}
+	assertSetEqual(t, res, []string{"*"})
+	if _, err = o.AuthorizedFields(admin, "read", widget, false); err == nil {
+		t.Fatal("Expected an error from AuthorizedFields")
+	}
+	res, err = o.AuthorizedFields(guest, "read", widget, false)
+	if err != nil {
+		t.Fatalf("Failed to get allowed fields: %v", err)
+	}
+	if res == nil || len(res) != 0 {
+		t.Error("expected empty set of fields", res)
+	}
+}
+
+func TestConcurrentIsAllowed(t *testing.T) {
+	o := getOso(t)
+
+	if err := o.LoadString("allow(actor: User, \"read\", widget: Widget) if " +
+		"actor.Name = \"admin\" or widget.Id = 0;"); err != nil {
+		t.Fatalf("LoadString returned error: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			actor := User{Name: "guest"}
+			if i%2 == 0 {
+				actor.Name = "admin"
+			}
+			widget := Widget{Id: i % 3}
+			allowed, err := o.IsAllowed(actor, "read", widget)
+			if err != nil {
+				errs <- err
+			} else if expected := i%2 == 0 || i%3 == 0; allowed != expected {
+				errs <- fmt.Errorf("IsAllowed(%v, %v): expected %v, got %v", actor, widget, expected, allowed)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestConcurrentRegistration(t *testing.T) {
+	o := getOso(t)
+
+	if err := o.LoadString("allow(actor: User, \"read\", _: Widget) if actor.Name = \"admin\";"); err != nil {
+		t.Fatalf("LoadString returned error: %v", err)
+	}
+
+	// Register classes and constants while other goroutines query.
+	const n = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, 3*n)
+	for i := 0; i < n; i++ {
+		wg.Add(3)
+		go func(i int) {
+			defer wg.Done()
+			if err := o.RegisterClassWithName(reflect.TypeOf(Company{}), nil, fmt.Sprintf("Company%d", i)); err != nil {
+				errs <- err
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			if err := o.RegisterConstant(&User{Name: fmt.Sprintf("user%d", i)}, fmt.Sprintf("User%d", i)); err != nil {
+				errs <- err
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			if allowed, err := o.IsAllowed(User{Name: "admin"}, "read", Widget{Id: i}); err != nil {
+				errs <- err
+			} else if !allowed {
+				errs <- fmt.Errorf("Expected admin to be allowed to read widget %d", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	classes := make(map[string]bool)
+	for _, name := range o.RegisteredClasses() {
+		classes[name] = true
+	}
+	constants := make(map[string]bool)
+	for _, name := range o.RegisteredConstants() {
+		constants[name] = true
+	}
+	for i := 0; i < n; i++ {
+		if name := fmt.Sprintf("Company%d", i); !classes[name] {
+			t.Errorf("Expected %s to be registered", name)
+		}
+		if name := fmt.Sprintf("User%d", i); !constants[name] {
+			t.Errorf("Expected %s to be registered", name)
+		}
+	}
+}
+
+func TestResultCache(t *testing.T) {
+	o := getOso(t)
+	o.EnableResultCache(2)
+
+	o.LoadString("allow(actor: User, \"read\", _: Widget) if actor.Name = \"admin\";")
+
+	admin := User{Name: "admin"}
+	guest := User{Name: "guest"}
+	check := func(actor User, widget Widget, expected bool) {
+		if allowed, err := o.IsAllowed(actor, "read", widget); err != nil {
+			t.Errorf("IsAllowed returned error: %v", err)
+		} else if allowed != expected {
+			t.Errorf("IsAllowed(%v, %v): expected %v, got %v", actor, widget, expected, allowed)
+		}
+	}
+	checkStats := func(hits, misses uint64) {
+		if stats := o.ResultCacheStats(); stats != (oso.CacheStats{Hits: hits, Misses: misses}) {
+			t.Errorf("Expected %v hits and %v misses, got %+v", hits, misses, stats)
+		}
+	}
+
+	check(admin, Widget{Id: 1}, true)
+	check(admin, Widget{Id: 1}, true)
+	check(guest, Widget{Id: 1}, false)
+	checkStats(1, 2)
+
+	// Least recently used results are evicted.
+	check(admin, Widget{Id: 2}, true)
+	check(admin, Widget{Id: 1}, true)
+	checkStats(1, 4)
+
+	// Loading a policy clears the cache.
+	o.ClearRules()
+	o.LoadString("allow(_: User, \"read\", _: Widget);")
+	check(guest, Widget{Id: 1}, true)
+	checkStats(1, 5)
+
+	// So does changing how attributes are looked up.
+	o.ClearRules()
+	o.LoadString("allow(_: User, \"read\", widget: Widget) if widget.Archived = nil;")
+	o.TreatUnknownAttributesAsNil(true)
+	check(guest, Widget{Id: 1}, true)
+	o.TreatUnknownAttributesAsNil(false)
+	if _, err := o.IsAllowed(guest, "read", Widget{Id: 1}); err == nil {
+		t.Error("Expected looking up an unknown field to fail once it is no longer treated as nil")
+	}
+	checkStats(1, 7)
+
+	o.EnableResultCache(0)
+	check(guest, Widget{Id: 1}, true)
+	checkStats(0, 0)
+}
+
+// Formats every Badge the same way with %#v.
+type Badge struct {
+	Level int
+}
+
+func (Badge) GoString() string {
+	return "Badge{}"
+}
+
+type Holder struct {
+	Badge *Badge
+}
+
+func TestResultCacheKeys(t *testing.T) {
+	o := getOso(t)
+	o.EnableResultCache(10)
+	o.RegisterClass(reflect.TypeOf(Badge{}), nil)
+	o.RegisterClass(reflect.TypeOf(Holder{}), nil)
+	o.LoadString("allow(_, \"read\", b: Badge) if b.Level > 1; allow(_, \"read\", h: Holder) if h.Badge.Level > 1;")
+
+	check := func(resource interface{}, expected bool) {
+		if allowed, err := o.IsAllowed("alice", "read", resource); err != nil {
+			t.Errorf("IsAllowed returned error: %v", err)
+		} else if allowed != expected {
+			t.Errorf("IsAllowed(%#v): expected %v, got %v", resource, expected, allowed)
+		}
+	}
+
+	// Values that GoString formats the same way get their own results.
+	check(Badge{Level: 1}, false)
+	check(Badge{Level: 2}, true)
+
+	// Pointers are compared by the values they point to, not their addresses.
+	check(Holder{Badge: &Badge{Level: 2}}, true)
+	check(Holder{Badge: &Badge{Level: 2}}, true)
+	check(Holder{Badge: &Badge{Level: 1}}, false)
+	if stats := o.ResultCacheStats(); stats != (oso.CacheStats{Hits: 1, Misses: 4}) {
+		t.Errorf("Expected 1 hit and 4 misses, got %+v", stats)
+	}
 }
 
 func TestCustomReadAction(t *testing.T) {
@@ -246,6 +524,37 @@ func TestCustomReadAction(t *testing.T) {
 	assertAuthorizationError(t, err, false)
 }
 
+func TestNewOsoOptions(t *testing.T) {
+	var o oso.Oso
+	var err error
+	var events []oso.TraceEvent
+	o, err = oso.NewOso(
+		oso.WithReadAction("fetch"),
+		oso.WithNotFoundError(func() error { return &CustomError{true} }),
+		oso.WithResultCache(10),
+		oso.WithLogger(func(event oso.TraceEvent) { events = append(events, event) }),
+	)
+	if err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	o.LoadString("allow(\"graham\", \"fetch\", \"bar\");")
+
+	if custom, ok := o.Authorize("sam", "frob", "bar").(*CustomError); !ok || !custom.IsNotFound {
+		t.Error("Expected Authorize to return a not found CustomError")
+	}
+	assertAuthorizationError(t, o.Authorize("graham", "frob", "bar"), false)
+	if allowed, err := o.IsAllowed("graham", "fetch", "bar"); err != nil || !allowed {
+		t.Errorf("Expected IsAllowed to return true, got %v, %v", allowed, err)
+	}
+	if stats := o.ResultCacheStats(); stats.Misses == 0 {
+		t.Errorf("Expected the result cache to be enabled, got %+v", stats)
+	}
+	if len(events) == 0 {
+		t.Error("Expected the logger to receive events")
+	}
+}
+
 type CustomError struct {
 	IsNotFound bool
 }
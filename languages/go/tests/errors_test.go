@@ -0,0 +1,285 @@
+//go:build go1.13
+// +build go1.13
+
+package oso_test
+
+import (
+	stderrors "errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	oso "github.com/osohq/go-oso"
+	"github.com/osohq/go-oso/errors"
+)
+
+// Tests matching the errors Oso returns with errors.Is and errors.As, which
+// need Go 1.13.
+
+func TestLoadFileErrors(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "oso")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var loadErr *errors.PolarFileLoadError
+	missing := filepath.Join(dir, "missing.polar")
+	err = o.LoadFile(missing)
+	if !stderrors.As(err, &loadErr) {
+		t.Fatalf("Expected a PolarFileLoadError, got: %v", err)
+	}
+	if !loadErr.NotFound() || loadErr.Filename() != missing {
+		t.Errorf("Expected a not found error for %s, got: %v", missing, err)
+	}
+	if !stderrors.Is(err, errors.ErrPolarFileNotFound) || !stderrors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected %v to match ErrPolarFileNotFound and os.ErrNotExist", err)
+	}
+
+	directory := filepath.Join(dir, "directory.polar")
+	if err = os.Mkdir(directory, 0755); err != nil {
+		t.Fatal(err)
+	}
+	err = o.LoadFile(directory)
+	if !stderrors.As(err, &loadErr) {
+		t.Fatalf("Expected a PolarFileLoadError, got: %v", err)
+	}
+	if loadErr.NotFound() || stderrors.Is(err, errors.ErrPolarFileNotFound) {
+		t.Errorf("Expected a read error for %s, got: %v", directory, err)
+	}
+
+	err = o.LoadFile(filepath.Join(dir, "missing.txt"))
+	if !stderrors.Is(err, errors.ErrPolarFileExtension) {
+		t.Errorf("Expected the extension to be checked first, got: %v", err)
+	}
+}
+
+func TestErrorsIs(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	err = o.LoadString("?= 1 = 2;")
+	if !stderrors.Is(err, errors.ErrInlineQueryFailed) {
+		t.Errorf("Expected ErrInlineQueryFailed, got: %v", err)
+	}
+	if stderrors.Is(err, errors.ErrParse) {
+		t.Errorf("Expected %v not to match ErrParse", err)
+	}
+
+	err = o.LoadFiles([]string{"test.txt"})
+	if !stderrors.Is(err, errors.ErrPolarFileExtension) {
+		t.Errorf("Expected ErrPolarFileExtension, got: %v", err)
+	}
+
+	err = o.LoadString("f(x) if ;")
+	if !stderrors.Is(err, errors.ErrParse) || !stderrors.Is(err, errors.ErrPolar) {
+		t.Errorf("Expected ErrParse wrapping ErrPolar, got: %v", err)
+	}
+
+	o.RegisterClass(reflect.TypeOf(Foo{}), MakeFooChecked)
+	o.LoadString("f(n) if new Foo(\"x\", n);")
+	_, err = o.QueryRuleOnce("f", -1)
+	if !stderrors.Is(err, errors.ErrInvalidConstructor) {
+		t.Errorf("Expected ErrInvalidConstructor, got: %v", err)
+	}
+}
+
+func TestUnloadFileError(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "oso")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "base.polar")
+	audit := filepath.Join(dir, "audit.polar")
+	if err = ioutil.WriteFile(base, []byte("g(1);"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(audit, []byte("?= g(1);"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = o.LoadFiles([]string{base, audit}); err != nil {
+		t.Fatal(err)
+	}
+	if err = o.UnloadFile(base); !stderrors.Is(err, errors.ErrInlineQueryFailed) {
+		t.Errorf("Expected an InlineQueryFailedError, got %v", err)
+	}
+}
+
+func TestLoadGlobErrors(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "oso")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a policy"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err = o.LoadGlob(filepath.Join(dir, "*.yaml"))
+	if !stderrors.Is(err, errors.ErrNoMatchingPolarFiles) {
+		t.Errorf("Expected a NoMatchingPolarFilesError, got: %v", err)
+	}
+	err = o.LoadGlob(filepath.Join(dir, "*"))
+	if !stderrors.Is(err, errors.ErrPolarFileExtension) {
+		t.Errorf("Expected a PolarFileExtensionError, got: %v", err)
+	}
+}
+
+func TestClosedErrors(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.LoadString("f(1); f(2);"); err != nil {
+		t.Fatal(err)
+	}
+
+	query, err := o.NewQueryFromRule("f", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = o.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = query.Next(); !stderrors.Is(err, errors.ErrClosed) {
+		t.Errorf("Expected ErrClosed from an outstanding query, got: %v", err)
+	}
+	query.Cleanup()
+
+	if err = o.LoadString("g(1);"); !stderrors.Is(err, errors.ErrClosed) {
+		t.Errorf("Expected ErrClosed from LoadString, got: %v", err)
+	}
+	if _, err = o.QueryRuleOnce("f", 1); !stderrors.Is(err, errors.ErrClosed) {
+		t.Errorf("Expected ErrClosed from QueryRuleOnce, got: %v", err)
+	}
+}
+
+func TestDiagnosticParseError(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	diagnostics, err := o.LoadWithDiagnostics("f(1;", "")
+	if err != nil {
+		t.Fatalf("LoadWithDiagnostics failed: %v", err)
+	}
+	if len(diagnostics) != 1 || !stderrors.Is(diagnostics[0].Err, errors.ErrParse) {
+		t.Errorf("Expected a parse error, got %+v", diagnostics)
+	}
+}
+
+func TestReleasedPolarValueError(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	term, err := o.ToPolarValue(User{Name: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.ReleasePolarValue(term)
+	var user User
+	if err = o.FromPolarValue(term, &user); !stderrors.Is(err, errors.ErrUnregisteredInstance) {
+		t.Errorf("Expected an UnregisteredInstanceError decoding a released term, got: %v", err)
+	}
+}
+
+func TestConstantRegistrationError(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	err = o.RegisterConstants(map[string]interface{}{
+		"Delete": "delete",
+		"Huge":   new(big.Int).Lsh(big.NewInt(1), 100),
+	})
+	if !stderrors.Is(err, errors.ErrConstantRegistration) {
+		t.Fatalf("Expected a ConstantRegistrationError, got %v", err)
+	}
+	var registrationErr *errors.ConstantRegistrationError
+	if !stderrors.As(err, &registrationErr) || registrationErr.Name() != "Huge" {
+		t.Errorf("Expected the error to name Huge, got %v", err)
+	}
+}
+
+func TestClassRegistrationErrors(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	if err = o.RegisterClass(reflect.TypeOf(Folder{}), nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{
+		o.RegisterClassWithOptions(reflect.TypeOf(Folder{}), nil, oso.ClassOptions{Methods: []string{"IsOwner"}}),
+		o.RegisterClassWithOptions(reflect.TypeOf(Folder{}), nil, oso.ClassOptions{JSONTags: true}),
+		o.RegisterClass(reflect.TypeOf(Folder{}), func() Folder { return Folder{} }),
+	} {
+		if !stderrors.Is(err, errors.ErrConflictingClassRegistration) {
+			t.Errorf("Expected ConflictingClassRegistrationError, got: %v", err)
+		}
+	}
+
+	if err = o.RegisterClassWithName(reflect.TypeOf(Widget{}), nil, "Gizmo"); err != nil {
+		t.Fatal(err)
+	}
+	err = o.RegisterClassAliases(reflect.TypeOf(Company{}), "Firm", "Gizmo")
+	if !stderrors.Is(err, errors.ErrDuplicateClassAlias) {
+		t.Errorf("Expected a DuplicateClassAliasError, got %v", err)
+	}
+}
+
+func TestKwargsError(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	if err = o.RegisterClassWithName(reflect.TypeOf(Project{}), func(name string) *Project {
+		return &Project{Name: name}
+	}, "PositionalProject"); err != nil {
+		t.Fatal(err)
+	}
+	query, err := o.NewQueryFromStr(`x = new PositionalProject(name: "oso")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = query.GetAllResults(); !stderrors.Is(err, errors.ErrKwargs) {
+		t.Errorf("Expected a KwargsError, got %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package oso_test
+
+import (
+	"reflect"
+	"testing"
+
+	oso "github.com/osohq/go-oso"
+)
+
+type Doc struct {
+	Owner  string
+	Public bool
+	Views  int
+}
+
+func TestAuthorizedFilter(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	o.RegisterClass(reflect.TypeOf(User{}), nil)
+	o.RegisterClass(reflect.TypeOf(Doc{}), nil)
+	err = o.LoadString(`
+		allow(user: User, "read", doc: Doc) if doc.Owner = user.Name;
+		allow(_: User, "read", doc: Doc) if doc.Public = true;
+		allow(_: User, "edit", doc: Doc) if 10 < doc.Views and doc.Owner != "root";
+		allow(_: User, "list", _: Doc);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		action   string
+		expected *oso.Filter
+	}{
+		{"read", &oso.Filter{Op: oso.FilterOr, Children: []*oso.Filter{
+			{Op: oso.FilterEq, Field: "Owner", Value: "alice"},
+			{Op: oso.FilterEq, Field: "Public", Value: true},
+		}}},
+		{"edit", &oso.Filter{Op: oso.FilterAnd, Children: []*oso.Filter{
+			{Op: oso.FilterGt, Field: "Views", Value: int64(10)},
+			{Op: oso.FilterNeq, Field: "Owner", Value: "root"},
+		}}},
+		{"list", &oso.Filter{Op: oso.FilterAnd}},
+		{"delete", &oso.Filter{Op: oso.FilterOr}},
+	}
+	for _, test := range tests {
+		filter, err := o.AuthorizedFilter(User{Name: "alice"}, test.action, "Doc")
+		if err != nil {
+			t.Errorf("%s: %v", test.action, err)
+			continue
+		}
+		if !reflect.DeepEqual(filter, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.action, test.expected, filter)
+		}
+	}
+}
+
+func TestAuthorizedResources(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	o.RegisterClass(reflect.TypeOf(User{}), nil)
+	o.RegisterClass(reflect.TypeOf(Doc{}), nil)
+	err = o.LoadString(`
+		allow(user: User, "read", doc: Doc) if doc.Owner = user.Name;
+		allow(_: User, "read", doc: Doc) if doc.Public = true;
+		allow(_: User, "edit", doc: Doc) if 10 < doc.Views and doc.Owner != "root";
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := User{Name: "alice"}
+	if _, err = o.AuthorizedResources(alice, "read", "Doc"); err == nil {
+		t.Error("Expected an error without a data filtering adapter")
+	}
+
+	docs := []interface{}{
+		Doc{Owner: "alice", Views: 1},
+		Doc{Owner: "bob", Public: true, Views: 20},
+		Doc{Owner: "root", Views: 100},
+		Doc{Owner: "bob", Views: 5},
+		User{Name: "alice"},
+	}
+	o.SetDataFilteringAdapter(oso.NewMemoryAdapter(docs))
+	for _, action := range []string{"read", "edit", "delete"} {
+		resources, err := o.AuthorizedResources(alice, action, "Doc")
+		if err != nil {
+			t.Fatalf("%s: %v", action, err)
+		}
+		expected := []interface{}{}
+		for _, doc := range docs[:4] {
+			if allowed, _ := o.IsAllowed(alice, action, doc); allowed {
+				expected = append(expected, doc)
+			}
+		}
+		if !reflect.DeepEqual(resources, expected) {
+			t.Errorf("%s: expected %v, got %v", action, expected, resources)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+//go:build go1.16
+// +build go1.16
+
+package oso_test
+
+import (
+	"testing"
+	"testing/fstest"
+
+	oso "github.com/osohq/go-oso"
+)
+
+func TestLoadFS(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	fsys := fstest.MapFS{
+		"policies/a.polar":  {Data: []byte("f(1);")},
+		"policies/b.polar":  {Data: []byte("f(2);")},
+		"policies/notes.md": {Data: []byte("not a policy")},
+	}
+
+	if err = o.LoadFS(fsys, "policies/*.md"); err == nil {
+		t.Error("Failed to error on loading non-polar file (.md)")
+	}
+
+	if err = o.LoadFS(fsys, "nothing/*.polar"); err == nil {
+		t.Error("Failed to error on empty match set")
+	}
+
+	if err = o.LoadFS(fsys, "policies/*.polar"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if testQuery, err := o.NewQueryFromStr("f(x)"); err != nil {
+		t.Error(err.Error())
+	} else if results, err := testQuery.GetAllResults(); err != nil {
+		t.Error(err.Error())
+	} else if len(results) != 2 {
+		t.Errorf("Expected 2 results; received: %v", len(results))
+	}
+}
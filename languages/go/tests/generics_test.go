@@ -0,0 +1,171 @@
+//go:build go1.18
+// +build go1.18
+
+package oso_test
+
+import (
+	"reflect"
+	"testing"
+
+	oso "github.com/osohq/go-oso"
+	"github.com/osohq/go-oso/types"
+)
+
+func TestRegisterClassT(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	if err = oso.RegisterClassT[Foo](&o, MakeFoo); err != nil {
+		t.Fatalf("Register class failed: %v", err)
+	}
+	if err = oso.RegisterClassWithNameT[User](&o, nil, "Account"); err != nil {
+		t.Fatalf("Register class failed: %v", err)
+	}
+
+	o.LoadString("f(x: Foo, y: Account) if x.Name = y.Name;")
+
+	if a, e := o.QueryRuleOnce("f", Foo{Name: "sam"}, User{Name: "sam"}); e != nil {
+		t.Error(e.Error())
+	} else if !a {
+		t.Error("Expected generically registered classes to match")
+	}
+}
+
+func TestQueryAll(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = oso.RegisterClassT[User](&o, nil); err != nil {
+		t.Fatalf("Register class failed: %v", err)
+	}
+	if err = o.LoadString(`level(1); level(2); level(3);`); err != nil {
+		t.Fatal(err)
+	}
+
+	query, err := o.NewQueryFromRule("level", types.ValueVariable("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	levels, err := oso.QueryAll[int](query, "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(levels, []int{1, 2, 3}) {
+		t.Errorf("Expected [1 2 3], got %v", levels)
+	}
+
+	users := []*User{{Name: "alice"}, {Name: "bob"}}
+	query, err = o.QueryWithBindings("user in users", map[string]interface{}{"users": users})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := oso.QueryAll[*User](query, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != users[0] || got[1] != users[1] {
+		t.Errorf("Expected the same users back, got %v", got)
+	}
+
+	if query, err = o.NewQueryFromRule("level", types.ValueVariable("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = oso.QueryAll[string](query, "x"); err == nil {
+		t.Error("Expected an error decoding integers into strings")
+	}
+	if query, err = o.NewQueryFromRule("level", types.ValueVariable("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = oso.QueryAll[int](query, "y"); err == nil {
+		t.Error("Expected an error for a variable the query doesn't bind")
+	}
+}
+
+func TestQueryRuleInto(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	err = o.LoadString(`
+		grant("alice", {role: "admin", resource_id: 1});
+		grant("alice", {role: "reader", resource_id: 2});
+		grant("bob", "not a grant");
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type Grant struct {
+		Role       string
+		ResourceID int `json:"resource_id"`
+	}
+	grants, err := oso.QueryRuleInto[Grant](&o, "grant", "g", "alice", types.ValueVariable("g"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Grant{{Role: "admin", ResourceID: 1}, {Role: "reader", ResourceID: 2}}
+	if !reflect.DeepEqual(grants, expected) {
+		t.Errorf("Expected %v, got %v", expected, grants)
+	}
+
+	if _, err = oso.QueryRuleInto[Grant](&o, "grant", "g", "bob", types.ValueVariable("g")); err == nil {
+		t.Error("Expected an error decoding a string into a struct")
+	}
+	if _, err = oso.QueryRuleInto[Grant](&o, "grant", "g", "alice", types.ValueVariable("x")); err == nil {
+		t.Error("Expected an error for a variable the query doesn't bind")
+	}
+}
+
+type Repository[T any] struct {
+	Items []T
+}
+
+func TestRegisterGenericInstantiations(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = oso.RegisterClassT[Repository[User]](&o, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = oso.RegisterClassT[Repository[Widget]](&o, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = oso.RegisterClassWithNameT[Repository[User]](&o, nil, "UserRepository"); err != nil {
+		t.Fatal(err)
+	}
+	if err = o.LoadString(`
+		user_repo(_: Repository_User);
+		widget_repo(_: Repository_Widget);
+		named_user_repo(_: UserRepository);
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	users := Repository[User]{Items: []User{{Name: "alice"}}}
+	widgets := &Repository[Widget]{}
+	tests := []struct {
+		rule     string
+		repo     interface{}
+		expected bool
+	}{
+		{"user_repo", users, true},
+		{"user_repo", widgets, false},
+		{"widget_repo", widgets, true},
+		{"widget_repo", users, false},
+		{"named_user_repo", users, true},
+		{"named_user_repo", widgets, false},
+	}
+	for _, test := range tests {
+		if ok, err := o.QueryRuleOnce(test.rule, test.repo); err != nil || ok != test.expected {
+			t.Errorf("%s(%T): expected %v, got %v, %v", test.rule, test.repo, test.expected, ok, err)
+		}
+	}
+}
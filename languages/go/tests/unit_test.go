@@ -1,11 +1,21 @@
 package oso_test
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	oso "github.com/osohq/go-oso"
+	"github.com/osohq/go-oso/errors"
 	"github.com/osohq/go-oso/internal/ffi"
 	"github.com/osohq/go-oso/internal/host"
 	. "github.com/osohq/go-oso/types"
@@ -32,6 +42,12 @@ func TestLoadFiles(t *testing.T) {
 		t.Error("Failed to error on loading duplicate file")
 	}
 
+	if err = o.LoadFiles([]string{"test.polar", "./other/../test.polar"}); err == nil {
+		t.Error("Failed to error on loading duplicate file via a different path")
+	} else if _, ok := err.(*errors.DuplicateFileLoadError); !ok {
+		t.Errorf("Expected DuplicateFileLoadError, got: %v", err)
+	}
+
 	if err = o.LoadFiles([]string{"test.txt"}); err == nil {
 		t.Error("Failed to error on loading non-polar file (.txt)")
 	}
@@ -39,6 +55,21 @@ func TestLoadFiles(t *testing.T) {
 	if err = o.LoadFiles([]string{"fake.polar"}); err == nil {
 		t.Error("Failed to error on loading non-existent file")
 	}
+
+	if err = o.LoadFiles([]string{"test.polar"}); err != nil {
+		t.Error(err.Error())
+	}
+	if err = o.LoadFiles([]string{"test.polar"}); err == nil {
+		t.Error("Failed to error on loading the same file twice")
+	} else if _, ok := err.(*errors.DuplicateFileLoadError); !ok {
+		t.Errorf("Expected DuplicateFileLoadError, got: %v", err)
+	}
+	if err = o.ClearRules(); err != nil {
+		t.Error(err.Error())
+	}
+	if err = o.LoadFiles([]string{"test.polar"}); err != nil {
+		t.Errorf("Failed to reload file after clearing rules: %v", err)
+	}
 }
 
 // test_load_multiple_files_same_name_different_path
@@ -76,255 +107,2765 @@ func TestLoadMultipleFilesSameNameDifferentPath(t *testing.T) {
 	}
 }
 
-func TestLoadString(t *testing.T) {
+func TestLoadFilesIsAtomic(t *testing.T) {
 	var o oso.Oso
 	var err error
 	if o, err = oso.NewOso(); err != nil {
 		t.Fatalf("Failed to set up Oso: %v", err)
 	}
 
-	if err = o.LoadString("f(1);"); err != nil {
-		t.Error(err.Error())
+	if err = o.LoadFiles([]string{"test.polar", "test.txt"}); err == nil {
+		t.Fatal("Failed to error on loading non-polar file (.txt)")
 	}
 
+	if testQuery, err := o.NewQueryFromStr("f(x)"); err != nil {
+		t.Error(err.Error())
+	} else if results, err := testQuery.GetAllResults(); err != nil {
+		t.Error(err.Error())
+	} else if len(results) != 0 {
+		t.Errorf("Expected no rules to be loaded; received: %v", results)
+	}
 }
 
-func TestClearRules(t *testing.T) {
+func TestReload(t *testing.T) {
 	var o oso.Oso
 	var err error
 	if o, err = oso.NewOso(); err != nil {
 		t.Fatalf("Failed to set up Oso: %v", err)
 	}
 
-	o.LoadString("f(1);")
-	o.ClearRules()
-	results, errors := o.QueryStr("f(x)")
+	dir, err := ioutil.TempDir("", "oso")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	policy := filepath.Join(dir, "reload.polar")
 
-	if err = <-errors; err != nil {
-		t.Error(err.Error())
-	} else {
-		var got []map[string]interface{}
-		for elem := range results {
-			got = append(got, elem)
+	write := func(src string) {
+		if err := ioutil.WriteFile(policy, []byte(src), 0644); err != nil {
+			t.Fatal(err)
 		}
-		if len(got) > 0 {
-			t.Errorf("Received too many results: %v", got)
+	}
+	check := func(arg int, expected bool) {
+		if a, e := o.QueryRuleOnce("f", arg); e != nil {
+			t.Error(e.Error())
+		} else if a != expected {
+			t.Errorf("Expected f(%v) to be %v, got %v", arg, expected, a)
 		}
 	}
+
+	write("f(1);")
+	if err = o.LoadFiles([]string{policy}); err != nil {
+		t.Fatal(err)
+	}
+	check(1, true)
+
+	write("f(2);")
+	if err = o.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	check(1, false)
+	check(2, true)
+
+	// A broken policy leaves the previous rules in place.
+	write("f(3")
+	if err = o.Reload(); err == nil {
+		t.Error("Expected Reload to fail on invalid policy")
+	}
+	check(2, true)
+
+	// So does a policy whose inline query fails.
+	write("f(3); ?= f(4);")
+	if err = o.Reload(); err == nil {
+		t.Error("Expected Reload to fail on a failing inline query")
+	}
+	check(2, true)
+
+	// A query that is already running keeps the policy it was created with.
+	query, err := o.NewQueryFromRule("f", ValueVariable("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer query.Cleanup()
+	write("f(3);")
+	if err = o.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := query.Next(); err != nil {
+		t.Fatal(err)
+	} else if result == nil || (*result)["x"] != int64(2) {
+		t.Errorf("Expected the running query to see f(2), got %v", result)
+	}
+	check(3, true)
 }
 
-func TestQueryStr(t *testing.T) {
+func TestLoadFilesFailingInlineQuery(t *testing.T) {
 	var o oso.Oso
 	var err error
 	if o, err = oso.NewOso(); err != nil {
 		t.Fatalf("Failed to set up Oso: %v", err)
 	}
 
-	o.LoadString("f(1);")
-	results, errors := o.QueryStr("f(x)")
+	dir, err := ioutil.TempDir("", "oso")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	policy := filepath.Join(dir, "inline.polar")
 
-	if err = <-errors; err != nil {
-		t.Error(err.Error())
-	} else {
-		var got []map[string]interface{}
-		expected := map[string]interface{}{"x": int64(1)}
-		for elem := range results {
-			got = append(got, elem)
+	if err = ioutil.WriteFile(policy, []byte("f(1); ?= f(2);"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = o.LoadFiles([]string{policy}); err == nil {
+		t.Fatal("Expected a failing inline query to fail the load")
+	}
+	if a, err := o.QueryRuleOnce("f", 1); err != nil {
+		t.Fatal(err)
+	} else if a {
+		t.Error("Expected the rules of the failed load not to be loaded")
+	}
+
+	// Nothing was loaded, so there is nothing to reload, and the fixed file
+	// loads as if for the first time.
+	if err = ioutil.WriteFile(policy, []byte("f(1); ?= f(1);"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = o.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err = o.LoadFiles([]string{policy}); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := o.QueryRuleOnce("f", 1); err != nil {
+		t.Fatal(err)
+	} else if !a {
+		t.Error("Expected f(1) to hold once the fixed file is loaded")
+	}
+}
+
+func TestUnloadFile(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "oso")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"base.polar":    "f(1); ?= f(1);",
+		"billing.polar": "f(2); g(1);",
+		"audit.polar":   "?= g(1);",
+	}
+	for name, src := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
 		}
-		if len(got) > 1 {
-			t.Errorf("Received too many results: %v", got)
-		} else if !reflect.DeepEqual(got[0], expected) {
-			t.Errorf("Expected: %v, got: %v", expected, got[0])
+	}
+	base := filepath.Join(dir, "base.polar")
+	billing := filepath.Join(dir, "billing.polar")
+	audit := filepath.Join(dir, "audit.polar")
+	check := func(rule string, arg int, expected bool) {
+		if a, e := o.QueryRuleOnce(rule, arg); e != nil {
+			t.Error(e.Error())
+		} else if a != expected {
+			t.Errorf("Expected %s(%v) to be %v, got %v", rule, arg, expected, a)
 		}
 	}
 
-	o.ClearRules()
+	if err = o.LoadFiles([]string{base, billing, audit}); err != nil {
+		t.Fatal(err)
+	}
+	check("f", 2, true)
 
-	o.LoadString("g(x) if x.Fake();")
-	results, errors = o.QueryStr("g(1)")
+	// The inline query in audit.polar fails without billing.polar, so the
+	// policy is left as it was.
+	if err = o.UnloadFile(billing); err == nil {
+		t.Error("Expected unloading billing.polar to fail audit.polar's inline query")
+	}
+	check("f", 2, true)
 
-	if err = <-errors; err == nil {
-		t.Error("Expected Polar runtime error, got none")
+	if err = o.UnloadFile(audit); err != nil {
+		t.Fatal(err)
+	}
+	if err = o.UnloadFile(billing); err != nil {
+		t.Fatal(err)
+	}
+	check("f", 1, true)
+	check("f", 2, false)
+
+	if err = o.UnloadFile(billing); err == nil {
+		t.Error("Expected an error unloading a file that isn't loaded")
 	}
 }
 
-func TestQueryRule(t *testing.T) {
+func TestLoadString(t *testing.T) {
 	var o oso.Oso
 	var err error
 	if o, err = oso.NewOso(); err != nil {
 		t.Fatalf("Failed to set up Oso: %v", err)
 	}
 
-	o.LoadString("f(1, 2);")
-	results, errors := o.QueryRule("f", ValueVariable("x"), ValueVariable("y"))
-
-	if err = <-errors; err != nil {
+	if err = o.LoadString("f(1);"); err != nil {
 		t.Error(err.Error())
-	} else {
-		var got []map[string]interface{}
-		expected := map[string]interface{}{"x": int64(1), "y": int64(2)}
-		for elem := range results {
-			got = append(got, elem)
-		}
-		if len(got) != 1 {
-			t.Errorf("Received incorrect number of results: %v", got)
-		} else if !reflect.DeepEqual(got[0], expected) {
-			t.Errorf("Expected: %v, got: %v", expected, got[0])
-		}
 	}
 
-	o.ClearRules()
-
-	o.LoadString("g(x) if x.Fake();")
-	results, errors = o.QueryRule("g", 1)
+}
 
-	if err = <-errors; err == nil {
-		t.Error("Expected Polar runtime error, got none")
+func TestLoadGlob(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
 	}
 
-	o.ClearRules()
+	dir, err := ioutil.TempDir("", "oso")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
 
-	o.LoadString("h(x) if x = 1; h(x) if x.Fake();")
-	results, errors = o.QueryRule("h", 1)
-	if r := <-results; !reflect.DeepEqual(r, map[string]interface{}{}) {
-		t.Error("Expected result, got none")
+	files := map[string]string{
+		"b.polar":   "f(2);",
+		"a.polar":   "f(1);",
+		"notes.txt": "not a policy",
 	}
-	if e := <-errors; e == nil {
-		t.Error("Expected Polar runtime error, got none")
+	for name, contents := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	results, errors = o.QueryRule("v", 1)
-	if r := <-results; r != nil {
-		t.Error("Got result; expected none")
+	if err = o.LoadGlob(filepath.Join(dir, "*.yaml")); err == nil {
+		t.Error("Expected an error loading a pattern that matches no files")
 	}
-	if e := <-errors; e != nil {
-		t.Error(e)
+	if err = o.LoadGlob(filepath.Join(dir, "*")); err == nil {
+		t.Error("Expected an error loading a pattern that matches a non-polar file")
+	}
+	if err = o.LoadGlob(filepath.Join(dir, "*.polar")); err != nil {
+		t.Fatal(err)
+	}
+	query, err := o.NewQueryFromStr("f(x)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := query.GetAllResults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []map[string]interface{}{{"x": int64(1)}, {"x": int64(2)}}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("Expected %v, got %v", expected, results)
 	}
-
 }
 
-func TestIsAllowed(t *testing.T) {
+func TestLoadParseError(t *testing.T) {
 	var o oso.Oso
 	var err error
 	if o, err = oso.NewOso(); err != nil {
 		t.Fatalf("Failed to set up Oso: %v", err)
 	}
 
-	o.LoadString("allow(\"foo\", \"bar\", \"baz\");")
-	if a, e := o.IsAllowed("foo", "bar", "baz"); e != nil {
-		t.Error(e.Error())
-	} else if !a {
-		t.Error("IsAllowed returned false, expected true")
+	err = o.LoadString("f(1);\ng(x) if x ] 1;")
+	if parseErr, ok := err.(*errors.ParseError); !ok {
+		t.Fatalf("Expected ParseError, got: %v", err)
+	} else if parseErr.Filename != "" || parseErr.Line != 2 || parseErr.Column != 11 || parseErr.Token != "]" {
+		t.Errorf("Unexpected ParseError: %#v", parseErr)
+	} else if _, ok := parseErr.Unwrap().(*errors.FormattedPolarError); !ok {
+		t.Errorf("Expected ParseError to wrap a FormattedPolarError, got: %v", parseErr.Unwrap())
 	}
 
-	if a, e := o.IsAllowed("foo", "baz", "bar"); e != nil {
-		t.Error(e.Error())
-	} else if a {
-		t.Error("IsAllowed returned true, expected false")
+	dir, err := ioutil.TempDir("", "oso")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	policy := filepath.Join(dir, "bad.polar")
+	if err := ioutil.WriteFile(policy, []byte("f(1);\nf(2) f(3);"), 0644); err != nil {
+		t.Fatal(err)
 	}
 
+	err = o.LoadFiles([]string{policy})
+	if parseErr, ok := err.(*errors.ParseError); !ok {
+		t.Fatalf("Expected ParseError, got: %v", err)
+	} else if !strings.HasSuffix(parseErr.Filename, "bad.polar") || parseErr.Line != 2 || parseErr.Column != 6 {
+		t.Errorf("Unexpected ParseError: %#v", parseErr)
+	}
 }
 
-type User struct {
-	Name string
-}
+func TestInlineQueryFailedError(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
 
-type Widget struct {
-	Id int
+	err = o.LoadString("f(1);\n?= f(1);\n?= f(2);")
+	if inlineErr, ok := err.(*errors.InlineQueryFailedError); !ok {
+		t.Fatalf("Expected InlineQueryFailedError, got: %v", err)
+	} else if inlineErr.Source() != "f(2)" || inlineErr.Line() != 3 || inlineErr.Filename() != "" {
+		t.Errorf("Unexpected InlineQueryFailedError: source %q, line %v, filename %q",
+			inlineErr.Source(), inlineErr.Line(), inlineErr.Filename())
+	}
 }
 
-type Company struct {
-	Id int
-}
+func TestClose(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.LoadString("f(1); f(2);"); err != nil {
+		t.Fatal(err)
+	}
 
-type Foo struct {
-	Name string
-	Num  int
-}
+	query, err := o.NewQueryFromRule("f", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = o.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = query.Next(); err == nil {
+		t.Error("Expected an error from an outstanding query")
+	}
+	query.Cleanup()
 
-func MakeFoo(name string, num int) Foo {
-	return Foo{name, num}
+	if err = o.LoadString("g(1);"); err == nil {
+		t.Error("Expected an error from LoadString")
+	}
+	if _, err = o.QueryRuleOnce("f", 1); err == nil {
+		t.Error("Expected an error from QueryRuleOnce")
+	}
+	if err = o.Close(); err != nil {
+		t.Errorf("Expected closing twice to succeed, got: %v", err)
+	}
 }
 
-func TestConstructors(t *testing.T) {
+func TestRuleNamesAndValidate(t *testing.T) {
 	var o oso.Oso
 	var err error
 	if o, err = oso.NewOso(); err != nil {
 		t.Fatalf("Failed to set up Oso: %v", err)
 	}
 
-	o.RegisterClass(reflect.TypeOf(Foo{}), MakeFoo)
-
-	o.LoadString("f(y) if x = new Foo(\"hello\", 123) and y = x.Name;")
-	results, errors := o.QueryRule("f", ValueVariable("y"))
+	o.LoadString("g(); f(1); f(2); allow(_, _, _);")
 
-	if err = <-errors; err != nil {
+	if names, err := o.RuleNames(); err != nil {
 		t.Error(err.Error())
-	} else {
-		var got []map[string]interface{}
-		expected := map[string]interface{}{"y": "hello"}
-		for elem := range results {
-			got = append(got, elem)
-		}
-		if len(got) != 1 {
-			t.Errorf("Received incorrect number of results: %v", got)
-		} else if !reflect.DeepEqual(got[0], expected) {
-			t.Errorf("Expected: %v, got: %v", expected, got[0])
-		}
+	} else if expected := []string{"allow", "f", "g"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %v, got %v", expected, names)
+	}
+
+	if err = o.Validate("allow", "f"); err != nil {
+		t.Errorf("Validate returned error: %v", err)
+	}
+	err = o.Validate("allow", "allwo", "h")
+	if missing, ok := err.(*errors.MissingRulesError); !ok {
+		t.Errorf("Expected MissingRulesError, got: %v", err)
+	} else if expected := []string{"allwo", "h"}; !reflect.DeepEqual(missing.Names(), expected) {
+		t.Errorf("Expected %v to be missing, got %v", expected, missing.Names())
 	}
-	y := reflect.TypeOf(nil)
-	_ = y
-	//o.RegisterClass(reflect.TypeOf(nil), MakeFoo)
 }
 
-func TestExpressionError(t *testing.T) {
+func TestLoadReader(t *testing.T) {
 	var o oso.Oso
 	var err error
-
 	if o, err = oso.NewOso(); err != nil {
 		t.Fatalf("Failed to set up Oso: %v", err)
 	}
 
-	if o.LoadString("f(x) if x > 2;") != nil {
-		t.Fatalf("Load string failed: %v", err)
+	if err = o.LoadReader(strings.NewReader("f(1);"), "reader.polar"); err != nil {
+		t.Error(err.Error())
+	}
+	if a, e := o.QueryRuleOnce("f", 1); e != nil {
+		t.Error(e.Error())
+	} else if !a {
+		t.Error("Expected rule loaded from reader to succeed")
 	}
 
-	_, errors := o.QueryRule("f", ValueVariable("x"))
-	err = <-errors
-
-	msg := err.Error()
-
-	if !strings.Contains(msg, "unbound") {
-		t.Error("Does not contain unbound in error message.")
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.LoadReader(strings.NewReader("g(1"), "broken.polar"); err == nil {
+		t.Error("Failed to error on loading invalid policy")
+	} else if !strings.Contains(err.Error(), "broken.polar") {
+		t.Errorf("Expected error to mention filename, got: %v", err)
 	}
 }
 
-func TestRuleTypes(t *testing.T) {
+func TestPolarVersion(t *testing.T) {
 	var o oso.Oso
 	var err error
-	var msg string
-
 	if o, err = oso.NewOso(); err != nil {
 		t.Fatalf("Failed to set up Oso: %v", err)
 	}
+	version := o.PolarVersion()
+	if parts := strings.Split(version, "."); len(parts) != 3 {
+		t.Errorf("Expected a version like 0.22.1, got %q", version)
+	}
+}
 
-	if err = o.RegisterClass(reflect.TypeOf(User{}), nil); err != nil {
-		t.Fatalf("Register class failed: %v", err)
+func TestLoadStrings(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
 	}
-	if err = o.RegisterClass(reflect.TypeOf(Widget{}), nil); err != nil {
-		t.Fatalf("Register class failed: %v", err)
+	// The inline query depends on a rule from the other fragment.
+	if err = o.LoadStrings([]string{"?= g(1);", "f(1); g(x) if f(x);"}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := o.QueryRuleOnce("g", 1); err != nil || !ok {
+		t.Errorf("Expected g(1) to succeed, got %v, %v", ok, err)
 	}
 
-	policy := "type is_actor(_actor: Actor); is_actor(_actor: Actor);"
-
-	if err = o.LoadString(policy); err != nil {
-		t.Fatalf("Load string failed: %v", err)
+	// More strings can't be loaded alongside the rules, and trying leaves
+	// them in place.
+	if err = o.LoadStrings([]string{"h(1);", "?= h(1);"}); err == nil {
+		t.Error("Expected an error loading more strings alongside the policy")
 	}
-	if err = o.ClearRules(); err != nil {
-		t.Fatalf("Clear rules failed: %v", err)
+	if ok, err := o.QueryRuleOnce("g", 1); err != nil || !ok {
+		t.Errorf("Expected g(1) to still succeed, got %v, %v", ok, err)
 	}
 
-	policy = "type is_actor(_actor: Actor); is_actor(_actor: Widget);"
+	for _, sources := range [][]string{
+		{"f(1);", "?= f(2);"},
+		{"f(1);", "g("},
+	} {
+		if o, err = oso.NewOso(); err != nil {
+			t.Fatalf("Failed to set up Oso: %v", err)
+		}
+		if err = o.LoadStrings(sources); err == nil {
+			t.Errorf("Expected an error loading %v", sources)
+		}
+		if names, err := o.RuleNames(); err != nil || len(names) != 0 {
+			t.Errorf("Expected no rules after loading %v failed, got %v, %v", sources, names, err)
+		}
+	}
+}
+
+func TestLoadStringNamed(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	if err = o.LoadStringNamed("g(1", "templates/broken.polar"); err == nil {
+		t.Error("Failed to error on loading invalid policy")
+	} else if !strings.Contains(err.Error(), "templates/broken.polar") {
+		t.Errorf("Expected parse error to mention the name, got: %v", err)
+	}
+
+	if err = o.LoadStringNamed("f(1); ?= f(2);", "templates/failing.polar"); err == nil {
+		t.Error("Failed to error on a failing inline query")
+	} else if !strings.Contains(err.Error(), "templates/failing.polar") {
+		t.Errorf("Expected inline query error to mention the name, got: %v", err)
+	}
+
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.LoadStringNamed("f(1);", "templates/ok.polar"); err != nil {
+		t.Fatal(err)
+	}
+	if a, e := o.QueryRuleOnce("f", 1); e != nil || !a {
+		t.Errorf("Expected rule loaded from a named string to succeed, got %v, %v", a, e)
+	}
+}
+
+func TestLoadWithDiagnostics(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	policy := "f(x: Foo) if x = 1;\ng(y) if z = 1;"
+	diagnostics, err := o.LoadWithDiagnostics(policy, "bad.polar")
+	if err != nil {
+		t.Fatalf("LoadWithDiagnostics failed: %v", err)
+	}
+	var errs, warnings []oso.Diagnostic
+	for _, d := range diagnostics {
+		if d.Err != nil {
+			errs = append(errs, d)
+		} else {
+			warnings = append(warnings, d)
+		}
+	}
+	if len(errs) != 2 {
+		t.Errorf("Expected errors for both singleton variables, got %v", errs)
+	}
+	for _, d := range errs {
+		if d.Filename != "bad.polar" || d.Line != 2 {
+			t.Errorf("Expected an error on line 2 of bad.polar, got %+v", d)
+		}
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0].Message, "Unknown specializer Foo") {
+		t.Errorf("Expected a warning about Foo, got %v", warnings)
+	}
+	if names, err := o.RuleNames(); err != nil || len(names) != 0 {
+		t.Errorf("Expected nothing to be loaded, got %v, %v", names, err)
+	}
+
+	diagnostics, err = o.LoadWithDiagnostics("f(1;", "")
+	if err != nil {
+		t.Fatalf("LoadWithDiagnostics failed: %v", err)
+	}
+	if len(diagnostics) != 1 || diagnostics[0].Err == nil || diagnostics[0].Line != 1 {
+		t.Errorf("Expected a parse error on line 1, got %+v", diagnostics)
+	}
+
+	if diagnostics, err = o.LoadWithDiagnostics("f(1);", ""); err != nil || len(diagnostics) != 0 {
+		t.Errorf("Expected a valid policy to load cleanly, got %v, %v", diagnostics, err)
+	}
+	if a, e := o.QueryRuleOnce("f", 1); e != nil || !a {
+		t.Errorf("Expected the policy to be loaded, got %v, %v", a, e)
+	}
+}
+
+func TestReplWithIO(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	in := strings.NewReader("f(1)\nf(4)\nf(x) and x > 2\n")
+	var out strings.Builder
+	if err = o.ReplWithIO(in, &out, "test.polar"); err != nil {
+		t.Fatalf("ReplWithIO returned error: %v", err)
+	}
+	expected := "query> true\nquery> false\nquery> x = 3\nquery> "
+	if out.String() != expected {
+		t.Errorf("Expected output %q, got %q", expected, out.String())
+	}
+
+	// Incomplete queries continue on the next line.
+	in = strings.NewReader("f(x) and\nx > 2\nf(x) and\n\nf(x) and\nx < 2;\n")
+	out.Reset()
+	if err = o.ReplWithIO(in, &out); err != nil {
+		t.Fatalf("ReplWithIO returned error: %v", err)
+	}
+	if output := out.String(); !strings.HasPrefix(output, "query>   ...> x = 3\nquery>   ...> Error") ||
+		!strings.HasSuffix(output, "query>   ...> x = 1\nquery> ") {
+		t.Errorf("Unexpected output %q", output)
+	}
+}
+
+func TestReplJSON(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	in := strings.NewReader("f(x) and x > 1\nf(4)\nf(x) and x.y z\n")
+	var out strings.Builder
+	if err = o.ReplWithOptions(in, &out, oso.ReplOptions{JSON: true}, "test.polar"); err != nil {
+		t.Fatalf("ReplWithOptions returned error: %v", err)
+	}
+
+	var got []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var v map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &v); err != nil {
+			t.Fatalf("Failed to parse %q as JSON: %v", line, err)
+		}
+		got = append(got, v)
+	}
+	expected := []map[string]interface{}{
+		{"type": "result", "bindings": map[string]interface{}{"x": 2.0}},
+		{"type": "result", "bindings": map[string]interface{}{"x": 3.0}},
+		{"type": "no_results"},
+	}
+	if len(got) != 4 || !reflect.DeepEqual(got[:3], expected) {
+		t.Fatalf("Expected %v followed by an error, got %v", expected, got)
+	}
+	if got[3]["type"] != "ParseError" || got[3]["message"] == "" {
+		t.Errorf("Expected a ParseError, got %v", got[3])
+	}
+}
+
+func TestReplHistoryFile(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "oso")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	history := filepath.Join(dir, "history")
+
+	// Multi-line queries are recorded on a single line, and each session
+	// appends to the queries already in the file.
+	opts := oso.ReplOptions{HistoryFile: history}
+	if err = o.ReplWithOptions(strings.NewReader("f(x) and\nx > 2\n"), ioutil.Discard, opts, "test.polar"); err != nil {
+		t.Fatalf("ReplWithOptions returned error: %v", err)
+	}
+	if err = o.ReplWithOptions(strings.NewReader("f(1)\n"), ioutil.Discard, opts); err != nil {
+		t.Fatalf("ReplWithOptions returned error: %v", err)
+	}
+	contents, err := ioutil.ReadFile(history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "f(x) and x > 2\nf(1)\n"; string(contents) != expected {
+		t.Errorf("Expected history %q, got %q", expected, string(contents))
+	}
+}
+
+func TestClearRules(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	o.LoadString("f(1);")
+	o.ClearRules()
+	results, errors := o.QueryStr("f(x)")
+
+	if err = <-errors; err != nil {
+		t.Error(err.Error())
+	} else {
+		var got []map[string]interface{}
+		for elem := range results {
+			got = append(got, elem)
+		}
+		if len(got) > 0 {
+			t.Errorf("Received too many results: %v", got)
+		}
+	}
+}
+
+func TestClearRulesDuringQuery(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	o.LoadString("f(1); f(2);")
+	query, err := o.NewQueryFromStr("f(x)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer query.Cleanup()
+	if result, err := query.Next(); err != nil || result == nil {
+		t.Fatalf("Expected a first result, got %v, %v", result, err)
+	}
+	if err = o.ClearRules(); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := query.Next(); err != nil {
+		t.Fatal(err)
+	} else if result == nil || (*result)["x"] != int64(2) {
+		t.Errorf("Expected the running query to keep its rules, got %v", result)
+	}
+	if ok, err := o.QueryRuleOnce("f", 1); err != nil || ok {
+		t.Errorf("Expected new queries to see no rules, got %v, %v", ok, err)
+	}
+}
+
+func TestQueryStr(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	o.LoadString("f(1);")
+	results, errors := o.QueryStr("f(x)")
+
+	if err = <-errors; err != nil {
+		t.Error(err.Error())
+	} else {
+		var got []map[string]interface{}
+		expected := map[string]interface{}{"x": int64(1)}
+		for elem := range results {
+			got = append(got, elem)
+		}
+		if len(got) > 1 {
+			t.Errorf("Received too many results: %v", got)
+		} else if !reflect.DeepEqual(got[0], expected) {
+			t.Errorf("Expected: %v, got: %v", expected, got[0])
+		}
+	}
+
+	o.ClearRules()
+
+	o.LoadString("g(x) if x.Fake();")
+	results, errors = o.QueryStr("g(1)")
+
+	if err = <-errors; err == nil {
+		t.Error("Expected Polar runtime error, got none")
+	}
+}
+
+func TestQueryRule(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	o.LoadString("f(1, 2);")
+	results, errors := o.QueryRule("f", ValueVariable("x"), ValueVariable("y"))
+
+	if err = <-errors; err != nil {
+		t.Error(err.Error())
+	} else {
+		var got []map[string]interface{}
+		expected := map[string]interface{}{"x": int64(1), "y": int64(2)}
+		for elem := range results {
+			got = append(got, elem)
+		}
+		if len(got) != 1 {
+			t.Errorf("Received incorrect number of results: %v", got)
+		} else if !reflect.DeepEqual(got[0], expected) {
+			t.Errorf("Expected: %v, got: %v", expected, got[0])
+		}
+	}
+
+	o.ClearRules()
+
+	o.LoadString("g(x) if x.Fake();")
+	results, errors = o.QueryRule("g", 1)
+
+	if err = <-errors; err == nil {
+		t.Error("Expected Polar runtime error, got none")
+	}
+
+	o.ClearRules()
+
+	o.LoadString("h(x) if x = 1; h(x) if x.Fake();")
+	results, errors = o.QueryRule("h", 1)
+	if r := <-results; !reflect.DeepEqual(r, map[string]interface{}{}) {
+		t.Error("Expected result, got none")
+	}
+	if e := <-errors; e == nil {
+		t.Error("Expected Polar runtime error, got none")
+	}
+
+	results, errors = o.QueryRule("v", 1)
+	if r := <-results; r != nil {
+		t.Error("Got result; expected none")
+	}
+	if e := <-errors; e != nil {
+		t.Error(e)
+	}
+
+}
+
+func TestQueryRuleOnce(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	o.LoadString("f(1); f(1); g(x) if x.Fake();")
+
+	if a, e := o.QueryRuleOnce("f", 1); e != nil {
+		t.Error(e.Error())
+	} else if !a {
+		t.Error("QueryRuleOnce returned false, expected true")
+	}
+
+	if a, e := o.QueryRuleOnce("f", 2); e != nil {
+		t.Error(e.Error())
+	} else if a {
+		t.Error("QueryRuleOnce returned true, expected false")
+	}
+
+	if _, e := o.QueryRuleOnce("g", 1); e == nil {
+		t.Error("Expected Polar runtime error, got none")
+	}
+}
+
+func TestQueryRuleValue(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	o.LoadString(`role_level("admin", 2); role_level("admin", 3); role_level("guest", 0); g(x) if x.Fake();`)
+
+	if level, ok, e := o.QueryRuleValue("role_level", "level", "admin", ValueVariable("level")); e != nil {
+		t.Error(e.Error())
+	} else if !ok {
+		t.Error("QueryRuleValue returned false, expected true")
+	} else if level != int64(2) {
+		t.Errorf("Expected first binding 2, got: %v", level)
+	}
+
+	if level, ok, e := o.QueryRuleValue("role_level", "level", "guest", ValueVariable("level")); e != nil {
+		t.Error(e.Error())
+	} else if !ok || level != int64(0) {
+		t.Errorf("Expected zero binding, got: %v, %v", level, ok)
+	}
+
+	if _, ok, e := o.QueryRuleValue("role_level", "level", "nobody", ValueVariable("level")); e != nil {
+		t.Error(e.Error())
+	} else if ok {
+		t.Error("QueryRuleValue returned true, expected false")
+	}
+
+	if _, ok, e := o.QueryRuleValue("role_level", "other", "admin", ValueVariable("level")); e != nil {
+		t.Error(e.Error())
+	} else if ok {
+		t.Error("QueryRuleValue returned true for an unbound variable, expected false")
+	}
+
+	if _, _, e := o.QueryRuleValue("g", "x", 1); e == nil {
+		t.Error("Expected Polar runtime error, got none")
+	}
+}
+
+func TestQueryContext(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	o.LoadString("f(1); f(2); f(3);")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	query, err := o.NewQueryFromStrContext(ctx, "f(x)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := query.Next(); err != nil {
+		t.Error(err.Error())
+	} else if r == nil {
+		t.Error("Expected result, got none")
+	}
+	cancel()
+	if _, err := query.Next(); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got: %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	query, err = o.NewQueryFromRuleContext(ctx, "f", ValueVariable("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := query.GetAllResults(); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got: %v", err)
+	}
+}
+
+func TestQueryContextRecursion(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	// Searches 2^40 branches without ever calling into Go.
+	o.LoadString(`
+		deep(0);
+		deep(n) if n > 0 and (deep(n - 1) or deep(n - 1));
+		never(n) if deep(n) and false;
+	`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	query, err := o.NewQueryFromRuleContext(ctx, "never", 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := query.Next(); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the query to stop at its deadline, took %v", elapsed)
+	}
+}
+
+type tenantKey struct{}
+
+type Tenant struct {
+	Name string
+}
+
+// Only the tenant named in the context has members.
+func (t Tenant) HasMember(ctx context.Context, user string) bool {
+	current, _ := ctx.Value(tenantKey{}).(string)
+	return current == t.Name && user != ""
+}
+
+type Gauge struct {
+	Reading *int
+}
+
+func (g Gauge) Value() int {
+	return *g.Reading
+}
+
+func TestPanicInMethod(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.RegisterClass(reflect.TypeOf(Gauge{}), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = o.LoadString(`positive(g: Gauge) if g.Value() > 0;`); err != nil {
+		t.Fatal(err)
+	}
+
+	reading := 3
+	if ok, err := o.QueryRuleOnce("positive", Gauge{Reading: &reading}); err != nil || !ok {
+		t.Errorf("Expected the gauge to be positive, got %v, %v", ok, err)
+	}
+
+	// The nil dereference fails the query instead of crashing the test.
+	_, err = o.QueryRuleOnce("positive", Gauge{})
+	if err == nil {
+		t.Fatal("Expected an error from a panicking method")
+	}
+	if !strings.Contains(err.Error(), "nil pointer dereference") {
+		t.Errorf("Expected the error to include the panic, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "Gauge.Value") {
+		t.Errorf("Expected the error to include a stack trace, got %v", err)
+	}
+}
+
+func TestQueryRuleContext(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.RegisterClass(reflect.TypeOf(Tenant{}), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = o.LoadString("member(user, tenant: Tenant) if tenant.HasMember(user);"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), tenantKey{}, "acme")
+	results, errs := o.QueryRuleContext(ctx, "member", "alice", Tenant{Name: "acme"})
+	count := 0
+	for range results {
+		count++
+	}
+	if err = <-errs; err != nil {
+		t.Fatal(err)
+	} else if count != 1 {
+		t.Errorf("Expected 1 result, got %d", count)
+	}
+
+	results, errs = o.QueryRuleContext(ctx, "member", "alice", Tenant{Name: "other"})
+	for range results {
+		t.Error("Expected no results for a tenant not in the context")
+	}
+	if err = <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	// Queries without a context pass context.Background().
+	if ok, err := o.QueryRuleOnce("member", "alice", Tenant{Name: "acme"}); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Error("Expected no results without a context")
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	results, errs = o.QueryRuleContext(canceled, "member", "alice", Tenant{Name: "acme"})
+	for range results {
+	}
+	if err = <-errs; err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got: %v", err)
+	}
+}
+
+func TestSetLogger(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	o.RegisterClass(reflect.TypeOf(User{}), nil)
+	o.LoadString(`named(user: User, name) if user.Name = name;`)
+
+	var events []oso.TraceEvent
+	o.SetLogger(func(event oso.TraceEvent) {
+		events = append(events, event)
+	})
+	if a, e := o.QueryRuleOnce("named", User{Name: "alice"}, "alice"); e != nil {
+		t.Fatal(e)
+	} else if !a {
+		t.Fatal("Expected a result")
+	}
+
+	kinds := make(map[oso.TraceKind]bool)
+	for _, event := range events {
+		kinds[event.Kind] = true
+		if event.Kind == oso.TraceExternalCall && event.Attribute != "Name" {
+			t.Errorf("Unexpected external call: %v", event)
+		}
+		// Instances are described by their class, without their fields.
+		if event.Kind == oso.TraceExternalCall && event.Message != "looking up field Name on User" {
+			t.Errorf("Unexpected message for %v", event)
+		}
+	}
+	for _, kind := range []oso.TraceKind{oso.TraceExternalIsa, oso.TraceExternalCall, oso.TraceQueryResult} {
+		if !kinds[kind] {
+			t.Errorf("Expected a %s event, got: %v", kind, events)
+		}
+	}
+
+	events = nil
+	o.SetLogger(nil)
+	if _, e := o.QueryRuleOnce("named", User{Name: "alice"}, "alice"); e != nil {
+		t.Fatal(e)
+	}
+	if len(events) != 0 {
+		t.Errorf("Expected no events once the logger is removed, got: %v", events)
+	}
+}
+
+func TestSetTraceEnabled(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	o.LoadString(`f(x) if g(x); g(1);`)
+
+	var trace strings.Builder
+	o.SetTraceWriter(&trace)
+	o.SetTraceEnabled(true)
+	if a, e := o.QueryRuleOnce("f", 1); e != nil {
+		t.Fatal(e)
+	} else if !a {
+		t.Fatal("Expected a result")
+	}
+	if !strings.Contains(trace.String(), "QUERY: g(") {
+		t.Errorf("Expected the trace to include querying g, got: %q", trace.String())
+	}
+
+	trace.Reset()
+	o.SetTraceEnabled(false)
+	if _, e := o.QueryRuleOnce("f", 1); e != nil {
+		t.Fatal(e)
+	}
+	if os.Getenv("POLAR_LOG") == "" && trace.Len() != 0 {
+		t.Errorf("Expected no trace once tracing is disabled, got: %q", trace.String())
+	}
+}
+
+func TestQueryClose(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.LoadString("f(1); f(2); f(3);"); err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+
+	var closer io.Closer
+	query, err := o.NewQueryFromStr("f(x)")
+	if err != nil {
+		t.Fatalf("Failed to create query: %v", err)
+	}
+	closer = query
+	if result, err := query.Next(); err != nil || result == nil {
+		t.Fatalf("Expected a result, got %v, %v", result, err)
+	}
+	if err = closer.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if err = closer.Close(); err != nil {
+		t.Errorf("Closing twice failed: %v", err)
+	}
+	if _, err = query.Next(); err == nil {
+		t.Error("Expected an error calling Next on a closed query")
+	}
+
+	// Exhausted queries can be closed too.
+	if query, err = o.NewQueryFromStr("f(x)"); err != nil {
+		t.Fatalf("Failed to create query: %v", err)
+	}
+	if _, err = query.GetAllResults(); err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if err = query.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+}
+
+type Checker struct{}
+
+func (Checker) Check(n int) (bool, error) {
+	if n == 2 {
+		return false, fmt.Errorf("cannot check %d", n)
+	}
+	return true, nil
+}
+
+func TestErrorDuringIteration(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.RegisterClass(reflect.TypeOf(Checker{}), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = o.LoadString(`checked(x, checker: Checker) if x in [1, 2, 3] and checker.Check(x);`); err != nil {
+		t.Fatal(err)
+	}
+
+	// The error for 2 fails the whole query instead of truncating the results.
+	query, err := o.NewQueryFromRule("checked", ValueVariable("x"), Checker{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := query.GetAllResults()
+	if err == nil || !strings.Contains(err.Error(), "cannot check 2") {
+		t.Errorf("Expected the error from Check, got %v, %v", results, err)
+	}
+	if results != nil {
+		t.Errorf("Expected no results, got %v", results)
+	}
+
+	// Stepping through the results, the error is returned after the first
+	// result, and the query can't be stepped further.
+	if query, err = o.NewQueryFromRule("checked", ValueVariable("x"), Checker{}); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := query.Next(); err != nil || result == nil {
+		t.Fatalf("Expected a result, got %v, %v", result, err)
+	}
+	if result, err := query.Next(); err == nil {
+		t.Errorf("Expected an error, got %v", result)
+	}
+	if result, err := query.Next(); err == nil {
+		t.Errorf("Expected an error stepping a failed query, got %v", result)
+	}
+}
+
+func TestGetAllResultsTyped(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.RegisterClass(reflect.TypeOf(User{}), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = o.RegisterClassAliases(reflect.TypeOf(Widget{}), "Gadget", "Widget"); err != nil {
+		t.Fatal(err)
+	}
+
+	alice := &User{Name: "alice"}
+	items := []interface{}{alice, Widget{Id: 1}, Company{Id: 2}, 1, 1.5, "s", true, []int{1}, map[string]int{"a": 1}, nil}
+	query, err := o.QueryWithBindings("x in items", map[string]interface{}{"items": items})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := query.GetAllResultsTyped()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"User", "Widget", "oso_test.Company", "Integer", "Float", "String", "Boolean", "List", "Dictionary", "nil"}
+	if len(results) != len(expected) {
+		t.Fatalf("Expected %d results, got %v", len(expected), results)
+	}
+	for i, result := range results {
+		if result["x"].Type != expected[i] {
+			t.Errorf("Expected %v to have type %s, got %s", result["x"].Value, expected[i], result["x"].Type)
+		}
+	}
+	if results[0]["x"].Value != alice {
+		t.Errorf("Expected the same user back, got %v", results[0]["x"].Value)
+	}
+}
+
+func TestQueryCount(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.LoadString("f(1); f(2); f(3); g(x) if x.Fake();"); err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+
+	query, err := o.NewQueryFromStr("f(x)")
+	if err != nil {
+		t.Fatalf("Failed to create query: %v", err)
+	}
+	if count, err := query.Count(); err != nil {
+		t.Error(err)
+	} else if count != 3 {
+		t.Errorf("Expected 3 results, got %d", count)
+	}
+	if _, err = query.Next(); err == nil {
+		t.Error("Expected an error calling Next on a counted query")
+	}
+
+	// Results already returned by Next aren't counted.
+	if query, err = o.NewQueryFromStr("f(x)"); err != nil {
+		t.Fatalf("Failed to create query: %v", err)
+	}
+	query.Next()
+	if count, err := query.Count(); err != nil || count != 2 {
+		t.Errorf("Expected 2 remaining results, got %d, %v", count, err)
+	}
+
+	if query, err = o.NewQueryFromStr("f(4)"); err != nil {
+		t.Fatalf("Failed to create query: %v", err)
+	}
+	if count, err := query.Count(); err != nil || count != 0 {
+		t.Errorf("Expected no results, got %d, %v", count, err)
+	}
+
+	if query, err = o.NewQueryFromStr("g(1)"); err != nil {
+		t.Fatalf("Failed to create query: %v", err)
+	}
+	if _, err = query.Count(); err == nil {
+		t.Error("Expected Polar runtime error, got none")
+	}
+}
+
+func TestQuerySource(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.LoadString("f(_, _);"); err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+
+	query, err := o.NewQueryFromRule("f", 1, "read")
+	if err != nil {
+		t.Fatalf("Failed to create query: %v", err)
+	}
+	if source, err := query.Source(); err != nil {
+		t.Error(err)
+	} else if source != `f(1, "read")` {
+		t.Errorf("Expected source f(1, \"read\"), got %q", source)
+	}
+
+	if query, err = o.NewQueryFromRule("f", User{Name: "alice"}, "read"); err != nil {
+		t.Fatalf("Failed to create query: %v", err)
+	}
+	if source, err := query.Source(); err != nil {
+		t.Error(err)
+	} else if !strings.Contains(source, "User{Name:alice}") {
+		t.Errorf("Expected source to describe the instance, got %q", source)
+	}
+
+	if query, err = o.NewQueryFromStr("f(x, 2)"); err != nil {
+		t.Fatalf("Failed to create query: %v", err)
+	}
+	if source, err := query.Source(); err != nil {
+		t.Error(err)
+	} else if !strings.HasPrefix(source, "f(x, 2)") {
+		t.Errorf("Expected source to start with the query string, got %q", source)
+	}
+	query.Close()
+	if _, err = query.Source(); err == nil {
+		t.Error("Expected an error getting the source of a closed query")
+	}
+}
+
+func TestQueryGetResults(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	o.LoadString(`
+		f(1); f(2); f(3);
+		nat(0);
+		nat(n) if nat(m) and n = m + 1;
+	`)
+
+	tests := []struct {
+		query    string
+		limit    int
+		expected []interface{}
+	}{
+		{"nat(x)", 3, []interface{}{int64(0), int64(1), int64(2)}},
+		{"f(x)", 5, []interface{}{int64(1), int64(2), int64(3)}},
+		{"f(x)", 0, []interface{}{int64(1), int64(2), int64(3)}},
+		{"f(x)", -1, []interface{}{int64(1), int64(2), int64(3)}},
+	}
+	for _, test := range tests {
+		query, err := o.NewQueryFromStr(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, err := query.GetResults(test.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var xs []interface{}
+		for _, r := range results {
+			xs = append(xs, r["x"])
+		}
+		if !reflect.DeepEqual(xs, test.expected) {
+			t.Errorf("%s with limit %d: expected %v, got %v", test.query, test.limit, test.expected, xs)
+		}
+	}
+}
+
+func TestQueryResultsChan(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	o.LoadString("f(1); f(2); f(3);")
+
+	query, err := o.NewQueryFromStr("f(x)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, errs := query.ResultsChan(context.Background())
+	var xs []interface{}
+	for r := range results {
+		xs = append(xs, r["x"])
+	}
+	if err := <-errs; err != nil {
+		t.Error(err.Error())
+	}
+	if expected := []interface{}{int64(1), int64(2), int64(3)}; !reflect.DeepEqual(xs, expected) {
+		t.Errorf("Expected %v, got %v", expected, xs)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	query, err = o.NewQueryFromStr("f(x)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, errs = query.ResultsChan(ctx)
+	if _, ok := <-results; !ok {
+		t.Fatal("Expected a result, got none")
+	}
+	cancel()
+	for range results {
+	}
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got: %v", err)
+	}
+
+	// The context given to ResultsChan stops the query in the middle of a
+	// step, not just between results.
+	o.LoadString(`
+		deep(0);
+		deep(n) if n > 0 and (deep(n - 1) or deep(n - 1));
+		never(n) if deep(n) and false;
+	`)
+	query, err = o.NewQueryFromRule("never", 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	results, errs = query.ResultsChan(ctx)
+	for range results {
+	}
+	if err := <-errs; err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the query to stop at its deadline, took %v", elapsed)
+	}
+}
+
+func TestToAndFromPolarValue(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.LoadString(`f(u) if u.Name = "alice";`); err != nil {
+		t.Fatal(err)
+	}
+
+	term, err := o.ToPolarValue(User{Name: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The same term can be used in several queries.
+	for i := 0; i < 2; i++ {
+		if ok, err := o.QueryRuleOnce("f", term); err != nil || !ok {
+			t.Errorf("Expected f(term) to succeed, got: %v, %v", ok, err)
+		}
+	}
+	var user User
+	if err = o.FromPolarValue(term, &user); err != nil {
+		t.Fatal(err)
+	}
+	if user.Name != "alice" {
+		t.Errorf("Expected alice, got: %v", user)
+	}
+	if err = o.FromPolarValue(term, user); err == nil {
+		t.Error("Expected an error decoding into a non-pointer")
+	}
+
+	// Released terms' instances are forgotten.
+	o.ReleasePolarValue(term)
+	if err = o.FromPolarValue(term, &user); err == nil {
+		t.Error("Expected an error decoding a released term")
+	}
+
+	term, err = o.ToPolarValue([]string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tags []string
+	if err = o.FromPolarValue(term, &tags); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tags, []string{"a", "b"}) {
+		t.Errorf("Expected [a b], got: %v", tags)
+	}
+}
+
+func TestRegisterFunction(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.RegisterFunction("Double", func(n int) int { return n * 2 }); err != nil {
+		t.Fatal(err)
+	}
+	isEven := func(n int) (bool, error) {
+		if n < 0 {
+			return false, fmt.Errorf("negative number: %d", n)
+		}
+		return n%2 == 0, nil
+	}
+	if err = o.RegisterFunction("IsEven", isEven); err != nil {
+		t.Fatal(err)
+	}
+	if err = o.RegisterFunction("NotAFunction", 1); err == nil {
+		t.Error("Expected an error registering a value that isn't a func")
+	}
+	err = o.LoadString(`
+		double(x, y) if y = Double.Call(x);
+		even(x) if IsEven.Call(x);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := o.QueryRuleOnce("double", 2, 4); err != nil || !ok {
+		t.Errorf("Expected double(2, 4) to succeed, got: %v, %v", ok, err)
+	}
+	if ok, err := o.QueryRuleOnce("even", 4); err != nil || !ok {
+		t.Errorf("Expected even(4) to succeed, got: %v, %v", ok, err)
+	}
+	if ok, err := o.QueryRuleOnce("even", 3); err != nil || ok {
+		t.Errorf("Expected even(3) to fail, got: %v, %v", ok, err)
+	}
+	if _, err := o.QueryRuleOnce("even", -1); err == nil || !strings.Contains(err.Error(), "negative number") {
+		t.Errorf("Expected the function's error, got: %v", err)
+	}
+}
+
+func TestRegisteredClassesAndConstants(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	if err = o.RegisterClassWithName(reflect.TypeOf(User{}), nil, "AppUser"); err != nil {
+		t.Fatal(err)
+	}
+	if err = o.RegisterConstant(3, "Limit"); err != nil {
+		t.Fatal(err)
+	}
+	if err = o.RegisterFunction("Double", func(x int) int { return 2 * x }); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedClasses := []string{"AppUser", "Boolean", "Dictionary", "Float", "Integer", "List", "String"}
+	if classes := o.RegisteredClasses(); !reflect.DeepEqual(classes, expectedClasses) {
+		t.Errorf("Expected classes %v, got %v", expectedClasses, classes)
+	}
+	expectedConstants := []string{"Double", "Limit", "nil"}
+	if constants := o.RegisteredConstants(); !reflect.DeepEqual(constants, expectedConstants) {
+		t.Errorf("Expected constants %v, got %v", expectedConstants, constants)
+	}
+}
+
+func TestRegisterInstanceConstants(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.RegisterClass(reflect.TypeOf(User{}), nil); err != nil {
+		t.Fatal(err)
+	}
+	systemUser := &User{Name: "system"}
+	if err = o.RegisterConstant(systemUser, "System"); err != nil {
+		t.Fatal(err)
+	}
+	if err = o.RegisterConstant(User{Name: "guest"}, "Guest"); err != nil {
+		t.Fatal(err)
+	}
+	if err = o.LoadString(`allow(actor: User, "read", _) if actor = System or actor = Guest;`); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, q := range []string{"System matches User", "Guest matches User", `System.Name = "system"`} {
+		query, err := o.NewQueryFromStr(q)
+		if err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+		if results, err := query.GetAllResults(); err != nil {
+			t.Errorf("%s: %v", q, err)
+		} else if len(results) != 1 {
+			t.Errorf("%s: expected 1 result, got %d", q, len(results))
+		}
+	}
+
+	query, err := o.NewQueryFromStr("x = System")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results, err := query.GetAllResults(); err != nil {
+		t.Fatal(err)
+	} else if len(results) != 1 || results[0]["x"] != systemUser {
+		t.Errorf("Expected the System constant to be returned as %p, got %v", systemUser, results)
+	}
+
+	for _, actor := range []interface{}{systemUser, User{Name: "guest"}, User{Name: "alice"}} {
+		expected := actor != User{Name: "alice"}
+		if allowed, err := o.IsAllowed(actor, "read", "doc"); err != nil {
+			t.Errorf("IsAllowed(%v): %v", actor, err)
+		} else if allowed != expected {
+			t.Errorf("IsAllowed(%v): expected %v, got %v", actor, expected, allowed)
+		}
+	}
+}
+
+func TestUnregisteredClasses(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.RegisterClass(reflect.TypeOf(User{}), nil); err != nil {
+		t.Fatal(err)
+	}
+	policy := `
+		allow(actor: User, "read", resource: Document) if resource matches Folder or actor = resource;
+		allow(_: User, "write", _: String);`
+	if err = o.LoadString(policy); err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+	expected := []string{"Document", "Folder"}
+	if classes, err := o.UnregisteredClasses(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(classes, expected) {
+		t.Errorf("Expected unregistered classes %v, got %v", expected, classes)
+	}
+
+	if o, err = oso.NewOso(oso.WithStrictClassChecks()); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.RegisterClass(reflect.TypeOf(User{}), nil); err != nil {
+		t.Fatal(err)
+	}
+	err = o.LoadString(policy)
+	unregisteredErr, ok := err.(*errors.UnregisteredClassError)
+	if !ok {
+		t.Fatalf("Expected an UnregisteredClassError, got %v", err)
+	}
+	if names := unregisteredErr.Names(); !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected the error to list %v, got %v", expected, names)
+	}
+	if err = o.LoadString(`allow(_: User, "write", _: String);`); err != nil {
+		t.Errorf("Expected a policy using only registered classes to load, got %v", err)
+	}
+}
+
+func TestLint(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	for _, cls := range []interface{}{User{}, Widget{}, Company{}, Foo{}} {
+		if err = o.RegisterClass(reflect.TypeOf(cls), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = o.LoadString(`
+		allow(_: User, "read", _: Widget);
+		allow(_: User, "read", _: Document);
+		owner(company) if company = new Company(1);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	warnings, err := o.Lint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, warning := range warnings {
+		got = append(got, fmt.Sprintf("%s %s", warning.Kind, warning.Class))
+	}
+	expected := []string{"unregistered_class Document", "unused_class Foo"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected warnings %v, got %v", expected, got)
+	}
+
+	if err = o.ClearRules(); err != nil {
+		t.Fatal(err)
+	}
+	if err = o.LoadString(`allow(_: User, "read", w: Widget) if c = new Company(1) and f = new Foo("x", 1) and w.Id = c.Id and f.Num = 1;`); err != nil {
+		t.Fatal(err)
+	}
+	if warnings, err = o.Lint(); err != nil {
+		t.Fatal(err)
+	} else if len(warnings) != 0 {
+		t.Errorf("Expected no warnings, got %v", warnings)
+	}
+}
+
+func TestRegisterConstants(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	err = o.RegisterConstants(map[string]interface{}{
+		"Read":  "read",
+		"Write": "write",
+		"Admin": &User{Name: "admin"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = o.LoadString(`allow(actor, action, _) if action in [Read, Write] and actor.Name = Admin.Name;`); err != nil {
+		t.Fatal(err)
+	}
+	if allowed, err := o.IsAllowed(&User{Name: "admin"}, "write", "doc"); err != nil || !allowed {
+		t.Errorf("Expected Admin to be allowed to write, got %v, %v", allowed, err)
+	}
+	if allowed, err := o.IsAllowed(&User{Name: "admin"}, "delete", "doc"); err != nil || allowed {
+		t.Errorf("Expected Admin not to be allowed to delete, got %v, %v", allowed, err)
+	}
+
+	// None of the constants are registered if any can't be converted.
+	before := o.RegisteredConstants()
+	err = o.RegisterConstants(map[string]interface{}{
+		"Delete": "delete",
+		"Huge":   new(big.Int).Lsh(big.NewInt(1), 100),
+	})
+	if err == nil {
+		t.Fatal("Expected an error registering a constant that can't be converted")
+	}
+	if after := o.RegisteredConstants(); !reflect.DeepEqual(before, after) {
+		t.Errorf("Expected constants %v, got %v", before, after)
+	}
+}
+
+func TestRegisterCollectionConstants(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.RegisterConstant([]string{"us-east", "eu-west"}, "AllowedRegions"); err != nil {
+		t.Fatal(err)
+	}
+	if err = o.RegisterConstant(map[string]int{"read": 1, "write": 2}, "Levels"); err != nil {
+		t.Fatal(err)
+	}
+	if err = o.RegisterConstant(map[int]string{2: "write", 1: "read"}, "LevelNames"); err != nil {
+		t.Fatal(err)
+	}
+	err = o.LoadString(`
+		allowed_region(region) if region in AllowedRegions;
+		level(action, level) if Levels.(action) = level;
+		levels(n) if n = Levels.write - Levels.read;
+		level_name(level, name) if [level, name] in LevelNames;
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		rule     string
+		args     []interface{}
+		expected bool
+	}{
+		{"allowed_region", []interface{}{"us-east"}, true},
+		{"allowed_region", []interface{}{"ap-south"}, false},
+		{"level", []interface{}{"write", 2}, true},
+		{"level", []interface{}{"read", 2}, false},
+		{"levels", []interface{}{1}, true},
+		{"level_name", []interface{}{2, "write"}, true},
+		{"level_name", []interface{}{1, "write"}, false},
+	}
+	for _, test := range tests {
+		if ok, err := o.QueryRuleOnce(test.rule, test.args...); err != nil {
+			t.Errorf("%s%v: %v", test.rule, test.args, err)
+		} else if ok != test.expected {
+			t.Errorf("%s%v: expected %v, got %v", test.rule, test.args, test.expected, ok)
+		}
+	}
+}
+
+func TestMapsWithNonStringKeys(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.RegisterClass(reflect.TypeOf(User{}), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = o.LoadString("entries(m, id, user) if [id, user] in m;"); err != nil {
+		t.Fatal(err)
+	}
+
+	users := map[int]User{3: {Name: "carol"}, 1: {Name: "alice"}, 2: {Name: "bob"}}
+	query, err := o.NewQueryFromRule("entries", users, ValueVariable("id"), ValueVariable("user"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := query.GetAllResults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []map[string]interface{}{
+		{"id": int64(1), "user": User{Name: "alice"}},
+		{"id": int64(2), "user": User{Name: "bob"}},
+		{"id": int64(3), "user": User{Name: "carol"}},
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("Expected %v, got %v", expected, results)
+	}
+
+	// The map is passed to Polar as an instance, and returned unchanged.
+	query, err = o.QueryWithBindings("x = m", map[string]interface{}{"m": users})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := query.Next(); err != nil {
+		t.Fatal(err)
+	} else if result == nil || !reflect.DeepEqual((*result)["x"], users) {
+		t.Errorf("Expected %v, got %v", users, result)
+	}
+	query.Cleanup()
+}
+
+type Record struct {
+	Kind   string
+	values map[string]interface{}
+}
+
+func (r *Record) GetPolarAttribute(name string) (interface{}, error) {
+	if value, ok := r.values[name]; ok {
+		return value, nil
+	}
+	return nil, fmt.Errorf("record has no attribute %s", name)
+}
+
+func (r *Record) IsKind(kind string) bool {
+	return r.Kind == kind
+}
+
+func TestPolarAttributer(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.RegisterClass(reflect.TypeOf(Record{}), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = o.LoadString(`
+		owned(user: User, record: Record) if record.owner = user.Name;
+		is_doc(record: Record) if record.IsKind("doc");
+		has_kind(record: Record) if record.Kind = "doc";
+	`); err != nil {
+		t.Fatal(err)
+	}
+	record := &Record{Kind: "doc", values: map[string]interface{}{"owner": "alice"}}
+	if ok, err := o.QueryRuleOnce("owned", User{Name: "alice"}, record); err != nil || !ok {
+		t.Errorf("Expected alice to own the record, got %v, %v", ok, err)
+	}
+	if ok, err := o.QueryRuleOnce("owned", User{Name: "bob"}, *record); err != nil || ok {
+		t.Errorf("Expected bob not to own the record, got %v, %v", ok, err)
+	}
+	if ok, err := o.QueryRuleOnce("is_doc", record); err != nil || !ok {
+		t.Errorf("Expected methods to be called as usual, got %v, %v", ok, err)
+	}
+	// Struct fields are looked up through GetPolarAttribute too.
+	if _, err := o.QueryRuleOnce("has_kind", record); err == nil || !strings.Contains(err.Error(), "record has no attribute Kind") {
+		t.Errorf("Expected an error from GetPolarAttribute, got %v", err)
+	}
+}
+
+type Envelope struct {
+	Body []byte
+}
+
+func (m Envelope) HasBody(body []byte) bool {
+	return string(m.Body) == string(body)
+}
+
+func TestByteSlices(t *testing.T) {
+	for _, asList := range []bool{false, true} {
+		var o oso.Oso
+		var err error
+		if o, err = oso.NewOso(); err != nil {
+			t.Fatalf("Failed to set up Oso: %v", err)
+		}
+		o.SetBytesAsList(asList)
+		if err = o.RegisterClass(reflect.TypeOf(Envelope{}), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err = o.LoadString(`
+			body_is_string(m: Envelope) if m.Body = "ok";
+			body_is_list(m: Envelope) if m.Body = [111, 107];
+			has_string_body(m: Envelope) if m.HasBody("ok");
+			has_list_body(m: Envelope) if m.HasBody([111, 107]);
+		`); err != nil {
+			t.Fatal(err)
+		}
+		message := Envelope{Body: []byte("ok")}
+		tests := []struct {
+			rule     string
+			expected bool
+		}{
+			{"body_is_string", !asList},
+			{"body_is_list", asList},
+			{"has_string_body", true},
+			{"has_list_body", true},
+		}
+		for _, test := range tests {
+			if ok, err := o.QueryRuleOnce(test.rule, message); err != nil || ok != test.expected {
+				t.Errorf("%s with bytes as list %v: expected %v, got %v, %v", test.rule, asList, test.expected, ok, err)
+			}
+		}
+
+		var decoded []byte
+		if err = o.FromPolarValue(Term{Value{ValueString("ok")}}, &decoded); err != nil || string(decoded) != "ok" {
+			t.Errorf("Expected a string to decode to []byte(\"ok\"), got %v, %v", decoded, err)
+		}
+	}
+}
+
+func TestUnknownAttributesAsNil(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	policy := `
+		unarchived(w) if w.Archived = nil;
+		has_id(w, id) if w.Id = id;
+		calls(w) if w.Archived();
+	`
+	if err = o.LoadString(policy); err != nil {
+		t.Fatal(err)
+	}
+	widget := Widget{Id: 1}
+	if _, err = o.QueryRuleOnce("unarchived", widget); err == nil {
+		t.Error("Expected looking up an unknown field to fail by default")
+	}
+
+	o.TreatUnknownAttributesAsNil(true)
+	tests := []struct {
+		rule     string
+		args     []interface{}
+		expected bool
+	}{
+		{"unarchived", []interface{}{widget}, true},
+		{"has_id", []interface{}{widget, 1}, true},
+		{"has_id", []interface{}{widget, 2}, false},
+	}
+	for _, test := range tests {
+		if ok, err := o.QueryRuleOnce(test.rule, test.args...); err != nil {
+			t.Errorf("%s%v: %v", test.rule, test.args, err)
+		} else if ok != test.expected {
+			t.Errorf("%s%v: expected %v, got %v", test.rule, test.args, test.expected, ok)
+		}
+	}
+	// Calling an unknown method still fails.
+	if _, err = o.QueryRuleOnce("calls", widget); err == nil {
+		t.Error("Expected calling an unknown method to fail")
+	}
+
+	if o, err = oso.NewOso(oso.WithUnknownAttributesAsNil()); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.LoadString(policy); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := o.QueryRuleOnce("unarchived", widget); err != nil || !ok {
+		t.Errorf("Expected unarchived to succeed with the option, got %v, %v", ok, err)
+	}
+}
+
+func TestQueryWithBindings(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.LoadString("f(x, y) if x = 1 and y = 2;"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		bindings map[string]interface{}
+		expected int
+	}{
+		{map[string]interface{}{"a": 1, "b": 2}, 1},
+		{map[string]interface{}{"a": 1, "b": 3}, 0},
+		{map[string]interface{}{"b": 2}, 1},
+	}
+	for _, test := range tests {
+		query, err := o.QueryWithBindings("f(a, b)", test.bindings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, err := query.GetAllResults()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != test.expected {
+			t.Errorf("%v: expected %d results, got %v", test.bindings, test.expected, results)
+		}
+	}
+
+	query, err := o.QueryWithBindings("name = user.Name", map[string]interface{}{"user": User{Name: "alice"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := query.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result == nil || (*result)["name"] != "alice" {
+		t.Errorf("Expected name to be bound to alice, got %v", result)
+	}
+}
+
+func TestQueryRuleWithOptions(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.LoadString("f(x) if x > 1;"); err != nil {
+		t.Fatal(err)
+	}
+
+	query, err := o.QueryRuleWithOptions(oso.QueryOptions{}, "f", ValueVariable("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = query.Next(); err == nil {
+		t.Error("Expected an error for an expression without AcceptExpressions")
+	}
+
+	query, err = o.QueryRuleWithOptions(oso.QueryOptions{AcceptExpressions: true}, "f", ValueVariable("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := query.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := oso.Expression{Operator: "And", Args: []interface{}{
+		oso.Expression{Operator: "Gt", Args: []interface{}{ValueVariable("_this"), int64(1)}},
+	}}
+	if result == nil || !reflect.DeepEqual((*result)["x"], expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestLastRuleSource(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	o.LoadString("allow(_, \"read\", \"public\");\nallow(\"admin\", _, _);")
+
+	query, err := o.QueryRuleWithOptions(oso.QueryOptions{RecordRuleSources: true}, "allow", "admin", "write", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := query.Next(); err != nil {
+		t.Fatal(err)
+	} else if result == nil {
+		t.Fatal("Expected a result")
+	}
+	source := query.LastRuleSource()
+	if source == nil {
+		t.Fatal("Expected the source of the matching rule")
+	}
+	if source.Src != `allow("admin", _, _)` || source.Line != 2 {
+		t.Errorf("Expected the second rule, got %s at line %d", source.Src, source.Line)
+	}
+	query.Cleanup()
+
+	query, err = o.NewQueryFromRule("allow", "admin", "write", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := query.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if source := query.LastRuleSource(); source != nil {
+		t.Errorf("Expected no rule source without RecordRuleSources, got: %v", source)
+	}
+	query.Cleanup()
+}
+
+func TestExternalCalls(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.RegisterClass(reflect.TypeOf(Folder{}), nil); err != nil {
+		t.Fatal(err)
+	}
+	o.LoadString("allow(user, \"read\", folder: Folder) if folder.IsOwner(user) and folder.Owner = user;")
+
+	folder := Folder{Owner: "alice"}
+	query, err := o.QueryRuleWithOptions(oso.QueryOptions{RecordExternalCalls: true}, "allow", "alice", "read", folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := query.GetAllResults(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []oso.ExternalCall{
+		{Class: "Folder", Name: "IsOwner", IsMethod: true},
+		{Class: "Folder", Name: "Owner", IsMethod: false},
+	}
+	if calls := query.ExternalCalls(); !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Expected %v, got %v", expected, calls)
+	}
+
+	query, err = o.NewQueryFromRule("allow", "alice", "read", folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := query.GetAllResults(); err != nil {
+		t.Fatal(err)
+	}
+	if calls := query.ExternalCalls(); calls != nil {
+		t.Errorf("Expected no calls without RecordExternalCalls, got: %v", calls)
+	}
+
+	// Functions are recorded under their registered names, and calls that
+	// aren't allowed by the class's methods aren't recorded at all.
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.RegisterClassWithOptions(reflect.TypeOf(Folder{}), nil, oso.ClassOptions{Methods: []string{"IsOwner"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = o.RegisterFunction("Double", func(n int) int { return n * 2 }); err != nil {
+		t.Fatal(err)
+	}
+	o.LoadString(`
+		check(folder, n) if Double.Call(n) = 4 and folder.IsOwner("alice");
+		remove(folder) if folder.Delete();
+	`)
+	query, err = o.QueryRuleWithOptions(oso.QueryOptions{RecordExternalCalls: true}, "check", folder, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := query.GetAllResults(); err != nil {
+		t.Fatal(err)
+	}
+	expected = []oso.ExternalCall{
+		{Class: "", Name: "Double", IsMethod: true},
+		{Class: "Folder", Name: "IsOwner", IsMethod: true},
+	}
+	if calls := query.ExternalCalls(); !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Expected %v, got %v", expected, calls)
+	}
+
+	query, err = o.QueryRuleWithOptions(oso.QueryOptions{RecordExternalCalls: true}, "remove", folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := query.GetAllResults(); err == nil {
+		t.Error("Expected an error calling a method that isn't allowed")
+	}
+	if calls := query.ExternalCalls(); len(calls) != 0 {
+		t.Errorf("Expected the disallowed call not to be recorded, got: %v", calls)
+	}
+}
+
+func TestQueryNextInto(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	o.LoadString("f(\"read\", 1, [\"a\", \"b\"]); f(\"write\", 2, []);")
+
+	var result struct {
+		Action string
+		Level  int64 `polar:"lvl"`
+		Tags   []string
+	}
+	query, err := o.NewQueryFromStr("f(action, lvl, tags)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := query.NextInto(&result); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("Expected result, got none")
+	}
+	if result.Action != "read" || result.Level != 1 || !reflect.DeepEqual(result.Tags, []string{"a", "b"}) {
+		t.Errorf("Unexpected result: %#v", result)
+	}
+	if ok, err := query.NextInto(&result); err != nil {
+		t.Fatal(err)
+	} else if !ok || result.Action != "write" || result.Level != 2 {
+		t.Errorf("Unexpected result: %#v", result)
+	}
+	if ok, err := query.NextInto(&result); err != nil || ok {
+		t.Errorf("Expected no more results, got %v, %v", ok, err)
+	}
+
+	var wrongType struct{ Action int }
+	query, err = o.NewQueryFromStr("f(action, _, _)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := query.NextInto(&wrongType); err == nil {
+		t.Error("Expected an error assigning a string to an int field")
+	}
+	if _, err := query.NextInto(wrongType); err == nil {
+		t.Error("Expected an error passing a non-pointer to NextInto")
+	}
+}
+
+func TestQueryNextIntoDictionaries(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.LoadString(`grant({user_name: "alice", role: "admin", expires_at: 10}, "org");`); err != nil {
+		t.Fatal(err)
+	}
+
+	type Grant struct {
+		UserName  string
+		Role      string `json:"role"`
+		ExpiresAt int
+	}
+	var result struct {
+		Grant    Grant
+		Resource string `json:"resource_name"`
+	}
+	query, err := o.NewQueryFromStr("grant(grant, resource_name)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := query.NextInto(&result); err != nil || !ok {
+		t.Fatalf("Expected a result, got %v, %v", ok, err)
+	}
+	expected := Grant{UserName: "alice", Role: "admin", ExpiresAt: 10}
+	if result.Grant != expected || result.Resource != "org" {
+		t.Errorf("Unexpected result: %#v", result)
+	}
+
+	// Strict decoding fails on keys without a field.
+	var partial struct {
+		Grant struct{ Role string }
+	}
+	if query, err = o.NewQueryFromStr("grant(grant, _)"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := query.NextInto(&partial); err != nil || !ok || partial.Grant.Role != "admin" {
+		t.Errorf("Expected unknown keys to be ignored, got %#v, %v, %v", partial, ok, err)
+	}
+	if query, err = o.NewQueryFromStr("grant(grant, _)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := query.NextIntoWithOptions(&partial, oso.DecodeOptions{Strict: true}); err == nil {
+		t.Error("Expected an error for keys without a field")
+	}
+	if query, err = o.NewQueryFromStr("grant(_, resource)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := query.NextIntoWithOptions(&partial, oso.DecodeOptions{Strict: true}); err == nil {
+		t.Error("Expected an error for a binding without a field")
+	}
+}
+
+func TestQueryRuleTerms(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.RegisterClass(reflect.TypeOf(User{}), nil); err != nil {
+		t.Fatalf("Failed to register class: %v", err)
+	}
+	if err = o.LoadString(`allow(user: User, "read", widget) if user.Name = "alice" and widget.Id = 1;`); err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+
+	actor, err := o.ToPolarValue(User{Name: "alice"})
+	if err != nil {
+		t.Fatalf("Failed to convert actor: %v", err)
+	}
+	action, err := o.ToPolarValue("read")
+	if err != nil {
+		t.Fatalf("Failed to convert action: %v", err)
+	}
+	for id, expected := range map[int]bool{1: true, 2: false} {
+		resource, err := o.ToPolarValue(Widget{Id: id})
+		if err != nil {
+			t.Fatalf("Failed to convert resource: %v", err)
+		}
+		query, err := o.QueryRuleTerms("allow", actor, action, resource)
+		if err != nil {
+			t.Fatalf("QueryRuleTerms failed: %v", err)
+		}
+		results, err := query.GetAllResults()
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		if (len(results) > 0) != expected {
+			t.Errorf("Expected allowed = %v for widget %d, got %d results", expected, id, len(results))
+		}
+	}
+}
+
+func TestIsAllowed(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	o.LoadString("allow(\"foo\", \"bar\", \"baz\");")
+	if a, e := o.IsAllowed("foo", "bar", "baz"); e != nil {
+		t.Error(e.Error())
+	} else if !a {
+		t.Error("IsAllowed returned false, expected true")
+	}
+
+	if a, e := o.IsAllowed("foo", "baz", "bar"); e != nil {
+		t.Error(e.Error())
+	} else if a {
+		t.Error("IsAllowed returned true, expected false")
+	}
+
+}
+
+func TestIsAllowedNil(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.RegisterClass(reflect.TypeOf(User{}), nil); err != nil {
+		t.Fatalf("Failed to register class: %v", err)
+	}
+	if err = o.RegisterClass(reflect.TypeOf(Widget{}), nil); err != nil {
+		t.Fatalf("Failed to register class: %v", err)
+	}
+	policy := `
+		allow(actor: User, "read", widget: Widget) if actor.Name = "alice" and widget.Id = 1;
+		allow(actor, "read", "public") if actor = nil;
+		allow(_actor, action, _resource) if action = nil;`
+	if err = o.LoadString(policy); err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+
+	var nilUser *User
+	tests := []struct {
+		actor, action, resource interface{}
+		expected                bool
+	}{
+		{nil, "read", Widget{Id: 1}, false},
+		{nilUser, "read", Widget{Id: 1}, false},
+		{nil, "read", "public", true},
+		{nilUser, "read", "public", true},
+		{User{Name: "alice"}, "read", nil, false},
+		{User{Name: "alice"}, "read", Widget{Id: 1}, true},
+		{User{Name: "alice"}, nil, Widget{Id: 2}, true},
+		{nil, nil, nil, true},
+	}
+	for _, test := range tests {
+		allowed, err := o.IsAllowed(test.actor, test.action, test.resource)
+		if err != nil {
+			t.Errorf("IsAllowed(%#v, %#v, %#v) failed: %v", test.actor, test.action, test.resource, err)
+		} else if allowed != test.expected {
+			t.Errorf("IsAllowed(%#v, %#v, %#v) = %v, expected %v", test.actor, test.action, test.resource, allowed, test.expected)
+		}
+	}
+}
+
+func TestFilterAllowed(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.RegisterClass(reflect.TypeOf(Widget{}), nil); err != nil {
+		t.Fatalf("Failed to register class: %v", err)
+	}
+	policy := `
+		allow("foo", "read", w: Widget) if w.Id < 3;
+		allow("foo", "read", w: Widget) if w.Id = 1;
+		allow("foo", "read", "public");`
+	if err = o.LoadString(policy); err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+
+	resources := []interface{}{Widget{Id: 3}, Widget{Id: 1}, "public", Widget{Id: 2}, "private"}
+	filtered, err := o.FilterAllowed("foo", "read", resources)
+	if err != nil {
+		t.Fatalf("FilterAllowed failed: %v", err)
+	}
+	expected := []interface{}{Widget{Id: 1}, "public", Widget{Id: 2}}
+	if !reflect.DeepEqual(filtered, expected) {
+		t.Errorf("Expected %v, got %v", expected, filtered)
+	}
+
+	if filtered, err = o.FilterAllowed("bar", "read", resources); err != nil {
+		t.Fatalf("FilterAllowed failed: %v", err)
+	} else if len(filtered) != 0 {
+		t.Errorf("Expected no resources, got %v", filtered)
+	}
+}
+
+type User struct {
+	Name string
+}
+
+type Widget struct {
+	Id int
+}
+
+type Company struct {
+	Id int
+}
+
+type Foo struct {
+	Name string
+	Num  int
+}
+
+func MakeFoo(name string, num int) Foo {
+	return Foo{name, num}
+}
+
+func TestConstructors(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	o.RegisterClass(reflect.TypeOf(Foo{}), MakeFoo)
+
+	o.LoadString("f(y) if x = new Foo(\"hello\", 123) and y = x.Name;")
+	results, errors := o.QueryRule("f", ValueVariable("y"))
+
+	if err = <-errors; err != nil {
+		t.Error(err.Error())
+	} else {
+		var got []map[string]interface{}
+		expected := map[string]interface{}{"y": "hello"}
+		for elem := range results {
+			got = append(got, elem)
+		}
+		if len(got) != 1 {
+			t.Errorf("Received incorrect number of results: %v", got)
+		} else if !reflect.DeepEqual(got[0], expected) {
+			t.Errorf("Expected: %v, got: %v", expected, got[0])
+		}
+	}
+	y := reflect.TypeOf(nil)
+	_ = y
+	//o.RegisterClass(reflect.TypeOf(nil), MakeFoo)
+}
+
+func MakeFooChecked(name string, num int) (*Foo, error) {
+	if num < 0 {
+		return nil, fmt.Errorf("num must not be negative")
+	}
+	return &Foo{name, num}, nil
+}
+
+func TestConstructorsWithError(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	o.RegisterClass(reflect.TypeOf(Foo{}), MakeFooChecked)
+
+	o.LoadString("f(y, n) if x = new Foo(\"hello\", n) and y = x.Name;")
+
+	if a, e := o.QueryRuleOnce("f", "hello", 1); e != nil {
+		t.Error(e.Error())
+	} else if !a {
+		t.Error("QueryRuleOnce returned false, expected true")
+	}
+
+	if _, e := o.QueryRuleOnce("f", "hello", -1); e == nil {
+		t.Error("Expected constructor error, got none")
+	} else if !strings.Contains(e.Error(), "num must not be negative") {
+		t.Errorf("Expected constructor error, got: %v", e)
+	}
+}
+
+type Obj struct {
+	Attrs map[string]string
+}
+
+func (o Obj) Tags(tags ...string) []string {
+	return tags
+}
+
+func (o Obj) Lookup(key string) (string, error) {
+	if v, ok := o.Attrs[key]; ok {
+		return v, nil
+	}
+	return "", fmt.Errorf("no attribute %s", key)
+}
+
+func (o Obj) Pair() (int, string) {
+	return 1, "one"
+}
+
+func TestMethodResults(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	o.RegisterClass(reflect.TypeOf(Obj{}), nil)
+
+	o.LoadString("tags(o: Obj) if o.Tags(\"x\", \"y\") = [\"x\", \"y\"] and o.Tags() = []; " +
+		"lookup(o: Obj, k, v) if o.Lookup(k) = v; " +
+		"pair(o: Obj) if [1, \"one\"] = o.Pair();")
+
+	obj := Obj{map[string]string{"color": "red"}}
+	tests := []struct {
+		rule string
+		args []interface{}
+	}{
+		{"tags", []interface{}{obj}},
+		{"lookup", []interface{}{obj, "color", "red"}},
+		{"pair", []interface{}{obj}},
+	}
+	for _, test := range tests {
+		if a, e := o.QueryRuleOnce(test.rule, test.args...); e != nil {
+			t.Error(e.Error())
+		} else if !a {
+			t.Errorf("%s: expected true, got false", test.rule)
+		}
+	}
+
+	if _, e := o.QueryRuleOnce("lookup", obj, "size", "big"); e == nil {
+		t.Error("Expected method error, got none")
+	} else if !strings.Contains(e.Error(), "no attribute size") {
+		t.Errorf("Expected method error, got: %v", e)
+	}
+}
+
+type MissingKeyError struct {
+	Key string
+}
+
+func (e *MissingKeyError) Error() string {
+	return fmt.Sprintf("missing key %s", e.Key)
+}
+
+type Store struct {
+	Data map[string]string
+}
+
+func (s Store) Get(key string) (string, error) {
+	if key == "" {
+		return "", fmt.Errorf("empty key")
+	}
+	if v, ok := s.Data[key]; ok {
+		return v, nil
+	}
+	return "", &MissingKeyError{Key: key}
+}
+
+func TestErrorValueClass(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.RegisterClass(reflect.TypeOf(Store{}), nil); err != nil {
+		t.Fatalf("Failed to register class: %v", err)
+	}
+	if err = o.RegisterClassWithOptions(reflect.TypeOf(MissingKeyError{}), nil, oso.ClassOptions{ErrorValue: true}); err != nil {
+		t.Fatalf("Failed to register error class: %v", err)
+	}
+	if err = o.RegisterClassWithOptions(reflect.TypeOf(Widget{}), nil, oso.ClassOptions{Name: "ErrWidget", ErrorValue: true}); err == nil {
+		t.Error("Expected an error registering a type that isn't an error")
+	}
+	policy := `
+		missing(s: Store, key) if err = s.Get(key) and err matches MissingKeyError{Key: key};
+		found(s: Store, key, value) if s.Get(key) = value;`
+	if err = o.LoadString(policy); err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+
+	store := Store{Data: map[string]string{"color": "red"}}
+	if a, e := o.QueryRuleOnce("missing", store, "size"); e != nil {
+		t.Errorf("Query failed: %v", e)
+	} else if !a {
+		t.Error("Expected the missing key error to be matched")
+	}
+	if a, e := o.QueryRuleOnce("missing", store, "color"); e != nil {
+		t.Errorf("Query failed: %v", e)
+	} else if a {
+		t.Error("Expected no missing key error")
+	}
+	if a, e := o.QueryRuleOnce("found", store, "size", "big"); e != nil {
+		t.Errorf("Query failed: %v", e)
+	} else if a {
+		t.Error("Expected the missing key error not to unify with a string")
+	}
+	// Other errors still fail the query.
+	if _, e := o.QueryRuleOnce("found", store, "", "red"); e == nil {
+		t.Error("Expected method error, got none")
+	} else if !strings.Contains(e.Error(), "empty key") {
+		t.Errorf("Expected method error, got: %v", e)
+	}
+}
+
+type Member struct {
+	Roles []string
+}
+
+func (m Member) RoleChan() <-chan string {
+	ch := make(chan string, len(m.Roles))
+	for _, role := range m.Roles {
+		ch <- role
+	}
+	close(ch)
+	return ch
+}
+
+type roleCursor struct {
+	roles []string
+}
+
+func (c *roleCursor) Next() (interface{}, bool) {
+	if len(c.roles) == 0 {
+		return nil, false
+	}
+	role := c.roles[0]
+	c.roles = c.roles[1:]
+	return role, true
+}
+
+func (m Member) RoleCursor() *roleCursor {
+	return &roleCursor{m.Roles}
+}
+
+func TestIterateChannelsAndNexters(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	o.RegisterClass(reflect.TypeOf(Member{}), nil)
+
+	o.LoadString("chan_role(m: Member, role) if role in m.RoleChan(); " +
+		"cursor_role(m: Member, role) if role in m.RoleCursor();")
+
+	member := Member{[]string{"reader", "writer"}}
+	for _, rule := range []string{"chan_role", "cursor_role"} {
+		results, errs := o.QueryRule(rule, member, ValueVariable("role"))
+		var got []interface{}
+		for r := range results {
+			got = append(got, r["role"])
+		}
+		if err := <-errs; err != nil {
+			t.Error(err.Error())
+		}
+		if expected := []interface{}{"reader", "writer"}; !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: expected %v, got %v", rule, expected, got)
+		}
+	}
+}
+
+func TestRegisterClassWithFields(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	if err = o.RegisterClassWithFields(reflect.TypeOf(Foo{}), nil, map[string]interface{}{"Missing": "String"}); err == nil {
+		t.Error("Expected error registering a field that doesn't exist")
+	}
+
+	if err = o.RegisterClassWithFields(reflect.TypeOf(Foo{}), MakeFoo, map[string]interface{}{"Name": "String"}); err != nil {
+		t.Fatalf("Register class failed: %v", err)
+	}
+
+	o.LoadString("name(x: Foo, y) if y = x.Name; num(x: Foo, y) if y = x.Num;")
+
+	if a, e := o.QueryRuleOnce("name", Foo{Name: "hello"}, "hello"); e != nil {
+		t.Error(e.Error())
+	} else if !a {
+		t.Error("Expected registered field to be readable")
+	}
+
+	if _, e := o.QueryRuleOnce("num", Foo{Num: 1}, 1); e == nil {
+		t.Error("Expected error reading an unregistered field")
+	} else if !strings.Contains(e.Error(), "not a registered field") {
+		t.Errorf("Unexpected error: %v", e)
+	}
+
+	// Lint finds the unregistered field without running a query.
+	warnings, err := o.Lint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || warnings[0].Kind != oso.LintUnregisteredField || warnings[0].Class != "Foo" || warnings[0].Field != "Num" {
+		t.Errorf("Expected a warning about Foo.Num, got %v", warnings)
+	}
+}
+
+func TestRegisterClassWithFieldTypes(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	if err = o.RegisterClassWithFields(reflect.TypeOf(Foo{}), nil, map[string]interface{}{"Name": reflect.TypeOf(0)}); err == nil {
+		t.Error("Expected error registering a string field as an integer")
+	}
+
+	if err = o.RegisterClassWithFields(reflect.TypeOf(Foo{}), nil, map[string]interface{}{
+		"Name": reflect.TypeOf(""),
+		"Num":  "Counter",
+	}); err != nil {
+		t.Fatalf("Register class failed: %v", err)
+	}
+	if err = o.LoadString("num(x: Foo, y) if y = x.Num;"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lint finds the field declared with a class that isn't registered.
+	warnings, err := o.Lint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || warnings[0].Kind != oso.LintUnregisteredFieldType || warnings[0].Class != "Foo" || warnings[0].Field != "Num" {
+		t.Errorf("Expected a warning about Foo.Num, got %v", warnings)
+	}
+}
+
+func TestExpressionError(t *testing.T) {
+	var o oso.Oso
+	var err error
+
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	if o.LoadString("f(x) if x > 2;") != nil {
+		t.Fatalf("Load string failed: %v", err)
+	}
+
+	_, errors := o.QueryRule("f", ValueVariable("x"))
+	err = <-errors
+
+	msg := err.Error()
+
+	if !strings.Contains(msg, "unbound") {
+		t.Error("Does not contain unbound in error message.")
+	}
+}
+
+func TestRuleTypes(t *testing.T) {
+	var o oso.Oso
+	var err error
+	var msg string
+
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	if err = o.RegisterClass(reflect.TypeOf(User{}), nil); err != nil {
+		t.Fatalf("Register class failed: %v", err)
+	}
+	if err = o.RegisterClass(reflect.TypeOf(Widget{}), nil); err != nil {
+		t.Fatalf("Register class failed: %v", err)
+	}
+
+	policy := "type is_actor(_actor: Actor); is_actor(_actor: Actor);"
+
+	if err = o.LoadString(policy); err != nil {
+		t.Fatalf("Load string failed: %v", err)
+	}
+	if err = o.ClearRules(); err != nil {
+		t.Fatalf("Clear rules failed: %v", err)
+	}
+
+	policy = "type is_actor(_actor: Actor); is_actor(_actor: Widget);"
 
 	if err = o.LoadString(policy); err == nil {
 		t.Fatalf("Failed to raise validation error.")
@@ -333,51 +2874,880 @@ func TestRuleTypes(t *testing.T) {
 	}
 }
 
-func TestZeroValueRepr(t *testing.T) {
-	ffiPolar := ffi.NewPolarFfi()
-	host := host.NewHost(ffiPolar)
-	polarValue, err := host.ToPolar(Foo{})
+func TestZeroValueRepr(t *testing.T) {
+	ffiPolar := ffi.NewPolarFfi()
+	host := host.NewHost(ffiPolar)
+	polarValue, err := host.ToPolar(Foo{})
+	if err != nil {
+		t.Fatalf("host.ToPolar failed: %v", err)
+	}
+	switch variant := polarValue.ValueVariant.(type) {
+	case ValueExternalInstance:
+		expected := "oso_test.Foo{Name: Num:0}"
+		if *variant.Repr != expected {
+			t.Errorf("repr didn't match!\n\tExpected: %v\n\tReceived: %#v", expected, *variant.Repr)
+		}
+	default:
+		t.Fatalf("Expected ValueExternalInstance; received: %v", variant)
+	}
+
+	polarValue, err = host.ToPolar(Foo{Name: "Zooey", Num: 42})
+	if err != nil {
+		t.Fatalf("host.ToPolar failed: %v", err)
+	}
+	switch variant := polarValue.ValueVariant.(type) {
+	case ValueExternalInstance:
+		expected := "oso_test.Foo{Name:Zooey Num:42}"
+		if *variant.Repr != expected {
+			t.Errorf("repr didn't match!\n\tExpected: %v\n\tReceived: %#v", expected, *variant.Repr)
+		}
+	default:
+		t.Fatalf("Expected ValueExternalInstance; received: %v", variant)
+	}
+}
+
+type Typ struct {
+	x int
+}
+
+func (t Typ) Method() int {
+	return t.x + 1
+}
+
+func (t *Typ) PtrMethod() bool {
+	return t.x == 1
+}
+
+func TestPointerMethods(t *testing.T) {
+	var o oso.Oso
+	var err error
+
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	if err = o.RegisterClass(reflect.TypeOf(Typ{}), nil); err != nil {
+		t.Fatalf("Register class failed: %v", err)
+	}
+
+	typ := Typ{x: 1}
+	if typ.Method() != 2 {
+		t.Errorf("Bad Method")
+	}
+	if !typ.PtrMethod() {
+		t.Errorf("Bad Method")
+	}
+
+	o.LoadString("rule1(x: Typ, y) if y = x.Method(); rule2(x: Typ, y) if y = x.PtrMethod();")
+
+	test := func(rule string, typ interface{}, y_val interface{}) {
+		results, errors := o.QueryRule(rule, typ, ValueVariable("y"))
+		if err = <-errors; err != nil {
+			t.Error(err.Error())
+		} else {
+			var got []map[string]interface{}
+			expected := map[string]interface{}{"y": y_val}
+			for elem := range results {
+				got = append(got, elem)
+			}
+			if len(got) > 1 {
+				t.Errorf("Received too many results: %v", got)
+			} else if !reflect.DeepEqual(got[0], expected) {
+				t.Errorf("Expected: %v, got: %v", expected, got[0])
+			}
+		}
+	}
+
+	test("rule1", typ, int64(2))
+	test("rule2", typ, true)
+}
+
+type Speaker interface {
+	Sound() string
+}
+
+type Dog struct{}
+
+func (d Dog) Sound() string {
+	return "woof"
+}
+
+type Cat struct{}
+
+func (c *Cat) Sound() string {
+	return "meow"
+}
+
+func TestRegisterClassTwice(t *testing.T) {
+	var o oso.Oso
+	var err error
+
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	if err = o.RegisterClass(reflect.TypeOf(Foo{}), MakeFoo); err != nil {
+		t.Fatalf("Register class failed: %v", err)
+	}
+	if err = o.RegisterClass(reflect.TypeOf(Foo{}), MakeFoo); err != nil {
+		t.Errorf("Re-registering the same class failed: %v", err)
+	}
+	if err = o.RegisterClassWithName(reflect.TypeOf(Widget{}), nil, "Foo"); err == nil {
+		t.Error("Expected error registering a different class under the same name")
+	} else if _, ok := err.(*errors.DuplicateClassAliasError); !ok {
+		t.Errorf("Expected DuplicateClassAliasError, got: %v", err)
+	}
+}
+
+func TestRegisterClassTwiceWithDifferentOptions(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	if err = o.RegisterClass(reflect.TypeOf(Folder{}), nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{
+		o.RegisterClassWithOptions(reflect.TypeOf(Folder{}), nil, oso.ClassOptions{Methods: []string{"IsOwner"}}),
+		o.RegisterClassWithOptions(reflect.TypeOf(Folder{}), nil, oso.ClassOptions{JSONTags: true}),
+		o.RegisterClass(reflect.TypeOf(Folder{}), func() Folder { return Folder{} }),
+	} {
+		if err == nil {
+			t.Error("Expected an error re-registering a class with different options")
+		}
+	}
+	// The methods the first registration allowed are still allowed.
+	o.LoadString("f(folder: Folder) if folder.Delete();")
+	if ok, err := o.QueryRuleOnce("f", &Folder{}); err != nil || !ok {
+		t.Errorf("Expected Delete to be callable, got %v, %v", ok, err)
+	}
+
+	// Registering with exactly the same options is still a no-op.
+	opts := oso.ClassOptions{Name: "Dir", Methods: []string{"IsOwner"}}
+	if err = o.RegisterClassWithOptions(reflect.TypeOf(Folder{}), nil, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err = o.RegisterClassWithOptions(reflect.TypeOf(Folder{}), nil, opts); err != nil {
+		t.Errorf("Re-registering with the same options failed: %v", err)
+	}
+}
+
+type Money struct {
+	Amount   int
+	Currency string
+	Memo     string
+}
+
+func TestRegisterClassWithEquals(t *testing.T) {
+	var o oso.Oso
+	var err error
+
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	equals := func(a, b interface{}) bool {
+		return a.(Money).Amount == b.(Money).Amount && a.(Money).Currency == b.(Money).Currency
+	}
+	if err = o.RegisterClassWithEquals(reflect.TypeOf(Money{}), nil, equals); err != nil {
+		t.Fatalf("Register class failed: %v", err)
+	}
+	o.LoadString(`
+		same(a: Money, b: Money) if a = b;
+		different(a: Money, b: Money) if a != b;
+	`)
+
+	tests := []struct {
+		rule     string
+		left     interface{}
+		right    interface{}
+		expected bool
+	}{
+		{"same", Money{100, "USD", "rent"}, Money{100, "USD", "food"}, true},
+		{"same", &Money{100, "USD", "rent"}, Money{100, "USD", "food"}, true},
+		{"same", Money{100, "USD", "rent"}, Money{100, "EUR", "rent"}, false},
+		{"different", Money{100, "USD", "rent"}, Money{100, "USD", "food"}, false},
+		{"different", Money{100, "USD", "rent"}, Money{200, "USD", "rent"}, true},
+	}
+	for _, test := range tests {
+		if a, e := o.QueryRuleOnce(test.rule, test.left, test.right); e != nil {
+			t.Error(e.Error())
+		} else if a != test.expected {
+			t.Errorf("%s(%v, %v): expected %v, got %v", test.rule, test.left, test.right, test.expected, a)
+		}
+	}
+
+	// Without an equality function, instances are compared with reflect.DeepEqual.
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.RegisterClass(reflect.TypeOf(Money{}), nil); err != nil {
+		t.Fatalf("Register class failed: %v", err)
+	}
+	o.LoadString("same(a: Money, b: Money) if a = b;")
+	if a, e := o.QueryRuleOnce("same", Money{100, "USD", "rent"}, Money{100, "USD", "food"}); e != nil {
+		t.Error(e.Error())
+	} else if a {
+		t.Error("Expected instances with different memos not to be equal")
+	}
+}
+
+func TestRegisterInterface(t *testing.T) {
+	var o oso.Oso
+	var err error
+
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	if err = o.RegisterClass(reflect.TypeOf((*Speaker)(nil)).Elem(), nil); err != nil {
+		t.Fatalf("Register class failed: %v", err)
+	}
+
+	o.LoadString("speaks(x: Speaker, y) if y = x.Sound();")
+
+	for _, c := range []struct {
+		speaker interface{}
+		sound   string
+	}{{Dog{}, "woof"}, {&Cat{}, "meow"}} {
+		if a, e := o.QueryRuleOnce("speaks", c.speaker, c.sound); e != nil {
+			t.Error(e.Error())
+		} else if !a {
+			t.Errorf("Expected %T to match Speaker", c.speaker)
+		}
+	}
+
+	if a, e := o.QueryRuleOnce("speaks", Foo{}, "woof"); e != nil {
+		t.Error(e.Error())
+	} else if a {
+		t.Error("Expected Foo not to match Speaker")
+	}
+}
+
+type BaseModel struct {
+	ID int
+}
+
+type Named struct {
+	BaseModel
+	Name string
+}
+
+type Account struct {
+	*Named
+	Email string
+}
+
+type Wallet struct {
+	Balance *big.Int
+}
+
+func (w Wallet) Deposit(amount *big.Int) *big.Int {
+	return new(big.Int).Add(w.Balance, amount)
+}
+
+func TestBigNumbers(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.RegisterClass(reflect.TypeOf(Wallet{}), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = o.LoadString(`
+		gt(a, b) if a > b;
+		eq(a, b) if a = b;
+		after(wallet: Wallet, amount, total) if total = wallet.Deposit(amount);
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		rule     string
+		args     []interface{}
+		expected bool
+	}{
+		{"gt", []interface{}{big.NewInt(10), 5}, true},
+		{"gt", []interface{}{big.NewInt(10), big.NewInt(20)}, false},
+		{"eq", []interface{}{big.NewInt(7), 7}, true},
+		{"eq", []interface{}{big.NewFloat(0.5), 0.5}, true},
+		{"gt", []interface{}{big.NewFloat(1.5), 1.25}, true},
+		{"gt", []interface{}{1.5, 1.25}, true},
+		{"after", []interface{}{Wallet{Balance: big.NewInt(100)}, 5, 105}, true},
+	}
+	for _, test := range tests {
+		if ok, err := o.QueryRuleOnce(test.rule, test.args...); err != nil {
+			t.Errorf("%s%v: %v", test.rule, test.args, err)
+		} else if ok != test.expected {
+			t.Errorf("%s%v: expected %v, got %v", test.rule, test.args, test.expected, ok)
+		}
+	}
+
+	huge, _ := new(big.Int).SetString("100000000000000000000", 10)
+	if _, err = o.QueryRuleOnce("eq", huge, 1); err == nil {
+		t.Error("Expected an error converting an integer that doesn't fit in an int64")
+	}
+
+	// Numbers from Polar can be decoded into *big.Int and *big.Float fields.
+	query, err := o.NewQueryFromStr("x = 12345 and y = 2.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result struct {
+		X *big.Int
+		Y *big.Float
+	}
+	if ok, err := query.NextInto(&result); err != nil || !ok {
+		t.Fatalf("Expected a result, got %v, %v", ok, err)
+	}
+	if result.X.Cmp(big.NewInt(12345)) != 0 {
+		t.Errorf("Expected 12345, got %v", result.X)
+	}
+	if result.Y.Cmp(big.NewFloat(2.5)) != 0 {
+		t.Errorf("Expected 2.5, got %v", result.Y)
+	}
+}
+
+type Credentials struct {
+	PasswordHash string `polar:"-"`
+}
+
+type Login struct {
+	Credentials
+	Username string `polar:"user_name"`
+	Token    string `polar:"-" json:"token"`
+	Email    string `json:"email"`
+}
+
+func TestPolarStructTags(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	err = o.RegisterClassWithOptions(reflect.TypeOf(Login{}), nil, oso.ClassOptions{JSONTags: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	login := Login{
+		Credentials: Credentials{PasswordHash: "secret"},
+		Username:    "alice",
+		Token:       "token",
+		Email:       "alice@example.com",
+	}
+
+	for _, query := range []string{
+		`login.user_name = "alice"`,
+		`login.email = "alice@example.com"`,
+	} {
+		q, err := o.QueryWithBindings(query, map[string]interface{}{"login": login})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results, err := q.GetAllResults(); err != nil || len(results) != 1 {
+			t.Errorf("Expected %s to succeed, got %v, %v", query, results, err)
+		}
+	}
+
+	// Hidden fields, and renamed fields by their Go names, are unknown.
+	for _, query := range []string{
+		"x = login.PasswordHash",
+		"x = login.password_hash",
+		"x = login.Token",
+		"x = login.token",
+		"x = login.Username",
+	} {
+		q, err := o.QueryWithBindings(query, map[string]interface{}{"login": login})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results, err := q.GetAllResults(); err == nil {
+			t.Errorf("Expected %s to fail, got %v", query, results)
+		}
+	}
+
+	expected := map[string]interface{}{"user_name": "alice", "Email": "alice@example.com"}
+	if dict := oso.AsDict(login); !reflect.DeepEqual(dict, expected) {
+		t.Errorf("Expected %v, got %v", expected, dict)
+	}
+}
+
+func TestAsDict(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.LoadString(`check(request) if request.Name = "alice" and request.ID = 1 and request matches {Email: "a@example.com"};`); err != nil {
+		t.Fatal(err)
+	}
+
+	account := &Account{Named: &Named{BaseModel: BaseModel{ID: 1}, Name: "alice"}, Email: "a@example.com"}
+	expected := map[string]interface{}{"ID": 1, "Name": "alice", "Email": "a@example.com"}
+	if dict := oso.AsDict(account); !reflect.DeepEqual(dict, expected) {
+		t.Errorf("Expected %v, got %v", expected, dict)
+	}
+	if ok, err := o.QueryRuleOnce("check", oso.AsDict(account)); err != nil || !ok {
+		t.Errorf("Expected check to succeed, got %v, %v", ok, err)
+	}
+
+	// Nothing is promoted through a nil embedded pointer.
+	expected = map[string]interface{}{"Email": "b@example.com"}
+	if dict := oso.AsDict(Account{Email: "b@example.com"}); !reflect.DeepEqual(dict, expected) {
+		t.Errorf("Expected %v, got %v", expected, dict)
+	}
+	if dict := oso.AsDict("not a struct"); dict != nil {
+		t.Errorf("Expected nil for a value that isn't a struct, got %v", dict)
+	}
+}
+
+func TestEmbeddedFields(t *testing.T) {
+	var o oso.Oso
+	var err error
+
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	o.LoadString(`
+		named(account, name) if account.Name = name;
+		id(account, id) if account.ID = id;
+	`)
+
+	account := Account{Named: &Named{BaseModel: BaseModel{ID: 7}, Name: "alice"}, Email: "alice@example.com"}
+	if a, e := o.QueryRuleOnce("named", account, "alice"); e != nil {
+		t.Error(e.Error())
+	} else if !a {
+		t.Error("Expected to look up Name promoted from an embedded pointer")
+	}
+	if a, e := o.QueryRuleOnce("id", &account, 7); e != nil {
+		t.Error(e.Error())
+	} else if !a {
+		t.Error("Expected to look up ID promoted through two embedded structs")
+	}
+
+	if _, e := o.QueryRuleOnce("id", Account{}, 7); e == nil {
+		t.Error("Expected an error looking up a field through a nil embedded pointer")
+	}
+}
+
+type Article struct {
+	CreatedAt int
+	OwnerID   string
+	title     string
+}
+
+func TestSnakeCaseFields(t *testing.T) {
+	var o oso.Oso
+	var err error
+
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	post := Article{CreatedAt: 10, OwnerID: "alice", title: "hello"}
+	tests := []struct {
+		query    string
+		expected bool
+	}{
+		{"post.created_at = 10", true},
+		{"post.CreatedAt = 10", true},
+		{"post.owner_id = \"alice\"", true},
+		{"post.ownerId = \"alice\"", true},
+	}
+	for _, test := range tests {
+		query, err := o.QueryWithBindings(test.query, map[string]interface{}{"post": post})
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, err := query.GetAllResults()
+		if err != nil {
+			t.Errorf("%s: %v", test.query, err)
+		} else if (len(results) > 0) != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.query, test.expected, results)
+		}
+	}
+
+	// Unexported fields still can't be read.
+	query, err := o.QueryWithBindings("post.title = \"hello\"", map[string]interface{}{"post": post})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = query.GetAllResults(); err == nil {
+		t.Error("Expected an error reading an unexported field")
+	}
+}
+
+type Audited struct {
+	UpdatedBy string `json:"updated_by"`
+}
+
+type Invoice struct {
+	Audited
+	Customer string `json:"customer_name,omitempty"`
+	Secret   string `json:"-"`
+}
+
+func TestJSONTagFields(t *testing.T) {
+	var o oso.Oso
+	var err error
+
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	if err = o.RegisterClassWithOptions(reflect.TypeOf(Invoice{}), nil, oso.ClassOptions{JSONTags: true}); err != nil {
+		t.Fatalf("Register class failed: %v", err)
+	}
+
+	invoice := Invoice{Audited{"bob"}, "alice", "hunter2"}
+	tests := []struct {
+		query    string
+		expected bool
+	}{
+		{"invoice.customer_name = \"alice\"", true},
+		{"invoice.Customer = \"alice\"", true},
+		{"invoice.updated_by = \"bob\"", true},
+		{"invoice.Secret = \"hunter2\"", true},
+	}
+	for _, test := range tests {
+		query, err := o.QueryWithBindings(test.query, map[string]interface{}{"invoice": invoice})
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, err := query.GetAllResults()
+		if err != nil {
+			t.Errorf("%s: %v", test.query, err)
+		} else if (len(results) > 0) != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.query, test.expected, results)
+		}
+	}
+
+	// Built with reflect, since vet rejects repeated json tags in literal types.
+	conflicting := reflect.StructOf([]reflect.StructField{
+		{Name: "A", Type: reflect.TypeOf(""), Tag: `json:"name"`},
+		{Name: "B", Type: reflect.TypeOf(""), Tag: `json:"name"`},
+	})
+	if err = o.RegisterClassWithOptions(conflicting, nil, oso.ClassOptions{Name: "Conflicting", JSONTags: true}); err == nil {
+		t.Error("Expected an error registering a class with conflicting json tags")
+	}
+}
+
+type Folder struct {
+	Owner   string
+	deleted bool
+}
+
+func (f Folder) IsOwner(name string) bool {
+	return f.Owner == name
+}
+
+func (f *Folder) Delete() bool {
+	f.deleted = true
+	return true
+}
+
+type Project struct {
+	Name string
+	ID   int
+}
+
+type ProjectOptions struct {
+	Name string
+	ID   int `json:"project_id"`
+}
+
+func NewProject(opts ProjectOptions) *Project {
+	return &Project{Name: opts.Name, ID: opts.ID}
+}
+
+func TestConstructorStyle(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	err = o.RegisterClassWithOptions(reflect.TypeOf(Project{}), NewProject, oso.ClassOptions{
+		ConstructorStyle: oso.ConstructorStruct,
+	})
 	if err != nil {
-		t.Fatalf("host.ToPolar failed: %v", err)
+		t.Fatal(err)
 	}
-	switch variant := polarValue.ValueVariant.(type) {
-	case ValueExternalInstance:
-		expected := "oso_test.Foo{Name: Num:0}"
-		if *variant.Repr != expected {
-			t.Errorf("repr didn't match!\n\tExpected: %v\n\tReceived: %#v", expected, *variant.Repr)
+	queryOnce := func(s string) (bool, error) {
+		query, err := o.NewQueryFromStr(s)
+		if err != nil {
+			return false, err
+		}
+		results, err := query.GetAllResults()
+		return len(results) > 0, err
+	}
+	for _, query := range []string{
+		`x = new Project(name: "oso", project_id: 1) and x.Name = "oso" and x.ID = 1`,
+		`x = new Project({name: "oso", project_id: 1}) and x.Name = "oso" and x.ID = 1`,
+	} {
+		if ok, err := queryOnce(query); err != nil || !ok {
+			t.Errorf("Expected %s to succeed, got %v, %v", query, ok, err)
 		}
-	default:
-		t.Fatalf("Expected ValueExternalInstance; received: %v", variant)
 	}
 
-	polarValue, err = host.ToPolar(Foo{Name: "Zooey", Num: 42})
+	// Keyword arguments are an error for positional constructors.
+	if err = o.RegisterClassWithName(reflect.TypeOf(Project{}), func(name string) *Project {
+		return &Project{Name: name}
+	}, "PositionalProject"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := queryOnce(`x = new PositionalProject("oso") and x.Name = "oso"`); err != nil || !ok {
+		t.Errorf("Expected a positional constructor to succeed, got %v, %v", ok, err)
+	}
+	if _, err = queryOnce(`x = new PositionalProject(name: "oso")`); err == nil {
+		t.Error("Expected an error passing keyword arguments to a positional constructor")
+	}
+
+	// Struct constructors must take a single struct.
+	err = o.RegisterClassWithOptions(reflect.TypeOf(Project{}), func(name string, id int) *Project {
+		return &Project{Name: name, ID: id}
+	}, oso.ClassOptions{Name: "BadProject", ConstructorStyle: oso.ConstructorStruct})
+	if err == nil {
+		t.Error("Expected an error registering a struct constructor with two parameters")
+	}
+}
+
+func TestRegisterClassAliases(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.RegisterClassAliases(reflect.TypeOf(User{}), "User", "Account"); err != nil {
+		t.Fatal(err)
+	}
+	if err = o.LoadString(`
+		is_user(_: User);
+		is_account(_: Account);
+		both(x) if x matches User and x matches Account;
+	`); err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range []string{"is_user", "is_account", "both"} {
+		if ok, err := o.QueryRuleOnce(rule, &User{Name: "alice"}); err != nil || !ok {
+			t.Errorf("Expected %s to match, got %v, %v", rule, ok, err)
+		}
+		if ok, err := o.QueryRuleOnce(rule, Widget{Id: 1}); err != nil || ok {
+			t.Errorf("Expected %s not to match a Widget, got %v, %v", rule, ok, err)
+		}
+	}
+
+	// None of the names are registered if one is taken.
+	if err = o.RegisterClassWithName(reflect.TypeOf(Widget{}), nil, "Gizmo"); err != nil {
+		t.Fatal(err)
+	}
+	if err = o.RegisterClassAliases(reflect.TypeOf(Company{}), "Firm", "Gizmo"); err == nil {
+		t.Fatal("Expected an error registering an alias that is taken")
+	}
+	for _, name := range o.RegisteredClasses() {
+		if name == "Firm" {
+			t.Error("Expected Firm not to be registered")
+		}
+	}
+}
+
+func TestRegisterClassWithMethods(t *testing.T) {
+	var o oso.Oso
+	var err error
+
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.RegisterClassWithOptions(reflect.TypeOf(Folder{}), nil, oso.ClassOptions{Methods: []string{"IsOwner"}}); err != nil {
+		t.Fatal(err)
+	}
+	err = o.LoadString(`
+		owns(name, folder: Folder) if folder.IsOwner(name);
+		deletes(folder: Folder) if folder.Delete();
+		owner(folder: Folder, name) if folder.Owner = name;
+	`)
 	if err != nil {
-		t.Fatalf("host.ToPolar failed: %v", err)
+		t.Fatal(err)
 	}
-	switch variant := polarValue.ValueVariant.(type) {
-	case ValueExternalInstance:
-		expected := "oso_test.Foo{Name:Zooey Num:42}"
-		if *variant.Repr != expected {
-			t.Errorf("repr didn't match!\n\tExpected: %v\n\tReceived: %#v", expected, *variant.Repr)
+
+	folder := &Folder{Owner: "alice"}
+	if ok, err := o.QueryRuleOnce("owns", "alice", folder); err != nil || !ok {
+		t.Errorf("Expected an allowed method to be callable, got %v, %v", ok, err)
+	}
+	if ok, err := o.QueryRuleOnce("owner", folder, "alice"); err != nil || !ok {
+		t.Errorf("Expected fields to be unaffected, got %v, %v", ok, err)
+	}
+	if _, err = o.QueryRuleOnce("deletes", folder); err == nil {
+		t.Error("Expected calling a method that isn't allowed to fail")
+	} else if !strings.Contains(err.Error(), "'Delete' is not a registered method of class Folder") {
+		t.Errorf("Expected an unregistered method error, got: %v", err)
+	}
+	if folder.deleted {
+		t.Error("Expected the method that isn't allowed not to be called")
+	}
+
+	if err = o.RegisterClassWithOptions(reflect.TypeOf(Folder{}), nil, oso.ClassOptions{Name: "BadFolder", Methods: []string{"Rename"}}); err == nil {
+		t.Error("Expected an error registering a method the class doesn't have")
+	}
+}
+
+type Parrot struct {
+	secrets []string
+}
+
+func (p Parrot) Sound() string {
+	return "squawk"
+}
+
+func (p *Parrot) Repeat(secret string) bool {
+	p.secrets = append(p.secrets, secret)
+	return true
+}
+
+func TestRegisterInterfaceWithMethods(t *testing.T) {
+	var o oso.Oso
+	var err error
+
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	speaker := reflect.TypeOf((*Speaker)(nil)).Elem()
+	if err = o.RegisterClassWithOptions(speaker, nil, oso.ClassOptions{Methods: []string{"Sound"}}); err != nil {
+		t.Fatal(err)
+	}
+	err = o.LoadString(`
+		speaks(x: Speaker, y) if y = x.Sound();
+		repeats(x: Speaker, y) if x.Repeat(y);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parrot := &Parrot{}
+	if ok, err := o.QueryRuleOnce("speaks", parrot, "squawk"); err != nil || !ok {
+		t.Errorf("Expected an allowed method to be callable, got %v, %v", ok, err)
+	}
+	if _, err = o.QueryRuleOnce("repeats", parrot, "secret"); err == nil {
+		t.Error("Expected calling a method that isn't allowed to fail")
+	} else if !strings.Contains(err.Error(), "'Repeat' is not a registered method of class Speaker") {
+		t.Errorf("Expected an unregistered method error, got: %v", err)
+	}
+	if len(parrot.secrets) != 0 {
+		t.Error("Expected the method that isn't allowed not to be called")
+	}
+}
+
+func MakeFooPtr(name string, num int) *Foo {
+	return &Foo{name, num}
+}
+
+func (u User) SameName(other *User) bool {
+	return other != nil && u.Name == other.Name
+}
+
+func TestPointerClasses(t *testing.T) {
+	var o oso.Oso
+	var err error
+
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	if err = o.RegisterClass(reflect.TypeOf(&User{}), nil); err != nil {
+		t.Fatalf("Register class failed: %v", err)
+	}
+	if err = o.RegisterClass(reflect.TypeOf(Foo{}), MakeFooPtr); err != nil {
+		t.Fatalf("Register class failed: %v", err)
+	}
+
+	o.LoadString("is_user(_: User); " +
+		"same(a: User, b: User) if a.SameName(b); " +
+		"not_same(a: User) if not a.SameName(nil); " +
+		"foo_name(y) if x = new Foo(\"hello\", 1) and x matches Foo and y = x.Name;")
+
+	for _, u := range []interface{}{User{"sam"}, &User{"sam"}} {
+		if a, e := o.QueryRuleOnce("is_user", u); e != nil {
+			t.Error(e.Error())
+		} else if !a {
+			t.Errorf("Expected %#v to match User", u)
 		}
-	default:
-		t.Fatalf("Expected ValueExternalInstance; received: %v", variant)
+	}
+	if a, e := o.QueryRuleOnce("same", &User{"sam"}, User{"sam"}); e != nil {
+		t.Error(e.Error())
+	} else if !a {
+		t.Error("Expected User value to be passed as *User argument")
+	}
+	if a, e := o.QueryRuleOnce("not_same", User{"sam"}); e != nil {
+		t.Error(e.Error())
+	} else if !a {
+		t.Error("Expected nil to be passed as a nil *User argument")
+	}
+	if a, e := o.QueryRuleOnce("foo_name", "hello"); e != nil {
+		t.Error(e.Error())
+	} else if !a {
+		t.Error("Expected constructor returning *Foo to create a Foo")
 	}
 }
 
-type Typ struct {
-	x int
+type Counter struct {
+	Count int
 }
 
-func (t Typ) Method() int {
-	return t.x + 1
+func (c *Counter) Incr() bool {
+	c.Count++
+	return true
 }
 
-func (t *Typ) PtrMethod() bool {
-	return t.x == 1
+func TestInstanceIdentity(t *testing.T) {
+	var o oso.Oso
+	var err error
+
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	if err = o.RegisterClass(reflect.TypeOf(Counter{}), nil); err != nil {
+		t.Fatalf("Register class failed: %v", err)
+	}
+
+	o.LoadString("same(x: Counter, y) if y = x; incr(x: Counter) if x.Incr() and x.Count = 1;")
+
+	original := &Counter{}
+	query, err := o.NewQueryFromRule("same", original, ValueVariable("y"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := query.Next(); err != nil {
+		t.Fatal(err)
+	} else if r == nil {
+		t.Fatal("Expected result, got none")
+	} else if result, ok := (*r)["y"].(*Counter); !ok || result != original {
+		t.Errorf("Expected the original instance %p, got %#v", original, (*r)["y"])
+	}
+
+	if a, e := o.QueryRuleOnce("incr", original); e != nil {
+		t.Error(e.Error())
+	} else if !a {
+		t.Error("QueryRuleOnce returned false, expected true")
+	}
+	if original.Count != 1 {
+		t.Errorf("Expected method with pointer receiver to update the original instance, got %#v", original)
+	}
 }
 
-func TestPointerMethods(t *testing.T) {
+type Role string
+
+const (
+	RoleAdmin  Role = "admin"
+	RoleMember Role = "member"
+)
+
+type Level int
+
+func TestNamedBasicTypes(t *testing.T) {
 	var o oso.Oso
 	var err error
 
@@ -385,40 +3755,129 @@ func TestPointerMethods(t *testing.T) {
 		t.Fatalf("Failed to set up Oso: %v", err)
 	}
 
-	if err = o.RegisterClass(reflect.TypeOf(Typ{}), nil); err != nil {
+	if err = o.RegisterClass(reflect.TypeOf(RoleAdmin), nil); err != nil {
+		t.Fatalf("Register class failed: %v", err)
+	}
+	if err = o.RegisterClass(reflect.TypeOf(Level(0)), nil); err != nil {
 		t.Fatalf("Register class failed: %v", err)
 	}
 
-	typ := Typ{x: 1}
-	if typ.Method() != 2 {
-		t.Errorf("Bad Method")
+	o.LoadString("is_admin(role: Role) if role = \"admin\"; " +
+		"is_role(_: Role); " +
+		"is_senior(level: Level) if level >= 3;")
+
+	tests := []struct {
+		rule     string
+		arg      interface{}
+		expected bool
+	}{
+		{"is_admin", RoleAdmin, true},
+		{"is_admin", RoleMember, false},
+		{"is_admin", "admin", false},
+		{"is_role", RoleMember, true},
+		{"is_role", "member", false},
+		{"is_senior", Level(3), true},
+		{"is_senior", Level(2), false},
 	}
-	if !typ.PtrMethod() {
-		t.Errorf("Bad Method")
+	for _, test := range tests {
+		if a, e := o.QueryRuleOnce(test.rule, test.arg); e != nil {
+			t.Error(e.Error())
+		} else if a != test.expected {
+			t.Errorf("%s(%#v): expected %v, got %v", test.rule, test.arg, test.expected, a)
+		}
 	}
+}
 
-	o.LoadString("rule1(x: Typ, y) if y = x.Method(); rule2(x: Typ, y) if y = x.PtrMethod();")
+type Cents int64
 
-	test := func(rule string, typ interface{}, y_val interface{}) {
-		results, errors := o.QueryRule(rule, typ, ValueVariable("y"))
-		if err = <-errors; err != nil {
-			t.Error(err.Error())
-		} else {
-			var got []map[string]interface{}
-			expected := map[string]interface{}{"y": y_val}
-			for elem := range results {
-				got = append(got, elem)
-			}
-			if len(got) > 1 {
-				t.Errorf("Received too many results: %v", got)
-			} else if !reflect.DeepEqual(got[0], expected) {
-				t.Errorf("Expected: %v, got: %v", expected, got[0])
-			}
+type Item struct {
+	Price Cents
+}
+
+func TestNamedNumericComparisons(t *testing.T) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+	if err = o.RegisterClass(reflect.TypeOf(Cents(0)), nil); err != nil {
+		t.Fatalf("Register class failed: %v", err)
+	}
+	if err = o.RegisterClass(reflect.TypeOf(Item{}), nil); err != nil {
+		t.Fatalf("Register class failed: %v", err)
+	}
+	o.LoadString(`
+		pricier(a: Item, b: Item) if a.Price > b.Price;
+		expensive(a: Item) if a.Price > 100 and 1000 >= a.Price;
+		cheap(a: Item) if 99.5 > a.Price;
+		is_cents(a: Item) if a.Price matches Cents;`)
+
+	tests := []struct {
+		rule     string
+		args     []interface{}
+		expected bool
+	}{
+		{"pricier", []interface{}{Item{200}, Item{100}}, true},
+		{"pricier", []interface{}{Item{100}, Item{200}}, false},
+		{"expensive", []interface{}{Item{500}}, true},
+		{"expensive", []interface{}{Item{100}}, false},
+		{"expensive", []interface{}{Item{1001}}, false},
+		{"cheap", []interface{}{Item{99}}, true},
+		{"cheap", []interface{}{Item{100}}, false},
+		{"is_cents", []interface{}{Item{1}}, true},
+	}
+	for _, test := range tests {
+		if a, e := o.QueryRuleOnce(test.rule, test.args...); e != nil {
+			t.Errorf("%s%v: %v", test.rule, test.args, e)
+		} else if a != test.expected {
+			t.Errorf("%s%v: expected %v, got %v", test.rule, test.args, test.expected, a)
 		}
 	}
+}
 
-	test("rule1", typ, int64(2))
-	test("rule2", typ, true)
+type Post struct {
+	CreatedAt time.Time
+}
+
+func TestTimeValues(t *testing.T) {
+	var o oso.Oso
+	var err error
+
+	if o, err = oso.NewOso(); err != nil {
+		t.Fatalf("Failed to set up Oso: %v", err)
+	}
+
+	o.LoadString("older(a, b) if a.CreatedAt < b.CreatedAt; " +
+		"same(a, b) if a.CreatedAt = b.CreatedAt; " +
+		"id(x, x);")
+
+	utc := time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC)
+	est := utc.In(time.FixedZone("EST", -5*60*60))
+	later := utc.Add(time.Hour)
+
+	if a, e := o.QueryRuleOnce("older", Post{utc}, Post{later}); e != nil {
+		t.Error(e.Error())
+	} else if !a {
+		t.Error("Expected earlier time to be less than later time")
+	}
+	if a, e := o.QueryRuleOnce("older", Post{later}, Post{utc}); e != nil {
+		t.Error(e.Error())
+	} else if a {
+		t.Error("Expected later time not to be less than earlier time")
+	}
+	if a, e := o.QueryRuleOnce("same", Post{utc}, Post{est}); e != nil {
+		t.Error(e.Error())
+	} else if !a {
+		t.Error("Expected the same instant in different locations to be equal")
+	}
+
+	results, errors := o.QueryRule("id", est, ValueVariable("y"))
+	if err = <-errors; err != nil {
+		t.Fatal(err)
+	}
+	if r := <-results; !reflect.DeepEqual(r["y"], est) {
+		t.Errorf("Expected %v to round-trip, got %v", est, r["y"])
+	}
 }
 
 func TestFailingALot(t *testing.T) {
@@ -443,3 +3902,63 @@ func TestFailingALot(t *testing.T) {
 		}
 	}
 }
+
+func BenchmarkQueryRule(b *testing.B) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		b.Fatalf("Failed to set up Oso: %v", err)
+	}
+	// Each registered class adds to the host's registry, which queries share
+	// instead of copying.
+	for _, cls := range []interface{}{Foo{}, Counter{}, Member{}, Obj{}} {
+		if err = o.RegisterClass(reflect.TypeOf(cls), nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err = o.LoadString("f(x) if x = 1;"); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		query, err := o.NewQueryFromRule("f", 1)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err = query.GetAllResults(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkQueryRuleWithConstants(b *testing.B) {
+	var o oso.Oso
+	var err error
+	if o, err = oso.NewOso(); err != nil {
+		b.Fatalf("Failed to set up Oso: %v", err)
+	}
+	// Instances registered as constants are kept in the registry, so queries
+	// see them without copying them, however many there are.
+	for i := 0; i < 1000; i++ {
+		if err = o.RegisterConstant(&Foo{Name: fmt.Sprintf("foo%d", i), Num: i}, fmt.Sprintf("Foo%d", i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err = o.LoadString("f(x) if x = Foo999.Num;"); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		query, err := o.NewQueryFromRule("f", 999)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err = query.GetAllResults(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package oso
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/osohq/go-oso/internal/ffi"
+	"github.com/osohq/go-oso/types"
+)
+
+// The kind of a TraceEvent.
+type TraceKind string
+
+const (
+	// A message printed by the Polar VM while evaluating a query, such as a
+	// rule being queried or two terms being unified. The VM only prints these
+	// messages when tracing is enabled, with Oso.SetTraceEnabled or the
+	// POLAR_LOG environment variable.
+	TraceMessage TraceKind = "message"
+	// A warning printed by the Polar VM.
+	TraceWarning TraceKind = "warning"
+	// Polar looked up a field or called a method on a Go value.
+	TraceExternalCall TraceKind = "external_call"
+	// Polar constructed a Go value with `new`.
+	TraceMakeExternal TraceKind = "make_external"
+	// Polar checked whether a Go value is an instance of a class.
+	TraceExternalIsa TraceKind = "external_isa"
+	// Polar compared two Go values.
+	TraceExternalOp TraceKind = "external_op"
+	// The query produced a result.
+	TraceQueryResult TraceKind = "result"
+)
+
+/*
+An event that happened while running a query, passed to the logger set with
+Oso.SetLogger.
+*/
+type TraceEvent struct {
+	Kind TraceKind
+	// A description of the event, e.g. "calling method Sound on Dog" or the
+	// text of a message printed by the Polar VM. Go values are described by
+	// their Polar class, not their contents.
+	Message string
+	// For TraceExternalCall and TraceExternalIsa events, the Go value Polar
+	// called a method on, looked up a field of, or checked the class of.
+	Instance interface{}
+	// For TraceExternalCall events, the name of the method or field; for
+	// TraceMakeExternal and TraceExternalIsa events, the name of the class.
+	Attribute string
+}
+
+// How queries report what happens while they run.
+type tracer struct {
+	// Receives events, if non-nil.
+	logger func(event TraceEvent)
+	// Whether the Polar VM traces policy evaluation, regardless of POLAR_LOG.
+	enabled bool
+	// Where the VM's messages are written while tracing is enabled.
+	writer io.Writer
+}
+
+// Pass an event to the query's logger, if it has one.
+func (q Query) trace(event TraceEvent) {
+	if q.tracer.logger != nil {
+		q.tracer.logger(event)
+	}
+}
+
+// Handle a message printed by the Polar VM while running the query. Messages
+// are passed to the logger as well as printed, as they would be without one.
+func (q Query) handleMessage(message types.Message) {
+	event := TraceEvent{Kind: TraceMessage, Message: message.Msg}
+	if _, ok := message.Kind.MessageKindVariant.(types.MessageKindWarning); ok {
+		event.Kind = TraceWarning
+	}
+	switch {
+	case !q.tracer.enabled:
+		ffi.PrintMessage(message)
+	case event.Kind == TraceWarning:
+		fmt.Fprintf(q.tracer.writer, "WARNING: %s\n", message.Msg)
+	default:
+		fmt.Fprintf(q.tracer.writer, "%s\n", message.Msg)
+	}
+	q.trace(event)
+}
+
+func (q Query) traceExternalCall(term types.Term, instance interface{}, attribute string, isMethod bool) {
+	if q.tracer.logger == nil {
+		return
+	}
+	class := q.host.ClassOf(term, instance)
+	message := fmt.Sprintf("looking up field %s on %s", attribute, class)
+	if isMethod {
+		message = fmt.Sprintf("calling method %s on %s", attribute, class)
+	}
+	q.trace(TraceEvent{Kind: TraceExternalCall, Message: message, Instance: instance, Attribute: attribute})
+}
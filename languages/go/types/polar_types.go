@@ -1996,6 +1996,18 @@ type Rule struct {
 	Required bool `json:"required"`
 }
 
+// RuleSource struct
+type RuleSource struct {
+	// Src
+	Src string `json:"src"`
+	// Filename
+	Filename *string `json:"filename"`
+	// Line
+	Line uint64 `json:"line"`
+	// Column
+	Column uint64 `json:"column"`
+}
+
 // RuntimeErrorArithmeticError struct
 type RuntimeErrorArithmeticError struct {
 	// Msg
@@ -2329,6 +2341,8 @@ type TraceResult struct {
 	Trace Trace `json:"trace"`
 	// Formatted
 	Formatted string `json:"formatted"`
+	// RuleSource
+	RuleSource *RuleSource `json:"rule_source"`
 }
 
 // ValidationErrorMissingRequiredRule struct
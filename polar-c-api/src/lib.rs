@@ -6,6 +6,11 @@ use std::ffi::{CStr, CString};
 use std::os::raw::c_char;
 use std::panic::{catch_unwind, AssertUnwindSafe};
 use std::ptr::{null, null_mut};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::Arc;
+
+/// Cancels the query it was created for, from any thread.
+pub struct CancelHandle(Arc<AtomicBool>);
 
 /// Get a reference to an object from a pointer
 macro_rules! ffi_ref {
@@ -72,11 +77,28 @@ pub extern "C" fn polar_get_error() -> *const c_char {
     })
 }
 
+#[no_mangle]
+pub extern "C" fn polar_version() -> *const c_char {
+    ffi_try!({
+        CString::new(env!("CARGO_PKG_VERSION"))
+            .expect("Version should not contain any 0 bytes")
+            .into_raw()
+    })
+}
+
 #[no_mangle]
 pub extern "C" fn polar_new() -> *mut Polar {
     ffi_try!({ box_ptr!(Polar::new()) })
 }
 
+#[no_mangle]
+pub extern "C" fn polar_fork(polar_ptr: *mut Polar) -> *mut Polar {
+    ffi_try!({
+        let polar = unsafe { ffi_ref!(polar_ptr) };
+        box_ptr!(polar.fork())
+    })
+}
+
 #[no_mangle]
 pub extern "C" fn polar_load(polar_ptr: *mut Polar, sources: *const c_char) -> i32 {
     ffi_try!({
@@ -93,6 +115,32 @@ pub extern "C" fn polar_load(polar_ptr: *mut Polar, sources: *const c_char) -> i
     })
 }
 
+#[no_mangle]
+pub extern "C" fn polar_load_with_diagnostics(
+    polar_ptr: *mut Polar,
+    sources: *const c_char,
+) -> *const c_char {
+    ffi_try!({
+        let polar = unsafe { ffi_ref!(polar_ptr) };
+        let sources = unsafe { ffi_string!(sources) };
+        let diagnostics = serde_json::from_str(&sources)
+            .map_err(|e| error::RuntimeError::Serialization { msg: e.to_string() }.into())
+            .and_then(|sources| polar.load_with_diagnostics(sources));
+        match diagnostics {
+            Ok(diagnostics) => {
+                let diagnostics_json = serde_json::to_string(&diagnostics).unwrap();
+                CString::new(diagnostics_json)
+                    .expect("JSON should not contain any 0 bytes")
+                    .into_raw()
+            }
+            Err(e) => {
+                set_error(e);
+                null()
+            }
+        }
+    })
+}
+
 #[no_mangle]
 pub extern "C" fn polar_clear_rules(polar_ptr: *mut Polar) -> i32 {
     ffi_try!({
@@ -221,6 +269,50 @@ pub extern "C" fn polar_next_polar_message(polar_ptr: *mut Polar) -> *const c_ch
     })
 }
 
+#[no_mangle]
+pub extern "C" fn polar_rule_names(polar_ptr: *mut Polar) -> *const c_char {
+    ffi_try!({
+        let polar = unsafe { ffi_ref!(polar_ptr) };
+        let names_json = serde_json::to_string(&polar.rule_names()).unwrap();
+        CString::new(names_json)
+            .expect("JSON should not contain any 0 bytes")
+            .into_raw()
+    })
+}
+
+#[no_mangle]
+pub extern "C" fn polar_unregistered_classes(polar_ptr: *mut Polar) -> *const c_char {
+    ffi_try!({
+        let polar = unsafe { ffi_ref!(polar_ptr) };
+        let classes_json = serde_json::to_string(&polar.unregistered_classes()).unwrap();
+        CString::new(classes_json)
+            .expect("JSON should not contain any 0 bytes")
+            .into_raw()
+    })
+}
+
+#[no_mangle]
+pub extern "C" fn polar_referenced_classes(polar_ptr: *mut Polar) -> *const c_char {
+    ffi_try!({
+        let polar = unsafe { ffi_ref!(polar_ptr) };
+        let classes_json = serde_json::to_string(&polar.referenced_classes()).unwrap();
+        CString::new(classes_json)
+            .expect("JSON should not contain any 0 bytes")
+            .into_raw()
+    })
+}
+
+#[no_mangle]
+pub extern "C" fn polar_referenced_fields(polar_ptr: *mut Polar) -> *const c_char {
+    ffi_try!({
+        let polar = unsafe { ffi_ref!(polar_ptr) };
+        let fields_json = serde_json::to_string(&polar.referenced_fields()).unwrap();
+        CString::new(fields_json)
+            .expect("JSON should not contain any 0 bytes")
+            .into_raw()
+    })
+}
+
 #[no_mangle]
 pub extern "C" fn polar_next_query_event(query_ptr: *mut Query) -> *const c_char {
     ffi_try!({
@@ -363,6 +455,27 @@ pub extern "C" fn polar_query_source_info(query_ptr: *mut Query) -> *const c_cha
     })
 }
 
+/// Get a handle that stops `query` with an error once it is passed to `polar_cancel`, even while
+/// `polar_next_query_event` is running on another thread. The handle stays valid after the query
+/// is freed, and must be freed itself with `cancel_handle_free`.
+#[no_mangle]
+pub extern "C" fn polar_query_cancel_handle(query_ptr: *mut Query) -> *mut CancelHandle {
+    ffi_try!({
+        let query = unsafe { ffi_ref!(query_ptr) };
+        box_ptr!(CancelHandle(query.cancel_flag()))
+    })
+}
+
+#[no_mangle]
+pub extern "C" fn polar_cancel(handle_ptr: *const CancelHandle) -> i32 {
+    ffi_try!({
+        assert!(!handle_ptr.is_null());
+        let handle = unsafe { &*handle_ptr };
+        handle.0.store(true, Ordering::Relaxed);
+        POLAR_SUCCESS
+    })
+}
+
 #[no_mangle]
 pub extern "C" fn polar_bind(
     query_ptr: *mut Query,
@@ -384,6 +497,18 @@ pub extern "C" fn polar_bind(
     })
 }
 
+/// Enable or disable tracing of policy evaluation for the given query,
+/// overriding the `POLAR_LOG` environment variable. `enabled` is treated as a
+/// bool. Trace messages are returned by `polar_next_query_message`.
+#[no_mangle]
+pub extern "C" fn polar_set_polar_log(query_ptr: *mut Query, enabled: u32) -> i32 {
+    ffi_try!({
+        let query = unsafe { ffi_ref!(query_ptr) };
+        query.set_polar_log(enabled != 0);
+        POLAR_SUCCESS
+    })
+}
+
 #[no_mangle]
 pub extern "C" fn polar_get_external_id(polar_ptr: *mut Polar) -> u64 {
     ffi_try!({
@@ -424,6 +549,16 @@ pub extern "C" fn query_free(query: *mut Query) -> i32 {
     })
 }
 
+/// Recovers the original boxed version of `handle` so that
+/// it can be properly freed
+#[no_mangle]
+pub extern "C" fn cancel_handle_free(handle: *mut CancelHandle) -> i32 {
+    ffi_try!({
+        std::mem::drop(unsafe { Box::from_raw(handle) });
+        POLAR_SUCCESS
+    })
+}
+
 #[no_mangle]
 pub extern "C" fn polar_build_filter_plan(
     polar_ptr: *mut Polar,
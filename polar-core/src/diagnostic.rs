@@ -1,8 +1,10 @@
 use std::fmt;
 
+use serde::Serialize;
+
 use super::error::PolarError;
 
-#[derive(Debug)]
+#[derive(Debug, Serialize)]
 pub enum Diagnostic {
     Error(PolarError),
     Warning(String),
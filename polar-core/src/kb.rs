@@ -67,6 +67,18 @@ impl KnowledgeBase {
         self.id_counter.clone()
     }
 
+    /// Create a knowledge base with the same constants and MROs as this one but no rules. It
+    /// shares this one's counters, so IDs and symbols generated by either never collide.
+    pub fn fork(&self) -> Self {
+        Self {
+            constants: self.constants.clone(),
+            mro: self.mro.clone(),
+            gensym_counter: self.gensym_counter.clone(),
+            id_counter: self.id_counter.clone(),
+            ..Self::new()
+        }
+    }
+
     /// Generate a temporary variable prefix from a variable name.
     pub fn temp_prefix(name: &str) -> String {
         match name {
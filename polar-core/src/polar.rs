@@ -14,10 +14,11 @@ use super::sources::*;
 use super::terms::*;
 use super::validations::{
     check_ambiguous_precedence, check_no_allow_rule, check_resource_blocks_missing_has_permission,
-    check_singletons,
+    check_singletons, referenced_classes, referenced_fields, unregistered_classes, FieldReference,
 };
 use super::vm::*;
 
+use std::sync::atomic::AtomicBool;
 use std::sync::{Arc, RwLock};
 
 pub struct Query {
@@ -42,6 +43,16 @@ impl Query {
         self.vm.set_logging_options(rust_log, polar_log);
     }
 
+    pub fn set_polar_log(&mut self, enabled: bool) {
+        self.vm.set_polar_log(enabled);
+    }
+
+    /// Get a flag that stops the query with an error once it is set, e.g. from another thread
+    /// while the query is running.
+    pub fn cancel_flag(&self) -> Arc<AtomicBool> {
+        self.vm.cancel_flag()
+    }
+
     /// Runnable lifecycle
     ///
     /// 1. Get Runnable A from the top of the Runnable stack, defaulting to the VM.
@@ -171,6 +182,16 @@ impl Polar {
         }
     }
 
+    /// Create a `Polar` with the same registered constants and MROs as this one but no rules, so
+    /// that a new policy can be loaded into it while queries against this one keep running.
+    pub fn fork(&self) -> Self {
+        Self {
+            kb: Arc::new(RwLock::new(self.kb.read().unwrap().fork())),
+            messages: MessageQueue::new(),
+            ignore_no_allow_warning: self.ignore_no_allow_warning,
+        }
+    }
+
     /// Load `sources` into the KB, returning compile-time diagnostics accumulated during the load.
     pub fn diagnostic_load(&self, sources: Vec<Source>) -> Vec<Diagnostic> {
         // we extract this into a separate function
@@ -314,15 +335,20 @@ impl Polar {
         diagnostics
     }
 
-    /// Load `Source`s into the KB.
-    pub fn load(&self, sources: Vec<Source>) -> PolarResult<()> {
+    /// Load `sources`, returning every error and warning found rather than
+    /// stopping at the first error. Nothing is loaded if there are errors.
+    pub fn load_with_diagnostics(&self, sources: Vec<Source>) -> PolarResult<Vec<Diagnostic>> {
         if self.kb.read().unwrap().has_rules() {
             let msg = MULTIPLE_LOAD_ERROR_MSG.to_owned();
             return Err(error::RuntimeError::FileLoading { msg }.into());
         }
+        Ok(self.diagnostic_load(sources))
+    }
 
+    /// Load `Source`s into the KB.
+    pub fn load(&self, sources: Vec<Source>) -> PolarResult<()> {
         let (mut errors, mut warnings) = (vec![], vec![]);
-        for diagnostic in self.diagnostic_load(sources) {
+        for diagnostic in self.load_with_diagnostics(sources)? {
             match diagnostic {
                 Diagnostic::Error(e) => errors.push(e),
                 Diagnostic::Warning(w) => warnings.push(w),
@@ -352,6 +378,35 @@ impl Polar {
         kb.clear_rules();
     }
 
+    /// Names of the rules defined in the knowledge base, in sorted order.
+    pub fn rule_names(&self) -> Vec<String> {
+        let kb = self.kb.read().unwrap();
+        let mut names: Vec<String> = kb.get_rules().keys().map(|name| name.0.clone()).collect();
+        names.sort();
+        names
+    }
+
+    /// Return the sorted names of the classes that loaded rules specialize on
+    /// or match against but that haven't been registered.
+    pub fn unregistered_classes(&self) -> Vec<String> {
+        let kb = self.kb.read().unwrap();
+        unregistered_classes(&kb)
+    }
+
+    /// Return the sorted names of the classes and constants that loaded rules
+    /// refer to, whether or not they have been registered.
+    pub fn referenced_classes(&self) -> Vec<String> {
+        let kb = self.kb.read().unwrap();
+        referenced_classes(&kb)
+    }
+
+    /// Return the fields that loaded rules look up on parameters specialized
+    /// on a class, sorted by class and then by name.
+    pub fn referenced_fields(&self) -> Vec<FieldReference> {
+        let kb = self.kb.read().unwrap();
+        referenced_fields(&kb)
+    }
+
     pub fn next_inline_query(&self, trace: bool) -> Option<Query> {
         let term = { self.kb.write().unwrap().inline_queries.pop() };
         term.map(|t| self.new_query_from_term(t, trace))
@@ -437,6 +492,32 @@ mod tests {
         let _ = polar.load_str("f(_);");
     }
 
+    #[test]
+    fn rule_names_are_sorted_and_cleared_with_rules() {
+        let polar = Polar::new();
+        polar.load_str("g(); f(1); f(2);").unwrap();
+        assert_eq!(polar.rule_names(), vec!["f".to_owned(), "g".to_owned()]);
+
+        polar.clear_rules();
+        assert!(polar.rule_names().is_empty());
+    }
+
+    #[test]
+    fn fork_keeps_constants_but_not_rules() {
+        let polar = Polar::new();
+        polar.register_constant(sym!("x"), term!(1)).unwrap();
+        polar.load_str("f(1);").unwrap();
+
+        let fork = polar.fork();
+        assert!(fork.rule_names().is_empty());
+        assert!(fork.kb.read().unwrap().is_constant(&sym!("x")));
+        assert_ne!(polar.get_external_id(), fork.get_external_id());
+
+        fork.load_str("g(2);").unwrap();
+        assert_eq!(polar.rule_names(), vec!["f".to_owned()]);
+        assert_eq!(fork.rule_names(), vec!["g".to_owned()]);
+    }
+
     #[test]
     fn loading_a_second_time_fails() {
         let polar = Polar::new();
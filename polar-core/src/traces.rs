@@ -24,10 +24,33 @@ impl Trace {
             None
         }
     }
+
+    /// The first rule applied in this trace, which for the trace of a query
+    /// result is the rule that produced it.
+    pub fn first_rule(&self) -> Option<Arc<Rule>> {
+        if let Node::Rule(r) = &self.node {
+            return Some(r.clone());
+        }
+        self.children.iter().find_map(|c| c.first_rule())
+    }
+}
+
+/// Where a rule is defined in a loaded policy.
+#[derive(Clone, Debug, PartialEq, Serialize, Deserialize)]
+pub struct RuleSource {
+    /// The source of the rule's head, e.g. `allow(actor, "read", resource)`.
+    pub src: String,
+    pub filename: Option<String>,
+    pub line: usize,
+    pub column: usize,
 }
 
 #[derive(Clone, Debug, PartialEq, Serialize, Deserialize)]
 pub struct TraceResult {
     pub trace: Rc<Trace>,
     pub formatted: String,
+    /// The source of the rule that produced the result, if it was loaded
+    /// from a policy.
+    #[serde(default)]
+    pub rule_source: Option<RuleSource>,
 }
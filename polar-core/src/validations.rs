@@ -6,7 +6,9 @@ use super::sources::Source;
 use super::terms::*;
 use super::visitor::{walk_call, walk_rule, walk_term, Visitor};
 
-use std::collections::{hash_map::Entry, HashMap, HashSet};
+use std::collections::{hash_map::Entry, BTreeSet, HashMap, HashSet};
+
+use serde::Serialize;
 
 fn common_misspellings(t: &str) -> Option<String> {
     let misspelled_type = match t {
@@ -322,10 +324,146 @@ pub fn check_undefined_rule_calls(kb: &KnowledgeBase) -> Vec<Diagnostic> {
     visitor.errors()
 }
 
+/// Collect the classes that rules refer to.
+struct ClassReferenceVisitor<'kb> {
+    kb: &'kb KnowledgeBase,
+    /// Classes that rules specialize on or match against.
+    patterns: BTreeSet<String>,
+    /// Registered constants that rules refer to by name, and classes that
+    /// rules construct with `new`.
+    others: BTreeSet<String>,
+}
+
+impl<'kb> ClassReferenceVisitor<'kb> {
+    fn new(kb: &'kb KnowledgeBase) -> Self {
+        let mut visitor = Self {
+            kb,
+            patterns: BTreeSet::new(),
+            others: BTreeSet::new(),
+        };
+        for rule in kb.get_rules().values() {
+            visitor.visit_generic_rule(rule);
+        }
+        visitor
+    }
+}
+
+impl<'kb> Visitor for ClassReferenceVisitor<'kb> {
+    fn visit_term(&mut self, term: &Term) {
+        match term.value() {
+            Value::Pattern(Pattern::Instance(InstanceLiteral { tag, .. })) => {
+                if !self.kb.is_union(term) {
+                    self.patterns.insert(tag.0.clone());
+                }
+            }
+            Value::Expression(op) if op.operator == Operator::New => {
+                if let Some(Value::Call(call)) = op.args.first().map(|arg| arg.value()) {
+                    self.others.insert(call.name.0.clone());
+                }
+            }
+            Value::Variable(sym) if self.kb.is_constant(sym) => {
+                self.others.insert(sym.0.clone());
+            }
+            _ => {}
+        }
+        walk_term(self, term)
+    }
+}
+
+/// Return the sorted names of the classes referenced by rules that haven't
+/// been registered.
+pub fn unregistered_classes(kb: &KnowledgeBase) -> Vec<String> {
+    let visitor = ClassReferenceVisitor::new(kb);
+    visitor
+        .patterns
+        .into_iter()
+        .filter(|class| !kb.is_constant(&Symbol(class.clone())))
+        .collect()
+}
+
+/// Return the sorted names of the classes and constants that rules refer to,
+/// whether or not they have been registered.
+pub fn referenced_classes(kb: &KnowledgeBase) -> Vec<String> {
+    let visitor = ClassReferenceVisitor::new(kb);
+    let mut classes = visitor.patterns;
+    classes.extend(visitor.others);
+    classes.into_iter().collect()
+}
+
+/// A field that a rule looks up on a parameter specialized on a class.
+#[derive(Debug, Clone, PartialEq, Eq, PartialOrd, Ord, Serialize)]
+pub struct FieldReference {
+    pub class: String,
+    pub field: String,
+}
+
+/// Collect the fields that rules look up on their specialized parameters.
+struct FieldReferenceVisitor<'kb> {
+    kb: &'kb KnowledgeBase,
+    /// The classes that the parameters of the rule being visited are
+    /// specialized on, keyed by parameter name.
+    params: HashMap<Symbol, String>,
+    fields: BTreeSet<FieldReference>,
+}
+
+impl<'kb> Visitor for FieldReferenceVisitor<'kb> {
+    fn visit_rule(&mut self, rule: &Rule) {
+        self.params = HashMap::new();
+        for param in &rule.params {
+            if let (Value::Variable(name), Some(specializer)) =
+                (param.parameter.value(), &param.specializer)
+            {
+                if let Value::Pattern(Pattern::Instance(InstanceLiteral { tag, .. })) =
+                    specializer.value()
+                {
+                    if !self.kb.is_union(specializer) {
+                        self.params.insert(name.clone(), tag.0.clone());
+                    }
+                }
+            }
+        }
+        walk_rule(self, rule)
+    }
+
+    fn visit_term(&mut self, term: &Term) {
+        if let Value::Expression(op) = term.value() {
+            if op.operator == Operator::Dot && op.args.len() >= 2 {
+                if let (Value::Variable(name), Value::String(field)) =
+                    (op.args[0].value(), op.args[1].value())
+                {
+                    if let Some(class) = self.params.get(name) {
+                        self.fields.insert(FieldReference {
+                            class: class.clone(),
+                            field: field.clone(),
+                        });
+                    }
+                }
+            }
+        }
+        walk_term(self, term)
+    }
+}
+
+/// Return the fields, sorted by class and then by name, that rules look up
+/// directly on parameters specialized on a class, e.g. `name` for
+/// `f(x: Foo) if x.name = "a";`.
+pub fn referenced_fields(kb: &KnowledgeBase) -> Vec<FieldReference> {
+    let mut visitor = FieldReferenceVisitor {
+        kb,
+        params: HashMap::new(),
+        fields: BTreeSet::new(),
+    };
+    for rule in kb.get_rules().values() {
+        visitor.visit_generic_rule(rule);
+    }
+    visitor.fields.into_iter().collect()
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
     use crate::kb::KnowledgeBase;
+    use crate::resource_block::ACTOR_UNION_NAME;
 
     #[test]
     fn test_check_no_allow_rule_no_allow() {
@@ -392,6 +530,57 @@ mod tests {
         assert!(check_resource_blocks_missing_has_permission(&kb).is_none());
     }
 
+    #[test]
+    fn test_unregistered_classes() {
+        let mut kb = KnowledgeBase::new();
+        kb.register_constant(sym!("Registered"), term!("unimportant"))
+            .unwrap();
+        kb.add_rule(rule!("f", ["x"; instance!("Registered")]));
+        kb.add_rule(rule!("g", ["x"; instance!("Missing")]));
+        kb.add_rule(rule!("h", ["x"; instance!(ACTOR_UNION_NAME)]));
+        kb.add_rule(rule!("i", ["x"; instance!("Other"), "y"; instance!("Missing")]));
+        assert_eq!(unregistered_classes(&kb), vec!["Missing", "Other"]);
+    }
+
+    #[test]
+    fn test_referenced_classes() {
+        let mut kb = KnowledgeBase::new();
+        kb.register_constant(sym!("Registered"), term!("unimportant"))
+            .unwrap();
+        kb.register_constant(sym!("Unused"), term!("unimportant"))
+            .unwrap();
+        kb.register_constant(sym!("Constant"), term!("unimportant"))
+            .unwrap();
+        kb.add_rule(rule!("f", ["x"; instance!("Registered")]));
+        kb.add_rule(rule!("g", ["x"; instance!("Missing")]));
+        kb.add_rule(rule!("h", ["x"; instance!(ACTOR_UNION_NAME)]));
+        kb.add_rule(
+            rule!("i", [sym!("x")] => op!(Unify, term!(sym!("x")), term!(sym!("Constant")))),
+        );
+        assert_eq!(
+            referenced_classes(&kb),
+            vec!["Constant", "Missing", "Registered"]
+        );
+    }
+
+    #[test]
+    fn test_referenced_fields() {
+        let mut kb = KnowledgeBase::new();
+        kb.add_rule(rule!("f", ["x"; instance!("Foo"), "y"; instance!("Bar")] =>
+            op!(Dot, term!(sym!("x")), term!("name"), term!(sym!("a"))),
+            op!(Dot, term!(sym!("y")), term!(call!("method", [sym!("a")])), term!(sym!("b")))));
+        kb.add_rule(rule!("g", ["x"; instance!(ACTOR_UNION_NAME), sym!("y")] =>
+            op!(Dot, term!(sym!("x")), term!("id"), term!(sym!("a"))),
+            op!(Dot, term!(sym!("y")), term!("unspecialized"), term!(sym!("b")))));
+        assert_eq!(
+            referenced_fields(&kb),
+            vec![FieldReference {
+                class: "Foo".to_owned(),
+                field: "name".to_owned()
+            }]
+        );
+    }
+
     #[test]
     fn test_undefined_rule_error() {
         let mut kb = KnowledgeBase::new();
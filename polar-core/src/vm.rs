@@ -4,6 +4,7 @@ use std::collections::{HashMap, HashSet};
 use std::fmt::Write;
 use std::rc::Rc;
 use std::string::ToString;
+use std::sync::atomic::{AtomicBool, Ordering};
 use std::sync::{Arc, RwLock, RwLockReadGuard};
 
 #[cfg(target_arch = "wasm32")]
@@ -231,6 +232,8 @@ pub struct PolarVirtualMachine {
     #[cfg(target_arch = "wasm32")]
     query_start_time: Option<f64>,
     query_timeout_ms: u64,
+    /// Set from outside the VM, possibly from another thread, to stop the query.
+    cancelled: Arc<AtomicBool>,
 
     /// Maximum size of goal stack
     stack_limit: usize,
@@ -310,6 +313,7 @@ impl PolarVirtualMachine {
             binding_manager: BindingManager::new(),
             query_start_time: None,
             query_timeout_ms,
+            cancelled: Arc::new(AtomicBool::new(false)),
             stack_limit: MAX_STACK_SIZE,
             csp: Bsp::default(),
             choices: vec![],
@@ -352,6 +356,14 @@ impl PolarVirtualMachine {
         }
     }
 
+    /// Enable or disable tracing of policy evaluation, overriding the
+    /// `POLAR_LOG` environment variable. Trace messages are pushed to the
+    /// message queue rather than printed to stderr.
+    pub fn set_polar_log(&mut self, enabled: bool) {
+        self.polar_log = enabled;
+        self.polar_log_stderr = false;
+    }
+
     fn query_contains_partial(&mut self) {
         struct VarVisitor<'vm> {
             has_partial: bool,
@@ -438,6 +450,7 @@ impl PolarVirtualMachine {
         }
 
         self.check_timeout()?;
+        self.check_cancelled()?;
 
         match goal.as_ref() {
             Goal::Backtrack => self.backtrack()?,
@@ -866,6 +879,22 @@ impl PolarVirtualMachine {
         self.query_timeout_ms == 0
     }
 
+    /// Get the flag that stops the query once it is set. The VM checks it before each goal, so a
+    /// query can be stopped from another thread even while it runs without emitting any events.
+    pub fn cancel_flag(&self) -> Arc<AtomicBool> {
+        self.cancelled.clone()
+    }
+
+    fn check_cancelled(&self) -> PolarResult<()> {
+        if self.cancelled.load(Ordering::Relaxed) {
+            return Err(error::RuntimeError::QueryTimeout {
+                msg: "Query was canceled.".to_owned(),
+            }
+            .into());
+        }
+        Ok(())
+    }
+
     fn check_timeout(&self) -> PolarResult<()> {
         if self.is_query_timeout_disabled() {
             // Useful for debugging
@@ -2806,6 +2835,27 @@ impl PolarVirtualMachine {
         rule.to_polar()
     }
 
+    /// Get where a rule parsed from a policy is defined.
+    pub fn rule_source_info(&self, rule: &Rule) -> Option<RuleSource> {
+        if let SourceInfo::Parser {
+            src_id,
+            left,
+            right,
+        } = rule.source_info
+        {
+            let source = self.kb.read().unwrap().sources.get_source(src_id)?;
+            let (row, column) = loc_to_pos(&source.src, left);
+            Some(RuleSource {
+                src: source.src.chars().take(right).skip(left).collect(),
+                filename: source.filename,
+                line: row + 1,
+                column,
+            })
+        } else {
+            None
+        }
+    }
+
     fn set_error_context(
         &self,
         term: &Term,
@@ -2886,6 +2936,7 @@ impl Runnable for PolarVirtualMachine {
             let trace = self.trace.first().cloned();
             trace.map(|trace| TraceResult {
                 formatted: trace.draw(self),
+                rule_source: trace.first_rule().and_then(|r| self.rule_source_info(&r)),
                 trace,
             })
         } else {
@@ -3798,6 +3849,20 @@ mod tests {
         );
     }
 
+    #[test]
+    fn test_cancel() {
+        let mut vm = PolarVirtualMachine::default();
+        vm.push_goal(query!(op!(And))).unwrap();
+        vm.cancel_flag().store(true, Ordering::Relaxed);
+        assert!(matches!(
+            vm.run(None),
+            Err(PolarError {
+                kind: ErrorKind::Runtime(RuntimeError::QueryTimeout { .. }),
+                ..
+            })
+        ));
+    }
+
     #[test]
     fn test_timeout() {
         let vm = PolarVirtualMachine::default();